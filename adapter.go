@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+)
+
+// printAdapterInfo prints the device, driver and backend of adapter, to tell apart performance differences
+// between machines. Software renderers report a CPU adapter, which is what WGPU_FORCE_FALLBACK_ADAPTER selects.
+func printAdapterInfo(adapter *wgpu.Adapter) {
+	info := adapter.GetInfo()
+	fmt.Printf("GPU adapter: %s (%s, vendor %s)\n", info.Name, info.AdapterType, info.VendorName)
+	fmt.Printf("  backend: %s, driver: %s\n", info.BackendType, info.DriverDescription)
+	fmt.Printf("  fallback adapter: %t (forced: %t)\n", info.AdapterType == wgpu.AdapterTypeCPU, forceFallbackAdapter)
+}
+
+// backends maps the values of -backend to the backends adapters are requested from.
+var backends = map[string]wgpu.BackendType{
+	"vulkan": wgpu.BackendTypeVulkan,
+	"metal":  wgpu.BackendTypeMetal,
+	"dx12":   wgpu.BackendTypeD3D12,
+	"gl":     wgpu.BackendTypeOpenGL,
+}
+
+// powerPreferences maps the values of -power-preference to the preferences adapters are requested with.
+var powerPreferences = map[string]wgpu.PowerPreference{
+	"low":  wgpu.PowerPreferenceLowPower,
+	"high": wgpu.PowerPreferenceHighPerformance,
+}
+
+// requestAdapter requests an adapter that can present to surface, which may be nil, from the backend and with
+// the power preference in cfg. If there is no such adapter, it says so and falls back to any adapter.
+// The instance keeps all backends enabled, so the surface works with the adapter of the fallback.
+func requestAdapter(ctx context.Context, instance *wgpu.Instance, surface *wgpu.Surface, cfg Config) (*wgpu.Adapter, error) {
+	options := wgpu.RequestAdapterOptions{
+		ForceFallbackAdapter: forceFallbackAdapter,
+		CompatibleSurface:    surface,
+		PowerPreference:      powerPreferences[cfg.PowerPreference],
+		BackendType:          backends[cfg.Backend],
+	}
+	request := func() (*wgpu.Adapter, error) {
+		return instance.RequestAdapter(&options)
+	}
+	adapter, err := withContext(ctx, "adapter request", request)
+	if err == nil || ctx.Err() != nil || (cfg.Backend == "" && cfg.PowerPreference == "") {
+		return adapter, err
+	}
+	fmt.Printf("warning: no adapter found for backend %q and power preference %q, using any adapter: %v\n", cfg.Backend, cfg.PowerPreference, err)
+	options.BackendType = wgpu.BackendTypeUndefined
+	options.PowerPreference = wgpu.PowerPreferenceUndefined
+	return withContext(ctx, "adapter request", request)
+}
+
+// PrintAdapter requests the adapter the simulation would run on and prints its info with printAdapterInfo.
+func PrintAdapter(ctx context.Context, cfg Config) error {
+	instance := wgpu.CreateInstance(nil)
+	defer instance.Release()
+
+	adapter, err := requestAdapter(ctx, instance, nil, cfg)
+	if err != nil {
+		return err
+	}
+	defer adapter.Release()
+
+	printAdapterInfo(adapter)
+	return nil
+}
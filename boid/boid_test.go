@@ -0,0 +1,62 @@
+package boid
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBoidsRoundTrip(t *testing.T) {
+	boids := []Boid{
+		{Pos: Vec3{0.1, -0.2, 0.3}, Vel: Vec3{0.01, 0.02, -0.03}, Neighbors: 5, Force: 0.5, Flock: 2, SpeedJitter: -0.1},
+		{Pos: Vec3{X: -1, Y: 1}, Vel: Vec3{X: 0.2}, Predator: true},
+	}
+	data := FlattenBoids(boids)
+	if len(data) != len(boids)*Stride {
+		t.Fatalf("got %d values, want %d", len(data), len(boids)*Stride)
+	}
+	got, err := Boids(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, boids) {
+		t.Errorf("got %+v, want %+v", got, boids)
+	}
+}
+
+func TestBoidsLayout(t *testing.T) {
+	data := []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 1, 0.25, 0}
+	got, err := Boids(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Boid{{Pos: Vec3{1, 2, 3}, Neighbors: 4, Vel: Vec3{5, 6, 7}, Force: 8, Flock: 9, Predator: true, SpeedJitter: 0.25}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBoidsRejectsPartialBoids(t *testing.T) {
+	for _, n := range []int{1, Stride - 1, Stride + 4} {
+		_, err := Boids(make([]float32, n))
+		if err == nil {
+			t.Errorf("got no error for %d values", n)
+		}
+	}
+	boids, err := Boids(nil)
+	if err != nil || len(boids) != 0 {
+		t.Errorf("got %v, %v for no values, want no boids", boids, err)
+	}
+}
+
+func TestVec3(t *testing.T) {
+	v := Vec3{3, 4, 12}
+	if got := v.Len(); got != 13 {
+		t.Errorf("got length %v, want 13", got)
+	}
+	if got, want := v.Add(Vec3{1, -1, 0}), (Vec3{4, 3, 12}); got != want {
+		t.Errorf("got sum %v, want %v", got, want)
+	}
+	if got, want := v.Scale(0.5), (Vec3{1.5, 2, 6}); got != want {
+		t.Errorf("got %v scaled, want %v", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// budgetWindow is the number of frames averaged before the particle count is adapted.
+	budgetWindow = 30
+	// budgetStep is the fraction of the particle count that is removed or added per adaptation.
+	budgetStep = 0.1
+	// budgetHeadroom is the fraction of the target frame time below which particles are added again.
+	// The gap between it and the target keeps the count from oscillating.
+	budgetHeadroom = 0.7
+)
+
+// FrameBudget adapts the number of simulated particles so frames stay within a target frame time.
+type FrameBudget struct {
+	Target   time.Duration
+	Min, Max uint32
+
+	frames int
+	total  time.Duration
+}
+
+// Observe records the duration of a frame rendered with count particles. At the end of each window it
+// returns the new particle count and true if the average frame time left the hysteresis band.
+func (b *FrameBudget) Observe(frameTime time.Duration, count uint32) (uint32, bool) {
+	b.frames++
+	b.total += frameTime
+	if b.frames < budgetWindow {
+		return count, false
+	}
+	average := b.total / time.Duration(b.frames)
+	b.frames, b.total = 0, 0
+
+	step := max(uint32(float64(count)*budgetStep), 1)
+	switch {
+	case average > b.Target && count > b.Min:
+		return max(count-step, b.Min), true
+	case average < time.Duration(float64(b.Target)*budgetHeadroom) && count < b.Max:
+		return min(count+step, b.Max), true
+	}
+	return count, false
+}
+
+// SetActiveParticles changes the number of simulated, drawn and published particles.
+// It is clamped between 1 and the capacity of the particle buffer.
+func (s *State) SetActiveParticles(count uint32) {
+	count = min(max(count, 1), s.numParticles)
+	s.particleCount = count
+	s.params.ParticleCount = count
+}
+
+// adaptParticles feeds the frame time into the budget and applies and logs any change.
+func (s *State) adaptParticles(budget *FrameBudget, frameTime time.Duration) {
+	count, changed := budget.Observe(frameTime, s.particleCount)
+	if !changed || count == s.particleCount {
+		return
+	}
+	fmt.Printf("frame budget %v: adapting particle count from %d to %d\n", budget.Target, s.particleCount, count)
+	s.SetActiveParticles(count)
+}
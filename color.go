@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+	"strconv"
+	"strings"
+)
+
+// Color is an RGBA color with components between 0 and 1, laid out like a vec4<f32>.
+type Color [4]float32
+
+// ParseHexColor parses a color in the form "#rrggbb". The alpha of the returned color is 1.
+func ParseHexColor(s string) (Color, error) {
+	hex, ok := strings.CutPrefix(s, "#")
+	if !ok || len(hex) != 6 {
+		return Color{}, fmt.Errorf("color %q must have the form #rrggbb", s)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return Color{}, fmt.Errorf("color %q must have the form #rrggbb", s)
+	}
+	return Color{
+		float32(rgb>>16&0xff) / 255,
+		float32(rgb>>8&0xff) / 255,
+		float32(rgb&0xff) / 255,
+		1,
+	}, nil
+}
+
+// WGPU returns the color as a wgpu.Color, e.g. for clearing a render pass.
+func (c Color) WGPU() wgpu.Color {
+	return wgpu.Color{R: float64(c[0]), G: float64(c[1]), B: float64(c[2]), A: float64(c[3])}
+}
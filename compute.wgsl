@@ -1,6 +1,21 @@
+// In 2D runs z is always 0, which keeps all forces in the xy-plane.
+// The scalars fill the padding after each vec3, see boid.Stride.
 struct Boid {
-    position: vec2<f32>,
-    velocity: vec2<f32>,
+    position: vec3<f32>,
+    neighbors: f32, // number of boids within the perception radius, written each step
+    velocity: vec3<f32>,
+    forceMag: f32, // magnitude of the net steering force before clamping, written each step
+    flock: f32, // index of the flock, boids only flock with boids of the same flock
+    predator: f32, // 1 for predators, which are at the start of the buffer, 0 for prey
+    speedJitter: f32, // relative deviation of the maximum speed and force of this boid, 0 for none
+}
+
+// Scales of the rule weights for one flock
+struct FlockWeights {
+    alignment: f32,
+    cohesion: f32,
+    separation: f32,
+    padding: f32, // array elements of uniforms are 16 byte aligned
 }
 
 struct SimParams {
@@ -10,13 +25,107 @@ struct SimParams {
     alignmentWeight: f32,
     cohesionWeight: f32,
     separationWeight: f32,
-    perceptionRadius: f32,
+    perceptionRadius: f32, // the largest of the rule radii
+    smoothing: f32,
+    sampleSize: u32, // 0 = consider all boids, otherwise the number of randomly sampled boids
+    frame: u32,
+    maxTurnRate: f32, // radians per second
+    lookahead: f32, // how far ahead of a boid obstacles are detected
+    obstacleCount: u32,
+    particleCount: u32, // boids beyond this index are not simulated
+    boundaryMode: u32, // one of the BOUNDARY_ constants
+    attractorX: f32, // the point is split into scalars to match the Go struct without padding
+    attractorY: f32,
+    attractorMode: u32, // one of the ATTRACTOR_ constants
+    flockCount: u32,
+    predatorCount: u32, // the first predatorCount boids are predators
+    flocks: array<FlockWeights, MAX_FLOCKS>, // only the first flockCount entries are used
+    neighborGrid: u32, // 1 if the grid passes sorted the boids into cells, see grid.go
+    aspectX: f32, // scale offsets to their proportions on screen, the shorter side is 1
+    aspectY: f32,
+    perceptionRadiusSq: f32, // perceptionRadius squared, for comparing squared distances
+    separationRadius: f32, // neighbors within these distances contribute to the rules
+    alignmentRadius: f32,
+    cohesionRadius: f32,
+    falloff: f32, // alignment and cohesion weight neighbors by 1 / distance^falloff
+    windX: f32, // the wind pushes every boid alike
+    windY: f32,
+    windPeriod: f32, // seconds for the wind to oscillate back and forth, 0 for a constant wind
+    time: f32, // simulated seconds
+    turbulence: f32, // weight of the turbulence force, 0 disables it
+    turbulenceScale: f32, // spatial frequency of the turbulence
+    minSpeed: f32, // slower boids are sped up to it, 0 lets them halt
+    fieldOfView: f32, // degrees around the heading in which neighbors are seen
+    fieldOfViewCos: f32, // cosine of half the field of view, below -1 to see all around
+    marginSize: f32, // distance from the edges within which boids steer inwards with BOUNDARY_MARGIN
+    turnForce: f32, // how strongly they steer inwards, relative to the maximum force
+}
+
+struct Obstacle {
+    center: vec2<f32>,
+    radius: f32,
 }
 
+// Sums of the neighbor properties that drive the flocking rules
+struct Neighborhood {
+    alignment: vec3<f32>,
+    cohesion: vec3<f32>,
+    separation: vec3<f32>,
+    count: i32, // neighbors within the perception radius
+    cohesionWeight: f32, // sum of the weights of the neighbor positions in cohesion
+}
+
+// Must match MaxFlocks in flocks.go
+const MAX_FLOCKS = 8;
+// Invocations per workgroup, chosen from the adapter limits and filled in by computeShaderCode
+const WORKGROUP_SIZE = {{.WorkgroupSize}}u;
+// Must match gridMaxWidth in grid.go
+const MAX_GRID_WIDTH = 128u;
+const GRID_CELLS = MAX_GRID_WIDTH * MAX_GRID_WIDTH;
+// Cells each invocation of grid_scan is responsible for
+const SCAN_CHUNK = GRID_CELLS / WORKGROUP_SIZE;
+// How strongly prey flee from predators and predators chase prey, relative to maxForce
+const FLEE_WEIGHT = 2.0;
+const SEEK_WEIGHT = 1.0;
+// Predators are a bit faster than prey, so they can catch up
+const PREDATOR_SPEED = 1.2;
+// Avoiding obstacles is more important than flocking, so its force is scaled up
+const AVOIDANCE_WEIGHT = 2.0;
+// How fast the turbulence noise field moves, in noise cells per simulated second
+const TURBULENCE_DRIFT = 0.3;
+// Limit of the summed steering forces relative to maxForce. It leaves room for the weighted rules to add up,
+// but bounds extreme weights.
+const MAX_COMBINED_FORCE = 4.0;
+// Time step the steering forces and the smoothing are tuned for, one frame at 60 fps. Other time steps scale
+// them, so a frame simulated in several shorter steps steers as much as in one.
+const REFERENCE_DELTA_TIME = 1.0 / 60.0;
+// Distances below this get the same falloff weight, so that overlapping boids don't get an infinite one
+const MIN_FALLOFF_DISTANCE = 0.0001;
+// Boundary modes, see BoundaryMode in params.go
+const BOUNDARY_WRAP = 0u;
+const BOUNDARY_BOUNCE = 1u;
+const BOUNDARY_MARGIN = 2u;
+// Attractor modes, see AttractorMode in params.go
+const ATTRACTOR_OFF = 0u;
+const ATTRACTOR_ATTRACT = 1u;
+const ATTRACTOR_REPEL = 2u;
+// Distance within which the attractor affects boids, and how strong it is relative to maxForce
+const ATTRACTOR_RANGE = 1.0;
+const ATTRACTOR_WEIGHT = 1.5;
+
 @group(0) @binding(0) var<storage, read_write> boids: array<Boid>;
 @group(0) @binding(1) var<uniform> params: SimParams;
+@group(0) @binding(2) var<storage, read> obstacles: array<Obstacle>;
+// Forces set from Go, in the same units as the steering forces. They act in the xy-plane and are capped at maxForce.
+@group(0) @binding(3) var<storage, read> externalForces: array<vec2<f32>>;
+// The neighbor grid. Boid indices are sorted by cell into sortedIndices, where cell c takes the
+// cellCounts[c] entries from cellOffsets[c] on. boidSlots holds the cell and the rank within it of each boid.
+@group(0) @binding(4) var<storage, read_write> cellCounts: array<atomic<u32>>;
+@group(0) @binding(5) var<storage, read_write> cellOffsets: array<u32>;
+@group(0) @binding(6) var<storage, read_write> boidSlots: array<vec2<u32>>;
+@group(0) @binding(7) var<storage, read_write> sortedIndices: array<u32>;
 
-fn limit_vector(v: vec2<f32>, max_length: f32) -> vec2<f32> {
+fn limit_vector(v: vec3<f32>, max_length: f32) -> vec3<f32> {
     let length_sq = dot(v, v);
     if (length_sq > 0.0) {
         if (length_sq > max_length * max_length) {
@@ -24,52 +133,450 @@ fn limit_vector(v: vec2<f32>, max_length: f32) -> vec2<f32> {
         }
         return v;
     }
-    return vec2<f32>(0.0);
+    return vec3<f32>(0.0);
 }
 
+// Speeds v up to min_length, keeping its direction. A zero vector has no direction and stays zero.
+fn raise_speed(v: vec3<f32>, min_length: f32) -> vec3<f32> {
+    let len = length(v);
+    if (len == 0.0 || len >= min_length) {
+        return v;
+    }
+    return v * (min_length / len);
+}
 
-@compute @workgroup_size(256)
+// Rotates v towards desired by at most max_angle radians and returns it with the length of desired.
+fn limit_turn(v: vec3<f32>, desired: vec3<f32>, max_angle: f32) -> vec3<f32> {
+    let speed = length(desired);
+    if (dot(v, v) == 0.0 || speed == 0.0) {
+        return desired;
+    }
+    let heading = normalize(v);
+    let desired_dir = desired / speed;
+    let cos_delta = dot(heading, desired_dir);
+    if (acos(clamp(cos_delta, -1.0, 1.0)) <= max_angle) {
+        return desired;
+    }
+    // Turn within the plane spanned by both directions, towards the part of desired perpendicular to v
+    var side = desired_dir - heading * cos_delta;
+    if (dot(side, side) < 1e-12) {
+        // desired points straight back, any perpendicular works. Prefer one in the xy-plane.
+        side = vec3<f32>(-heading.y, heading.x, 0.0);
+        if (dot(side, side) < 1e-12) {
+            side = vec3<f32>(1.0, 0.0, 0.0);
+        }
+    }
+    side = normalize(side);
+    return (heading * cos(max_angle) + side * sin(max_angle)) * speed;
+}
+
+// Casts a ray from the boid along its velocity and returns a steering direction perpendicular to the
+// heading that avoids the nearest obstacle on that ray. The closer the obstacle, the stronger the steering.
+// Obstacles are circles in the xy-plane, which extend along z as cylinders in 3D.
+fn avoid_obstacles(b: Boid) -> vec3<f32> {
+    let speed = length(b.velocity.xy);
+    if (params.obstacleCount == 0u || params.lookahead <= 0.0 || speed == 0.0) {
+        return vec3<f32>(0.0);
+    }
+    let dir = b.velocity.xy / speed;
+    var nearest = params.lookahead;
+    var steer = vec2<f32>(0.0);
+    for (var i = 0u; i < params.obstacleCount; i++) {
+        let o = obstacles[i];
+        // Point on the ray that is closest to the obstacle center
+        let t = dot(o.center - b.position.xy, dir);
+        let offset = b.position.xy + dir * t - o.center;
+        let dist_sq = dot(offset, offset);
+        if (dist_sq >= o.radius * o.radius) {
+            continue; // the ray misses this obstacle
+        }
+        let half_chord = sqrt(o.radius * o.radius - dist_sq);
+        let hit = t - half_chord;
+        if (hit > nearest || t + half_chord < 0.0) {
+            continue; // too far ahead, or behind the boid
+        }
+        nearest = max(hit, 0.0);
+        // Turn towards the side of the obstacle the ray is already closer to
+        var side = vec2<f32>(-dir.y, dir.x);
+        if (dot(side, offset) < 0.0) {
+            side = -side;
+        }
+        steer = side * (1.0 - nearest / params.lookahead);
+    }
+    return vec3<f32>(steer, 0.0);
+}
+
+// Returns a direction straight out of every obstacle the boid is inside of, so boids that start or
+// get pushed into an obstacle leave it instead of circling inside.
+fn escape_obstacles(b: Boid) -> vec3<f32> {
+    var escape = vec2<f32>(0.0);
+    for (var i = 0u; i < params.obstacleCount; i++) {
+        let o = obstacles[i];
+        let offset = b.position.xy - o.center;
+        let d = length(offset);
+        if (d >= o.radius) {
+            continue;
+        }
+        if (d == 0.0) {
+            escape += vec2<f32>(1.0, 0.0); // exactly at the center, any direction leads out
+        } else {
+            escape += offset / d;
+        }
+    }
+    if (dot(escape, escape) == 0.0) {
+        return vec3<f32>(0.0);
+    }
+    return vec3<f32>(normalize(escape), 0.0);
+}
+
+// Returns the force towards (or away from) the attractor point. It is strongest at the point and fades out
+// linearly until ATTRACTOR_RANGE. The point lies in the plane z = 0.
+fn attractor_force(b: Boid) -> vec3<f32> {
+    if (params.attractorMode == ATTRACTOR_OFF) {
+        return vec3<f32>(0.0);
+    }
+    let offset = vec3<f32>(params.attractorX, params.attractorY, 0.0) - b.position;
+    let d = length(offset);
+    if (d == 0.0 || d >= ATTRACTOR_RANGE) {
+        return vec3<f32>(0.0);
+    }
+    var force = offset / d * params.maxForce * ATTRACTOR_WEIGHT * (1.0 - d / ATTRACTOR_RANGE);
+    if (params.attractorMode == ATTRACTOR_REPEL) {
+        force = -force;
+    }
+    return force;
+}
+
+// Returns the wind, which is the same everywhere. An oscillating wind follows a sine over windPeriod.
+fn wind_force() -> vec3<f32> {
+    var strength = 1.0;
+    if (params.windPeriod > 0.0) {
+        strength = sin(params.time * 6.2831853 / params.windPeriod);
+    }
+    return vec3<f32>(params.windX, params.windY, 0.0) * strength;
+}
+
+// Returns the value noise at p together with its gradient as (value, d/dx, d/dy). The value is smoothly
+// interpolated between pseudo-random values at integer lattice points, so four hashes per sample suffice.
+fn value_noise(p: vec2<f32>) -> vec3<f32> {
+    let cell = floor(p);
+    let f = p - cell;
+    // Smoothstep interpolation and its derivative
+    let u = f * f * (3.0 - 2.0 * f);
+    let du = 6.0 * f * (1.0 - f);
+    let i = vec2<i32>(cell);
+    let a = lattice_value(i);
+    let b = lattice_value(i + vec2<i32>(1, 0));
+    let c = lattice_value(i + vec2<i32>(0, 1));
+    let d = lattice_value(i + vec2<i32>(1, 1));
+    let value = mix(mix(a, b, u.x), mix(c, d, u.x), u.y);
+    let gradient = vec2<f32>(du.x * mix(b - a, d - c, u.y), du.y * mix(c - a, d - b, u.x));
+    return vec3<f32>(value, gradient);
+}
+
+// Returns a pseudo-random value in [0, 1] for a lattice point of value_noise
+fn lattice_value(i: vec2<i32>) -> f32 {
+    return f32(hash((bitcast<u32>(i.x) * 73856093u) ^ (bitcast<u32>(i.y) * 19349663u))) / 4294967295.0;
+}
+
+// Returns the turbulence force at the boid. The noise gradient is turned by 90 degrees, so boids circle
+// around the peaks of the noise instead of gathering on them. The noise field drifts over time.
+fn turbulence_force(b: Boid) -> vec3<f32> {
+    if (params.turbulence == 0.0) {
+        return vec3<f32>(0.0);
+    }
+    let p = b.position.xy * params.turbulenceScale + vec2<f32>(params.time * TURBULENCE_DRIFT);
+    let gradient = value_noise(p).yz;
+    let swirl = vec3<f32>(gradient.y, -gradient.x, 0.0);
+    return limit_vector(swirl * params.maxForce, params.maxForce) * params.turbulence;
+}
+
+// Returns the force that drives prey away from all predators within the perception radius, strongest
+// when a predator is close. Predators are at the start of the buffer, so this only looks at predatorCount boids.
+fn flee_predators(b: Boid, total: u32) -> vec3<f32> {
+    var flee = vec3<f32>(0.0);
+    for (var i = 0u; i < min(params.predatorCount, total); i++) {
+        let offset = b.position - boids[i].position;
+        let d = length(offset);
+        if (d == 0.0 || d >= params.perceptionRadius) {
+            continue;
+        }
+        flee += offset / d * (1.0 - d / params.perceptionRadius);
+    }
+    return limit_vector(flee, 1.0) * params.maxForce * FLEE_WEIGHT;
+}
+
+// Returns the steering force of a predator towards the nearest prey.
+fn seek_prey(b: Boid, total: u32) -> vec3<f32> {
+    var nearest = -1.0;
+    var target_offset = vec3<f32>(0.0);
+    for (var i = params.predatorCount; i < total; i++) {
+        let offset = boids[i].position - b.position;
+        let d_sq = dot(offset, offset);
+        if (nearest < 0.0 || d_sq < nearest) {
+            nearest = d_sq;
+            target_offset = offset;
+        }
+    }
+    if (nearest <= 0.0) {
+        return vec3<f32>(0.0);
+    }
+    let desired = normalize(target_offset) * params.maxSpeed * PREDATOR_SPEED;
+    return limit_vector(desired - b.velocity, params.maxForce) * SEEK_WEIGHT;
+}
+
+// PCG hash, used to pick pseudo-random neighbors
+fn hash(value: u32) -> u32 {
+    let state = value * 747796405u + 2891336453u;
+    let word = ((state >> ((state >> 28u) + 4u)) ^ state) * 277803737u;
+    return (word >> 22u) ^ word;
+}
+
+fn accumulate(n: ptr<function, Neighborhood>, current: Boid, other: Boid) {
+    if (other.flock != current.flock || other.predator != 0.0) {
+        return; // flocks ignore each other, and nobody flocks with predators
+    }
+    // Distances are measured on screen, so neighborhoods stay circular in a non-square window.
+    // Squared distances are compared, only close neighbors need the distance itself.
+    let diff = current.position - other.position;
+    let offset = diff * vec3<f32>(params.aspectX, params.aspectY, 1.0);
+    let d2 = dot(offset, offset);
+    if (d2 >= params.perceptionRadiusSq) {
+        return;
+    }
+    // Neighbors in the blind spot behind the boid are not seen. Comparing the dot product with the scaled
+    // cosine avoids normalizing, and a boid standing still sees all around.
+    let heading = current.velocity * vec3<f32>(params.aspectX, params.aspectY, 1.0);
+    if (dot(heading, -offset) < params.fieldOfViewCos * length(heading) * sqrt(d2)) {
+        return;
+    }
+    (*n).count++;
+    // Closer neighbors count more with a falloff. The distance is bounded, so boids on top of each other
+    // don't get an infinite weight.
+    var weight = 1.0;
+    if (params.falloff > 0.0) {
+        weight = pow(max(sqrt(d2), MIN_FALLOFF_DISTANCE), -params.falloff);
+    }
+    if (d2 < params.alignmentRadius * params.alignmentRadius) {
+        (*n).alignment += other.velocity * weight;
+    }
+    if (d2 < params.cohesionRadius * params.cohesionRadius) {
+        (*n).cohesion += other.position * weight;
+        (*n).cohesionWeight += weight;
+    }
+    if (d2 < params.separationRadius * params.separationRadius) {
+        (*n).separation += normalize(diff) / sqrt(d2);
+    }
+}
+
+// Steers boids within marginSize of an edge back inwards, along each axis separately. It keeps pushing boids
+// that overshoot the margin until they have turned around. In 2D z is 0 and never within the margin.
+fn margin_force(b: Boid) -> vec3<f32> {
+    let inner = vec3<f32>(1.0 - params.marginSize);
+    let inwards = select(vec3<f32>(0.0), vec3<f32>(1.0), b.position < -inner) -
+                  select(vec3<f32>(0.0), vec3<f32>(1.0), b.position > inner);
+    return inwards * params.turnForce;
+}
+
+// Keeps the boid inside the world by clamping its position and reflecting its velocity at the walls.
+// The velocity is pointed inwards rather than negated, so a boid sitting exactly on the edge doesn't
+// flip back and forth every step.
+fn bounce(b: Boid) -> Boid {
+    var result = b;
+    if (abs(result.position.x) >= 1.0) {
+        result.position.x = clamp(result.position.x, -1.0, 1.0);
+        result.velocity.x = -sign(result.position.x) * abs(result.velocity.x);
+    }
+    if (abs(result.position.y) >= 1.0) {
+        result.position.y = clamp(result.position.y, -1.0, 1.0);
+        result.velocity.y = -sign(result.position.y) * abs(result.velocity.y);
+    }
+    if (abs(result.position.z) >= 1.0) {
+        result.position.z = clamp(result.position.z, -1.0, 1.0);
+        result.velocity.z = -sign(result.position.z) * abs(result.velocity.z);
+    }
+    return result;
+}
+
+// Number of grid cells along each axis. Cells are at least perceptionRadius wide, so all neighbors of a
+// boid are in its own or the adjacent cells. The grid spans the xy-plane, in 3D each cell is a column.
+fn grid_width() -> u32 {
+    return clamp(u32(2.0 / params.perceptionRadius), 1u, MAX_GRID_WIDTH);
+}
+
+fn grid_cell(position: vec3<f32>) -> vec2<u32> {
+    let width = grid_width();
+    let cell = vec2<u32>(clamp((position.xy + 1.0) * 0.5, vec2<f32>(0.0), vec2<f32>(1.0)) * f32(width));
+    return min(cell, vec2<u32>(width - 1u));
+}
+
+fn particle_total() -> u32 {
+    return min(params.particleCount, arrayLength(&boids));
+}
+
+@compute @workgroup_size(WORKGROUP_SIZE)
+fn grid_clear(@builtin(global_invocation_id) global_id: vec3<u32>) {
+    atomicStore(&cellCounts[global_id.x], 0u);
+}
+
+@compute @workgroup_size(WORKGROUP_SIZE)
+fn grid_count(@builtin(global_invocation_id) global_id: vec3<u32>) {
+    let index = global_id.x;
+    if (index >= particle_total()) {
+        return;
+    }
+    let cell = grid_cell(boids[index].position);
+    let c = cell.y * grid_width() + cell.x;
+    boidSlots[index] = vec2<u32>(c, atomicAdd(&cellCounts[c], 1u));
+}
+
+var<workgroup> chunk_offsets: array<u32, WORKGROUP_SIZE>;
+
+// Exclusive prefix sum of the cell counts. Each invocation sums a chunk of cells, one invocation
+// scans the chunk sums and then every invocation fills in the offsets of its chunk.
+@compute @workgroup_size(WORKGROUP_SIZE)
+fn grid_scan(@builtin(local_invocation_index) local: u32) {
+    let first = local * SCAN_CHUNK;
+    var sum = 0u;
+    for (var c = first; c < first + SCAN_CHUNK; c++) {
+        sum += atomicLoad(&cellCounts[c]);
+    }
+    chunk_offsets[local] = sum;
+    workgroupBarrier();
+    if (local == 0u) {
+        var offset = 0u;
+        for (var i = 0u; i < WORKGROUP_SIZE; i++) {
+            let count = chunk_offsets[i];
+            chunk_offsets[i] = offset;
+            offset += count;
+        }
+    }
+    workgroupBarrier();
+    var offset = chunk_offsets[local];
+    for (var c = first; c < first + SCAN_CHUNK; c++) {
+        cellOffsets[c] = offset;
+        offset += atomicLoad(&cellCounts[c]);
+    }
+}
+
+@compute @workgroup_size(WORKGROUP_SIZE)
+fn grid_scatter(@builtin(global_invocation_id) global_id: vec3<u32>) {
+    let index = global_id.x;
+    if (index >= particle_total()) {
+        return;
+    }
+    let slot = boidSlots[index];
+    sortedIndices[cellOffsets[slot.x] + slot.y] = index;
+}
+
+@compute @workgroup_size(WORKGROUP_SIZE)
 fn main(@builtin(global_invocation_id) global_id: vec3<u32>) {
     let index = global_id.x;
+    let total = particle_total();
+    if (index >= total) {
+        return;
+    }
     var current = boids[index];
-    var alignment = vec2<f32>(0.0);
-    var cohesion = vec2<f32>(0.0);
-    var separation = vec2<f32>(0.0);
-    var total_cohesion = 0;
-    for (var i = 0u; i < arrayLength(&boids); i++) {
-        if (i == index) {
-            continue;
+    var n = Neighborhood(vec3<f32>(0.0), vec3<f32>(0.0), vec3<f32>(0.0), 0, 0.0);
+    if (params.sampleSize == 0u && params.neighborGrid != 0u) {
+        // Only look at the boids in the 3x3 cells around this one
+        let cell = vec2<i32>(grid_cell(current.position));
+        let width = i32(grid_width());
+        for (var y = max(cell.y - 1, 0); y <= min(cell.y + 1, width - 1); y++) {
+            for (var x = max(cell.x - 1, 0); x <= min(cell.x + 1, width - 1); x++) {
+                let c = u32(y * width + x);
+                let start = cellOffsets[c];
+                let end = start + atomicLoad(&cellCounts[c]);
+                for (var k = start; k < end; k++) {
+                    let i = sortedIndices[k];
+                    if (i == index) {
+                        continue;
+                    }
+                    accumulate(&n, current, boids[i]);
+                }
+            }
         }
-        let other = boids[i];
-        let d = distance(current.position, other.position);
-        if (d < params.perceptionRadius) {
-            total_cohesion++;
-            alignment += other.velocity;
-            cohesion += other.position;
-            // Separation
-            if (d < params.perceptionRadius * 0.5) {
-                let diff = current.position - other.position;
-                separation += normalize(diff) / d;
+    } else if (params.sampleSize == 0u) {
+        for (var i = 0u; i < total; i++) {
+            if (i == index) {
+                continue;
             }
+            accumulate(&n, current, boids[i]);
+        }
+    } else {
+        // Only look at a random sample of boids, which changes every frame
+        let seed = hash(index ^ hash(params.frame));
+        for (var k = 0u; k < params.sampleSize; k++) {
+            let i = hash(seed + k) % total;
+            if (i == index) {
+                continue;
+            }
+            accumulate(&n, current, boids[i]);
         }
     }
+    var alignment = n.alignment;
+    var cohesion = n.cohesion;
+    var separation = n.separation;
+    let total_cohesion = n.cohesionWeight;
+    current.neighbors = f32(n.count);
+
+    // Every boid steers and moves a bit differently, the outside forces push them all alike
+    let agility = 1.0 + current.speedJitter;
+    let max_force = params.maxForce * agility;
+    var max_speed = params.maxSpeed * agility;
 
     // Apply flocking behaviors
-    alignment = limit_vector(normalize(alignment) * params.maxSpeed - current.velocity, params.maxForce);
+    alignment = limit_vector(normalize(alignment) * max_speed - current.velocity, max_force);
 
-    let center = cohesion / f32(total_cohesion);
-    cohesion = limit_vector(normalize(center - current.position) * params.maxSpeed - current.velocity, params.maxForce);
+    let center = cohesion / total_cohesion;
+    cohesion = limit_vector(normalize(center - current.position) * max_speed - current.velocity, max_force);
 
-    separation = limit_vector(normalize(separation) * params.maxSpeed - current.velocity, params.maxForce);
+    separation = limit_vector(normalize(separation) * max_speed - current.velocity, max_force);
 
     // Update boid
-    var acceleration = alignment * params.alignmentWeight +
-                         cohesion * params.cohesionWeight + 
-                         separation * params.separationWeight;
+    let weights = params.flocks[min(u32(current.flock), params.flockCount - 1u)];
+    var acceleration = alignment * params.alignmentWeight * weights.alignment +
+                         cohesion * params.cohesionWeight * weights.cohesion +
+                         separation * params.separationWeight * weights.separation;
+    if (current.predator != 0.0) {
+        // Predators don't flock, they hunt
+        acceleration = seek_prey(current, total);
+        max_speed *= PREDATOR_SPEED;
+    } else {
+        acceleration += flee_predators(current, total);
+    }
+    // Every rule is limited to maxForce before it is weighted, and the sum is limited again, so no
+    // combination of weights and forces can accelerate a boid arbitrarily
+    acceleration += limit_vector(avoid_obstacles(current) * max_force, max_force) * AVOIDANCE_WEIGHT;
+    acceleration += limit_vector(escape_obstacles(current) * max_force, max_force) * AVOIDANCE_WEIGHT;
+    acceleration += limit_vector(vec3<f32>(externalForces[index], 0.0), params.maxForce);
+    acceleration += limit_vector(attractor_force(current), params.maxForce * ATTRACTOR_WEIGHT);
+    acceleration += limit_vector(wind_force(), params.maxForce);
+    acceleration += turbulence_force(current);
+    if (params.boundaryMode == BOUNDARY_MARGIN) {
+        acceleration += margin_force(current) * max_force;
+    }
+    acceleration = limit_vector(acceleration, max_force * MAX_COMBINED_FORCE);
+    current.forceMag = length(acceleration);
 
-    current.velocity = limit_vector(current.velocity + acceleration, params.maxSpeed);
+    let steps = params.deltaTime / REFERENCE_DELTA_TIME;
+    var velocity = limit_vector(current.velocity + acceleration * steps, max_speed);
+    velocity = limit_turn(current.velocity, velocity, params.maxTurnRate * params.deltaTime);
+    // The maximum speed wins if they conflict, e.g. after lowering it at runtime
+    velocity = raise_speed(velocity, min(params.minSpeed, max_speed));
+    // Low-pass filter the velocity to reduce jitter. A smoothing of 0 keeps the new velocity as is, otherwise
+    // the old velocity decays by the factor smoothing per reference time step.
+    let retained = select(0.0, pow(params.smoothing, steps), params.smoothing > 0.0);
+    current.velocity = mix(velocity, current.velocity, retained);
     current.position = current.position + current.velocity * params.deltaTime;
-    current.position = clamp(current.position - 2 * floor((current.position + 1) /2 ), vec2(-1.0),vec2(1.0));
+    if (params.boundaryMode == BOUNDARY_BOUNCE) {
+        current = bounce(current);
+    } else if (params.boundaryMode == BOUNDARY_MARGIN) {
+        // The margin force turns boids around, those that reach the edge anyway stay on it meanwhile
+        current.position = clamp(current.position, vec3(-1.0), vec3(1.0));
+    } else {
+        current.position = clamp(current.position - 2 * floor((current.position + 1) /2 ), vec3(-1.0),vec3(1.0));
+    }
 
     boids[index] = current;
 }
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/brodo/goBoids/stream"
+	"github.com/nats-io/nats.go"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the startup settings resolved from the command line and environment.
+type Config struct {
+	// SampleCount is the number of MSAA samples per pixel. 1 disables multisampling.
+	SampleCount uint32 `json:"msaa"`
+	// StateFile is the path simulation snapshots are saved to (F5) and loaded from (F9).
+	StateFile string `json:"stateFile"`
+	// Backend is the graphics API the adapter is requested from: vulkan, metal, dx12 or gl. Any backend if empty.
+	Backend string `json:"backend"`
+	// PowerPreference selects between integrated (low) and discrete (high) GPUs. The driver decides if empty.
+	PowerPreference string `json:"powerPreference"`
+	// PresentMode is the surface present mode: fifo (vsync), fifo-relaxed, mailbox or immediate.
+	PresentMode string `json:"presentMode"`
+	// FPS is the number of frames rendered per second at most. 0 renders as fast as possible, which only the
+	// present mode limits, e.g. fifo to the refresh rate.
+	FPS uint `json:"fps"`
+	// ColorMode is how boids are colored.
+	ColorMode ColorMode `json:"colorMode"`
+	// ColorPeriod is how long the hue of the boids takes to cycle once with ColorRainbow, in simulated time.
+	ColorPeriod time.Duration `json:"colorPeriod"`
+	// Background is the color behind the boids.
+	Background Color `json:"background"`
+	// BoidColor is the color of the boids with the solid color mode.
+	BoidColor Color `json:"boidColor"`
+	// BoidSize scales the boid meshes.
+	BoidSize float32 `json:"boidSize"`
+	// BoidShape is the mesh boids are drawn with: ShapeTriangle, ShapeArrow or ShapeFish.
+	BoidShape string `json:"boidShape"`
+	// TrailDecay is the fraction of the boid trails that fades each frame. 0 disables trails.
+	TrailDecay float32 `json:"trailDecay"`
+	// Particles is the number of boids to simulate. The viewer draws at most this many.
+	Particles uint32 `json:"particles"`
+	// ThreeD spreads the boids through a cube instead of the xy-plane.
+	ThreeD bool `json:"3d"`
+	// Params are the initial simulation parameters.
+	Params SimParams `json:"params"`
+	// Seed seeds the random number generator for the initial particle data.
+	Seed int64 `json:"seed"`
+	// Substeps is the number of simulation steps per rendered frame, each advancing 1/Substeps of the frame
+	// time. More sub-steps let fast boids react to neighbors before they fly through them, so separation
+	// keeps them apart, at the cost of running the compute pass that many times per frame.
+	Substeps uint32 `json:"substeps"`
+	// Layout is how the boids are placed initially: LayoutUniform, LayoutCircle, LayoutGrid or LayoutCluster.
+	Layout string `json:"layout"`
+	// Speeds is the distribution the initial boid speeds are drawn from.
+	Speeds SpeedDistribution `json:"speeds"`
+	// SpeedVariance is the largest deviation of the maximum speed and force of each boid from MaxSpeed and MaxForce,
+	// relative to them. 0 makes all boids alike.
+	SpeedVariance float32 `json:"speedVariance"`
+	// Obstacles are the circles boids steer around.
+	Obstacles []Obstacle `json:"obstacles"`
+	// NATS configures where particle data is published to.
+	NATS NATSConfig `json:"nats"`
+	// DensityBuckets are the lower bounds of the neighbor count buckets of the density histogram
+	// published to the NATS subject followed by ".density". The histogram is not published if empty.
+	DensityBuckets []int `json:"densityBuckets"`
+	// Stats publishes the centroid, bounding box, mean speed and polarization of every frame to the NATS
+	// subject followed by ".stats".
+	Stats bool `json:"stats"`
+	// Format is the serialization of published frames, "arrow" or "jsonl".
+	Format string `json:"format"`
+	// LogForces periodically prints statistics of the steering force magnitudes of the read back frames.
+	LogForces bool `json:"logForces"`
+	// ForceColumn adds the steering force magnitude of each boid to the published frames.
+	ForceColumn bool `json:"forceColumn"`
+	// NetworkSample is the fraction of the boids in frames published over NATS and WebSocket, in (0, 1].
+	// Recordings, CSV exports and flock statistics still cover every boid.
+	NetworkSample float64 `json:"networkSample"`
+	// ReadbackBuffers is the number of staging buffers particle data is read back from the GPU through. Frames are
+	// skipped while all of them wait to be mapped, so slow readback paths need more.
+	ReadbackBuffers int `json:"readbackBuffers"`
+	// TargetFrameTime enables adapting the particle count between MinParticles and MaxParticles
+	// so that rendering a frame takes about this long. 0 disables adaptation.
+	TargetFrameTime time.Duration `json:"targetFrameTime"`
+	MinParticles    uint32        `json:"minParticles"`
+	MaxParticles    uint32        `json:"maxParticles"`
+	// HealthAddr is the address the /healthz endpoint listens on. It is disabled if empty.
+	HealthAddr string `json:"healthAddr"`
+	// MetricsAddr is the address the Prometheus /metrics endpoint listens on. It is disabled if empty.
+	MetricsAddr string `json:"metricsAddr"`
+	// WebSocketAddr is the address a WebSocket endpoint streaming every published frame as Arrow IPC listens on.
+	// It is disabled if empty.
+	WebSocketAddr string `json:"webSocketAddr"`
+	// HealthStall is how long the render loop may go without a frame before /healthz reports it as stalled.
+	HealthStall time.Duration `json:"healthStall"`
+	// RenderFrames is the number of frames rendered off-screen to FramesDir before exiting. 0 opens a window
+	// or runs headless instead.
+	RenderFrames uint32 `json:"renderFrames"`
+	// FramesDir is the directory the frames rendered with RenderFrames are written to as numbered PNGs.
+	FramesDir string `json:"framesDir"`
+	// FrameWidth and FrameHeight are the size of the frames rendered with RenderFrames in pixels.
+	FrameWidth  uint32 `json:"frameWidth"`
+	FrameHeight uint32 `json:"frameHeight"`
+	// Headless simulates and publishes without opening a window.
+	Headless bool `json:"headless"`
+	// Viewer renders particles received over NATS instead of simulating them. It is set by the `view` subcommand.
+	Viewer bool `json:"viewer"`
+	// Record is the path of an Arrow IPC or, if it ends in .parquet, Parquet file every published frame is
+	// recorded to. Nothing is recorded if empty.
+	Record string `json:"record"`
+	// CSV is the path of a CSV file the position and velocity of every boid in every published frame is
+	// written to. Nothing is written if empty.
+	CSV string `json:"csv"`
+	// Replay is the path of a recording that is rendered instead of simulating boids.
+	Replay string `json:"replay"`
+	// DumpConfig is the path the resolved configuration is written to, if set.
+	DumpConfig string `json:"-"`
+	// PrintAdapter prints the GPU adapter the simulation would run on and exits.
+	PrintAdapter bool `json:"-"`
+	// WatchShaders reads compute.wgsl and draw.wgsl from the working directory instead of the embedded copies
+	// and reloads the pipelines when they change.
+	WatchShaders bool `json:"watchShaders"`
+}
+
+// NATSConfig holds the NATS connection settings, read from the environment.
+type NATSConfig struct {
+	// URL is the server URL, or a comma-separated list of servers, set by NATS_URL.
+	URL string `json:"url"`
+	// Password is set by NATS_PASSWORD. Connections are unauthenticated if it is empty. It is never written to configuration dumps.
+	Password string `json:"-"`
+	// Creds is the path of a .creds file with a JWT and nkey to authenticate with, set by -nats-creds or
+	// NATS_CREDS. It takes precedence over Password.
+	Creds string `json:"creds"`
+	// Subject is the subject frames are published to, set by -nats-subject or NATS_SUBJECT.
+	Subject string `json:"subject"`
+	// Batch is the number of frames published together in one message, set by -nats-batch.
+	// Batched messages have an additional frame column.
+	Batch int `json:"batch"`
+	// Compression is the compression of Arrow messages, set by -nats-compression.
+	Compression string `json:"compression"`
+	// PublishEvery publishes only every nth frame, set by -publish-every or NATS_PUBLISH_EVERY. Particle data is
+	// only read back from the GPU on frames that are published.
+	PublishEvery uint64 `json:"publishEvery"`
+	// Control accepts parameter updates on the control subject, set by -nats-control.
+	Control bool `json:"control"`
+	// Publish publishes the simulated frames, set by -nats-publish.
+	Publish bool `json:"publish"`
+}
+
+// WriteFile writes the configuration as JSON to path. Secrets are omitted.
+func (c Config) WriteFile(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// DefaultConfig returns the configuration without any command-line arguments.
+func DefaultConfig() Config {
+	cfg, err := ParseConfig(nil)
+	if err != nil {
+		// Only the environment can make the defaults invalid, e.g. a malformed NATS_PUBLISH_EVERY
+		panic(err)
+	}
+	return cfg
+}
+
+// ParseConfig parses the command-line arguments (without the program name) into a Config.
+func ParseConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("goBoids", flag.ContinueOnError)
+
+	var msaa uint
+	fs.UintVar(&msaa, "msaa", 1, "multisample anti-aliasing sample count (1, 2, 4 or 8)")
+	stateFile := fs.String("state-file", "boids.state", "file used to save (F5) and load (F9) simulation snapshots")
+	seed := fs.Int64("seed", 42, "seed for the initial particle positions and velocities")
+	headless := fs.Bool("headless", false, "simulate and publish without a window, until interrupted")
+	renderFrames := fs.Uint("render-frames", 0, "render this many frames off-screen as numbered PNGs to -frames-dir, then exit")
+	framesDir := fs.String("frames-dir", "frames", "directory the frames of -render-frames are written to")
+	frameSize := fs.String("frame-size", "1280x720", "size of the frames of -render-frames as WIDTHxHEIGHT")
+	printAdapter := fs.Bool("print-adapter", false, "print the GPU adapter and backend the simulation would run on and exit")
+	watchShaders := fs.Bool("watch-shaders", false, "read compute.wgsl and draw.wgsl from the working directory and reload them when they change")
+	dumpConfig := fs.String("dump-config", "", "write the resolved configuration as JSON to this file")
+	targetFrameTime := fs.Duration("target-frame-time", 0, "adapt the particle count to keep frames below this duration, 0 disables adaptation")
+	backend := fs.String("backend", "", "graphics API to run on: vulkan, metal, dx12 or gl (default any)")
+	powerPreference := fs.String("power-preference", "", "prefer the low power (integrated) or high performance (discrete) GPU: low or high (default up to the driver)")
+	fps := fs.Uint("fps", 60, "target frame rate, 0 renders as fast as possible (combine with -present-mode=immediate to exceed the refresh rate)")
+	presentMode := fs.String("present-mode", "fifo", "surface present mode: fifo (vsync), fifo-relaxed, mailbox or immediate; unsupported modes fall back to fifo")
+	colorMode := fs.String("color-mode", "speed", "boid coloring: solid, speed for a heatmap relative to -max-speed, flock, density by neighbor count, or rainbow cycling through all hues every -color-period; flock is the default with -flocks")
+	colorPeriod := fs.Duration("color-period", 10*time.Second, "simulated time the hue of -color-mode=rainbow takes to cycle once")
+	flocks := fs.Uint("flocks", 1, fmt.Sprintf("number of flocks that ignore each other, at most %d", MaxFlocks))
+	predators := fs.Uint("predators", 0, "number of predators that chase the other boids, which flee from them")
+	flockWeights := fs.String("flock-weights", "", `scales of the rule weights per flock as "alignment,cohesion,separation;...", missing flocks use 1,1,1`)
+	background := fs.String("bg", "#000000", "background color as #rrggbb")
+	boidColor := fs.String("boid-color", "#ffcc00", "boid color as #rrggbb, used with -color-mode=solid")
+	boidShape := fs.String("boid-shape", ShapeTriangle, "mesh boids are drawn with: triangle, arrow or fish")
+	boidSize := fs.Float64("boid-size", 1, fmt.Sprintf("scale of the boid triangles between %g and %g, change it at runtime with = and -", float64(minBoidSize), float64(maxBoidSize)))
+	trailDecay := fs.Float64("trail-decay", 0, "draw fading trails behind the boids, losing this fraction of their brightness each frame; 0 disables trails")
+	threeD := fs.Bool("3d", false, "simulate boids in three dimensions, drawn with perspective")
+	particles := fs.Uint("particles", DefaultNumParticles, "number of boids to simulate, or the most the viewer draws")
+	minParticles := fs.Uint("min-particles", 0, "lower bound of the adaptive particle count, 0 uses 1/8 of -particles")
+	maxParticles := fs.Uint("max-particles", 0, "upper bound of the adaptive particle count, 0 uses -particles")
+	healthAddr := fs.String("health-addr", "", `serve a /healthz endpoint on this address, e.g. ":8080"`)
+	metricsAddr := fs.String("metrics-addr", "", `serve Prometheus metrics on /metrics at this address, e.g. ":9090"`)
+	wsAddr := fs.String("ws-addr", "", `stream every published frame as Arrow IPC to WebSocket clients at this address, e.g. ":8080"`)
+	healthStall := fs.Duration("health-stall", 5*time.Second, "time without a rendered frame after which /healthz reports a stall")
+	format := fs.String("format", "arrow", "serialization of published frames: arrow, or jsonl for log pipelines (the viewer only reads arrow)")
+	logForces := fs.Bool("log-forces", false, "print the smallest, mean and largest steering force of the flock every few seconds, to check the -max-force limits")
+	forceColumn := fs.Bool("force-column", false, "publish the steering force magnitude of each boid in a forceMag column")
+	networkSample := fs.Float64("network-sample", 1, "fraction of the boids published over NATS and WebSocket, e.g. 0.25 for every 4th; the id column keeps their indices")
+	readbackBuffers := fs.Int("readback-buffers", DefaultReadbackBuffers, "number of staging buffers for reading back particle data; raise it if frames are skipped because all are in use")
+	natsSubject := fs.String("nats-subject", "", fmt.Sprintf("NATS subject frames are published to, overrides NATS_SUBJECT (default %q)", stream.FlockSubject))
+	natsPublish := fs.Bool("nats-publish", true, "publish frames to NATS; without it and other outputs, particle data isn't read back from the GPU at all")
+	natsControl := fs.Bool("nats-control", false, "accept JSON parameter updates, e.g. {\"alignmentWeight\": 1.5}, on the subject <nats-subject>.control")
+	publishEvery := fs.Uint64("publish-every", 0, "read back and publish only every nth frame, overrides NATS_PUBLISH_EVERY (default 1)")
+	natsCreds := fs.String("nats-creds", "", "NATS credentials file (JWT and nkey) to authenticate with, overrides NATS_CREDS and NATS_PASSWORD")
+	natsBatch := fs.Int("nats-batch", 1, "number of frames published together in one message with a frame column, 1 publishes every frame on its own")
+	natsCompression := fs.String("nats-compression", stream.CompressionNone, "compression of published Arrow frames: none, lz4 or zstd")
+	record := fs.String("record", "", "record every published frame to this Arrow IPC file, e.g. run.arrow, or Parquet file if it ends in .parquet, e.g. run.parquet")
+	fs.StringVar(record, "output", "", "alias of -record")
+	csvPath := fs.String("csv", "", "write time, position and velocity of every boid in every published frame to this CSV file, e.g. out.csv")
+	replay := fs.String("replay", "", "render an Arrow IPC file written with -record at its recorded pace instead of simulating")
+	stats := fs.Bool("stats", true, "publish the centroid, bounding box, mean speed and polarization of every frame to <nats-subject>.stats")
+	densityBuckets := fs.String("density-buckets", "", `publish a neighbor density histogram with these bucket lower bounds, e.g. "0,1,6,11,21"`)
+
+	// Simulation parameters are parsed directly into params, so their defaults are DefaultSimParams
+	params := DefaultSimParams()
+	float32Var(fs, &params.DeltaTime, "delta-time", "simulated seconds per frame")
+	float32Var(fs, &params.MaxForce, "max-force", "maximum steering force of each flocking rule")
+	float32Var(fs, &params.MaxSpeed, "max-speed", "maximum speed of a boid")
+	float32Var(fs, &params.MinSpeed, "min-speed", "speed slower boids are sped up to so they keep moving, 0 lets them halt")
+	float32Var(fs, &params.AlignmentWeight, "alignment-weight", "weight of steering towards the heading of neighbors")
+	float32Var(fs, &params.CohesionWeight, "cohesion-weight", "weight of steering towards the center of neighbors")
+	float32Var(fs, &params.SeparationWeight, "separation-weight", "weight of steering away from close neighbors")
+	perceptionRadius := fs.Float64("perception-radius", 0, "sets -alignment-radius and -cohesion-radius to this distance and -separation-radius to half of it, unless they are given")
+	float32Var(fs, &params.SeparationRadius, "separation-radius", "distance within which boids steer away from each other")
+	float32Var(fs, &params.AlignmentRadius, "alignment-radius", "distance within which boids align their headings")
+	float32Var(fs, &params.CohesionRadius, "cohesion-radius", "distance within which boids steer towards each other")
+	float32Var(fs, &params.WindX, "wind-x", "wind force pushing all boids to the right, capped at -max-force")
+	float32Var(fs, &params.WindY, "wind-y", "wind force pushing all boids up, capped at -max-force")
+	float32Var(fs, &params.WindPeriod, "wind-oscillate", "period in seconds of a wind oscillating back and forth, 0 keeps it constant")
+	float32Var(fs, &params.Turbulence, "turbulence", "weight of a swirling noise force relative to -max-force, 0 disables it")
+	float32Var(fs, &params.TurbulenceScale, "turbulence-scale", "spatial frequency of the turbulence, larger values give smaller swirls")
+	float32Var(fs, &params.FieldOfView, "fov-degrees", "angle around its heading within which a boid sees its neighbors, 360 sees all around")
+	float32Var(fs, &params.Falloff, "falloff", "exponent weighting alignment and cohesion neighbors by 1/distance^falloff, 0 weights them equally")
+	float32Var(fs, &params.Smoothing, "smoothing", "velocity smoothing factor, 0 disables smoothing")
+	sample := fs.Uint("sample", uint(params.SampleSize), "number of random boids each boid considers per frame, 0 considers all")
+	float32Var(fs, &params.MaxTurnRate, "max-turn", "maximum turn rate of a boid in radians per second")
+	obstacles := fs.String("obstacles", "", `circular obstacles as "x,y,radius;x,y,radius"`)
+	boundary := fs.String("boundary", "wrap", "behavior at the edges of the world: wrap, bounce, or margin to steer back inwards near them")
+	float32Var(fs, &params.MarginSize, "margin-size", "distance from the edges within which boids steer back inwards with -boundary=margin")
+	float32Var(fs, &params.TurnForce, "turn-force", "how strongly boids steer back inwards within -margin-size, relative to -max-force")
+	grid := fs.Bool("grid", true, "find neighbors in a uniform grid instead of comparing all pairs of boids, has no effect with -sample")
+	substeps := fs.Uint("substeps", 1, "number of simulation steps per frame, each advancing 1/substeps of the frame time. More sub-steps keep fast boids from flying through each other, but cost that many times the compute work per frame")
+	float32Var(fs, &params.Lookahead, "lookahead", "distance ahead of a boid at which obstacles are avoided")
+
+	layout := fs.String("init", LayoutUniform, "initial layout of the boids: uniform, circle (a ring), grid or cluster (a blob in the center)")
+	speedVariance := fs.Float64("speed-variance", 0, "spread of the maximum speed and force of the boids, e.g. 0.2 for up to 20% slower or faster than -max-speed and -max-force")
+	speedDist := fs.String("speed-dist", SpeedConstant, "initial speed distribution: constant, uniform or normal")
+	speed := fs.Float64("speed", 0.1, "initial speed for the constant distribution, mean for the normal distribution")
+	speedMin := fs.Float64("speed-min", 0.05, "minimum initial speed for the uniform distribution")
+	speedMax := fs.Float64("speed-max", 0.15, "maximum initial speed for the uniform distribution")
+	speedStdDev := fs.Float64("speed-stddev", 0.02, "standard deviation of the initial speed for the normal distribution")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	switch msaa {
+	case 1, 2, 4, 8:
+	default:
+		return Config{}, fmt.Errorf("invalid -msaa value %d: must be 1, 2, 4 or 8", msaa)
+	}
+	if _, ok := backends[*backend]; *backend != "" && !ok {
+		return Config{}, fmt.Errorf("invalid -backend value %q: must be vulkan, metal, dx12 or gl", *backend)
+	}
+	if _, ok := powerPreferences[*powerPreference]; *powerPreference != "" && !ok {
+		return Config{}, fmt.Errorf("invalid -power-preference value %q: must be low or high", *powerPreference)
+	}
+	switch *presentMode {
+	case "fifo", "fifo-relaxed", "mailbox", "immediate":
+	default:
+		return Config{}, fmt.Errorf("invalid -present-mode value %q: must be fifo, fifo-relaxed, mailbox or immediate", *presentMode)
+	}
+	if isFlagSet(fs, "perception-radius") {
+		if *perceptionRadius <= 0 {
+			return Config{}, fmt.Errorf("invalid -perception-radius value %g: must be positive", *perceptionRadius)
+		}
+		// Separation used to apply within half the perception radius
+		for _, r := range []struct {
+			name  string
+			value *float32
+			scale float64
+		}{
+			{"separation-radius", &params.SeparationRadius, 0.5},
+			{"alignment-radius", &params.AlignmentRadius, 1},
+			{"cohesion-radius", &params.CohesionRadius, 1},
+		} {
+			if !isFlagSet(fs, r.name) {
+				*r.value = float32(*perceptionRadius * r.scale)
+			}
+		}
+	}
+	if err := validateParams(params, flagName); err != nil {
+		return Config{}, err
+	}
+	if *substeps == 0 {
+		return Config{}, fmt.Errorf("invalid -substeps value %d: must be at least 1", *substeps)
+	}
+	obstacleList, err := ParseObstacles(*obstacles)
+	if err != nil {
+		return Config{}, err
+	}
+	switch *layout {
+	case LayoutUniform, LayoutCircle, LayoutGrid, LayoutCluster:
+	default:
+		return Config{}, fmt.Errorf("invalid -init value %q: must be %s, %s, %s or %s", *layout, LayoutUniform, LayoutCircle, LayoutGrid, LayoutCluster)
+	}
+	if *speedVariance < 0 || *speedVariance >= 1 {
+		return Config{}, fmt.Errorf("invalid -speed-variance value %g: must be at least 0 and less than 1", *speedVariance)
+	}
+	speeds := SpeedDistribution{
+		Kind:   *speedDist,
+		Speed:  float32(*speed),
+		Min:    float32(*speedMin),
+		Max:    float32(*speedMax),
+		StdDev: float32(*speedStdDev),
+	}
+	if err := speeds.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid initial speed distribution: %w", err)
+	}
+	params.SampleSize = uint32(*sample)
+	if *grid {
+		params.NeighborGrid = 1
+	}
+	params.BoundaryMode, err = ParseBoundaryMode(*boundary)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -boundary value: %w", err)
+	}
+	if *flocks == 0 || *flocks > MaxFlocks {
+		return Config{}, fmt.Errorf("invalid -flocks value %d: must be between 1 and %d", *flocks, MaxFlocks)
+	}
+	params.FlockCount = uint32(*flocks)
+	params.Flocks, err = ParseFlockWeights(*flockWeights, params.FlockCount)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -flock-weights value: %w", err)
+	}
+	colors, err := ParseColorMode(*colorMode)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -color-mode value: %w", err)
+	}
+	if *colorPeriod <= 0 {
+		return Config{}, fmt.Errorf("invalid -color-period value %v: must be positive", *colorPeriod)
+	}
+	if params.FlockCount > 1 && !isFlagSet(fs, "color-mode") {
+		colors = ColorFlock
+	}
+
+	bg, err := ParseHexColor(*background)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -bg value: %w", err)
+	}
+	boids, err := ParseHexColor(*boidColor)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid -boid-color value: %w", err)
+	}
+	if _, ok := boidShapes[*boidShape]; !ok {
+		return Config{}, fmt.Errorf("invalid -boid-shape value %q: must be %s, %s or %s", *boidShape, ShapeTriangle, ShapeArrow, ShapeFish)
+	}
+	if *boidSize < minBoidSize || *boidSize > maxBoidSize {
+		return Config{}, fmt.Errorf("invalid -boid-size value %g: must be between %g and %g", *boidSize, float64(minBoidSize), float64(maxBoidSize))
+	}
+	if *trailDecay < 0 || *trailDecay > 1 {
+		return Config{}, fmt.Errorf("invalid -trail-decay value %g: must be between 0 and 1", *trailDecay)
+	}
+
+	var frameWidth, frameHeight uint32
+	_, err = fmt.Sscanf(*frameSize, "%dx%d", &frameWidth, &frameHeight)
+	if err != nil || frameWidth == 0 || frameHeight == 0 {
+		return Config{}, fmt.Errorf("invalid -frame-size value %q: must be WIDTHxHEIGHT with positive sizes", *frameSize)
+	}
+	if *renderFrames > 0 && *headless {
+		return Config{}, fmt.Errorf("invalid -render-frames value %d: frames can't be rendered headless", *renderFrames)
+	}
+
+	switch *format {
+	case "arrow", "jsonl":
+	default:
+		return Config{}, fmt.Errorf("invalid -format value %q: must be arrow or jsonl", *format)
+	}
+	if *healthStall <= 0 {
+		return Config{}, fmt.Errorf("invalid -health-stall value %v: must be positive", *healthStall)
+	}
+	if *targetFrameTime < 0 {
+		return Config{}, fmt.Errorf("invalid -target-frame-time value %v: must not be negative", *targetFrameTime)
+	}
+	if *particles == 0 || *particles > math.MaxUint32/(boid.Stride*4) {
+		return Config{}, fmt.Errorf("invalid -particles value %d: must be between 1 and %d", *particles, math.MaxUint32/(boid.Stride*4))
+	}
+	if *predators >= *particles {
+		return Config{}, fmt.Errorf("invalid -predators value %d: must be less than -particles", *predators)
+	}
+	params.PredatorCount = uint32(*predators)
+	if *maxParticles == 0 {
+		*maxParticles = *particles
+	}
+	if *minParticles == 0 {
+		*minParticles = max(*particles/8, 1)
+	}
+	if *maxParticles > *particles {
+		return Config{}, fmt.Errorf("invalid -max-particles value %d: must be between 1 and %d", *maxParticles, *particles)
+	}
+	if *minParticles == 0 || *minParticles > *maxParticles {
+		return Config{}, fmt.Errorf("invalid -min-particles value %d: must be between 1 and -max-particles", *minParticles)
+	}
+
+	if *record != "" && *replay != "" {
+		return Config{}, fmt.Errorf("invalid -record value %q: a replay can't be recorded", *record)
+	}
+	if stream.IsParquet(*replay) {
+		return Config{}, fmt.Errorf("invalid -replay value %q: only Arrow IPC recordings can be replayed", *replay)
+	}
+	if *csvPath != "" && *replay != "" {
+		return Config{}, fmt.Errorf("invalid -csv value %q: a replay can't be exported", *csvPath)
+	}
+	if !(*networkSample > 0 && *networkSample <= 1) {
+		return Config{}, fmt.Errorf("invalid -network-sample value %g: must be greater than 0 and at most 1", *networkSample)
+	}
+	if *readbackBuffers < 1 {
+		return Config{}, fmt.Errorf("invalid -readback-buffers value %d: must be at least 1", *readbackBuffers)
+	}
+	if *wsAddr != "" && *replay != "" {
+		return Config{}, fmt.Errorf("invalid -ws-addr value %q: a replay can't be streamed", *wsAddr)
+	}
+
+	buckets, err := stream.ParseDensityBuckets(*densityBuckets)
+	if err != nil {
+		return Config{}, err
+	}
+
+	natsConfig := NATSConfig{
+		URL:          os.Getenv("NATS_URL"),
+		Password:     os.Getenv("NATS_PASSWORD"),
+		PublishEvery: 1,
+	}
+	if natsConfig.URL == "" {
+		natsConfig.URL = nats.DefaultURL
+	}
+	natsConfig.Creds = *natsCreds
+	natsConfig.Control = *natsControl
+	natsConfig.Publish = *natsPublish
+	if natsConfig.Control && !natsConfig.Publish {
+		return Config{}, fmt.Errorf("invalid -nats-control value: control messages are received over the NATS connection of -nats-publish")
+	}
+	if natsConfig.Creds == "" {
+		natsConfig.Creds = os.Getenv("NATS_CREDS")
+	}
+	natsConfig.Subject = *natsSubject
+	if natsConfig.Subject == "" {
+		natsConfig.Subject = os.Getenv("NATS_SUBJECT")
+	}
+	if natsConfig.Subject == "" {
+		natsConfig.Subject = stream.FlockSubject
+	}
+	if err := stream.ValidateSubject(natsConfig.Subject); err != nil {
+		return Config{}, fmt.Errorf("invalid NATS subject: %w", err)
+	}
+	if *natsBatch < 1 {
+		return Config{}, fmt.Errorf("invalid -nats-batch value %d: must be at least 1", *natsBatch)
+	}
+	natsConfig.Batch = *natsBatch
+	switch *natsCompression {
+	case stream.CompressionNone, stream.CompressionLZ4, stream.CompressionZstd:
+	default:
+		return Config{}, fmt.Errorf("invalid -nats-compression value %q: must be none, lz4 or zstd", *natsCompression)
+	}
+	if *natsCompression != stream.CompressionNone && *format != "arrow" {
+		return Config{}, fmt.Errorf("invalid -nats-compression value %q: only Arrow frames can be compressed", *natsCompression)
+	}
+	natsConfig.Compression = *natsCompression
+	if isFlagSet(fs, "publish-every") {
+		if *publishEvery == 0 {
+			return Config{}, fmt.Errorf("invalid -publish-every value %d: must be at least 1", *publishEvery)
+		}
+		natsConfig.PublishEvery = *publishEvery
+	} else if every := os.Getenv("NATS_PUBLISH_EVERY"); every != "" {
+		natsConfig.PublishEvery, err = strconv.ParseUint(every, 10, 64)
+		if err != nil || natsConfig.PublishEvery == 0 {
+			return Config{}, fmt.Errorf("invalid NATS_PUBLISH_EVERY value %q: must be a positive integer", every)
+		}
+	}
+
+	return Config{
+		SampleCount:     uint32(msaa),
+		StateFile:       *stateFile,
+		Backend:         *backend,
+		PowerPreference: *powerPreference,
+		PresentMode:     *presentMode,
+		FPS:             *fps,
+		Particles:       uint32(*particles),
+		ThreeD:          *threeD,
+		ColorMode:       colors,
+		ColorPeriod:     *colorPeriod,
+		Background:      bg,
+		BoidColor:       boids,
+		BoidSize:        float32(*boidSize),
+		BoidShape:       *boidShape,
+		TrailDecay:      float32(*trailDecay),
+		Params:          params,
+		Seed:            *seed,
+		Substeps:        uint32(*substeps),
+		Layout:          *layout,
+		Speeds:          speeds,
+		SpeedVariance:   float32(*speedVariance),
+		Obstacles:       obstacleList,
+		NATS:            natsConfig,
+		DensityBuckets:  buckets,
+		Stats:           *stats,
+		Format:          *format,
+		ForceColumn:     *forceColumn,
+		NetworkSample:   *networkSample,
+		ReadbackBuffers: *readbackBuffers,
+		LogForces:       *logForces,
+		TargetFrameTime: *targetFrameTime,
+		MinParticles:    uint32(*minParticles),
+		MaxParticles:    uint32(*maxParticles),
+		Headless:        *headless,
+		RenderFrames:    uint32(*renderFrames),
+		FramesDir:       *framesDir,
+		FrameWidth:      frameWidth,
+		FrameHeight:     frameHeight,
+		HealthAddr:      *healthAddr,
+		HealthStall:     *healthStall,
+		MetricsAddr:     *metricsAddr,
+		WebSocketAddr:   *wsAddr,
+		Record:          *record,
+		CSV:             *csvPath,
+		Replay:          *replay,
+		DumpConfig:      *dumpConfig,
+		PrintAdapter:    *printAdapter,
+		WatchShaders:    *watchShaders,
+	}, nil
+}
+
+// Simulated reports whether the boids are simulated, rather than received by the viewer or replayed.
+func (c Config) Simulated() bool {
+	return !c.Viewer && c.Replay == ""
+}
+
+// ReadsBack reports whether anything consumes the simulated particle data: NATS, a recording, the CSV export,
+// the WebSocket endpoint or force logging. Otherwise the particles stay on the GPU.
+func (c Config) ReadsBack() bool {
+	return c.Simulated() && (c.NATS.Publish || c.Record != "" || c.CSV != "" || c.WebSocketAddr != "" || c.LogForces)
+}
+
+// validateParams checks the simulation parameters with the limits of their command-line flags. Errors name
+// a parameter by what name returns for its flag name, so they match where the value came from.
+func validateParams(p SimParams, name func(flag string) string) error {
+	if p.DeltaTime <= 0 {
+		return fmt.Errorf("invalid %s value %g: must be positive", name("delta-time"), p.DeltaTime)
+	}
+	if p.MaxForce < 0 {
+		return fmt.Errorf("invalid %s value %g: must not be negative", name("max-force"), p.MaxForce)
+	}
+	if p.MaxSpeed <= 0 {
+		return fmt.Errorf("invalid %s value %g: must be positive", name("max-speed"), p.MaxSpeed)
+	}
+	if p.MinSpeed < 0 || p.MinSpeed > p.MaxSpeed {
+		return fmt.Errorf("invalid %s value %g: must be between 0 and %s", name("min-speed"), p.MinSpeed, name("max-speed"))
+	}
+	if !(p.MarginSize > 0 && p.MarginSize < 1) {
+		return fmt.Errorf("invalid %s value %g: must be greater than 0 and less than 1", name("margin-size"), p.MarginSize)
+	}
+	for _, w := range []struct {
+		name  string
+		value float32
+	}{
+		{"alignment-weight", p.AlignmentWeight},
+		{"cohesion-weight", p.CohesionWeight},
+		{"separation-weight", p.SeparationWeight},
+		{"turn-force", p.TurnForce},
+	} {
+		if w.value < 0 {
+			return fmt.Errorf("invalid %s value %g: must not be negative", name(w.name), w.value)
+		}
+	}
+	for _, r := range []struct {
+		name  string
+		value float32
+	}{
+		{"separation-radius", p.SeparationRadius},
+		{"alignment-radius", p.AlignmentRadius},
+		{"cohesion-radius", p.CohesionRadius},
+	} {
+		if r.value <= 0 {
+			return fmt.Errorf("invalid %s value %g: must be positive", name(r.name), r.value)
+		}
+	}
+	if p.WindPeriod < 0 {
+		return fmt.Errorf("invalid %s value %g: must not be negative", name("wind-oscillate"), p.WindPeriod)
+	}
+	if p.Turbulence < 0 {
+		return fmt.Errorf("invalid %s value %g: must not be negative", name("turbulence"), p.Turbulence)
+	}
+	if p.TurbulenceScale <= 0 {
+		return fmt.Errorf("invalid %s value %g: must be positive", name("turbulence-scale"), p.TurbulenceScale)
+	}
+	if p.FieldOfView <= 0 || p.FieldOfView > 360 {
+		return fmt.Errorf("invalid %s value %g: must be greater than 0 and at most 360", name("fov-degrees"), p.FieldOfView)
+	}
+	if p.Falloff < 0 {
+		return fmt.Errorf("invalid %s value %g: must not be negative", name("falloff"), p.Falloff)
+	}
+	if p.Smoothing < 0 || p.Smoothing > MaxSmoothing {
+		return fmt.Errorf("invalid %s value %g: must be between 0 and %g", name("smoothing"), p.Smoothing, MaxSmoothing)
+	}
+	if p.MaxTurnRate <= 0 {
+		return fmt.Errorf("invalid %s value %g: must be positive", name("max-turn"), p.MaxTurnRate)
+	}
+	if p.Lookahead < 0 {
+		return fmt.Errorf("invalid %s value %g: must not be negative", name("lookahead"), p.Lookahead)
+	}
+	return nil
+}
+
+// flagName names a parameter by its command-line flag, e.g. -max-speed.
+func flagName(flag string) string {
+	return "-" + flag
+}
+
+// isFlagSet reports whether the flag name was given on the command line.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// float32Value is a flag.Value for float32 fields, such as those of SimParams.
+type float32Value float32
+
+func (f *float32Value) Set(s string) error {
+	v, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return err
+	}
+	*f = float32Value(v)
+	return nil
+}
+
+func (f *float32Value) String() string {
+	return strconv.FormatFloat(float64(*f), 'g', -1, 32)
+}
+
+// float32Var defines a float32 flag that is stored in p, with the current value of p as its default.
+func float32Var(fs *flag.FlagSet, p *float32, name, usage string) {
+	fs.Var((*float32Value)(p), name, usage)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// maxPendingControls is the number of parameter updates that can wait for the render loop to apply them.
+const maxPendingControls = 16
+
+// ParamUpdate changes simulation parameters of a running simulation. It is received as JSON on the control
+// subject, e.g. {"alignmentWeight": 1.5, "windX": 0.2}. Only the parameters present in the message change,
+// the keys are the JSON names of the SimParams fields.
+type ParamUpdate struct {
+	MaxForce         *float32 `json:"maxForce,omitempty"`
+	MaxSpeed         *float32 `json:"maxSpeed,omitempty"`
+	MinSpeed         *float32 `json:"minSpeed,omitempty"`
+	AlignmentWeight  *float32 `json:"alignmentWeight,omitempty"`
+	CohesionWeight   *float32 `json:"cohesionWeight,omitempty"`
+	SeparationWeight *float32 `json:"separationWeight,omitempty"`
+	SeparationRadius *float32 `json:"separationRadius,omitempty"`
+	AlignmentRadius  *float32 `json:"alignmentRadius,omitempty"`
+	CohesionRadius   *float32 `json:"cohesionRadius,omitempty"`
+	Falloff          *float32 `json:"falloff,omitempty"`
+	WindX            *float32 `json:"windX,omitempty"`
+	WindY            *float32 `json:"windY,omitempty"`
+	Turbulence       *float32 `json:"turbulence,omitempty"`
+	TurnForce        *float32 `json:"turnForce,omitempty"`
+}
+
+// controlParam is a parameter that can be changed by a ParamUpdate.
+type controlParam struct {
+	name   string
+	flag   string // command-line flag of the parameter
+	update *float32
+	param  *float32
+}
+
+// params pairs the fields of u with the parameters in p they change.
+func (u *ParamUpdate) params(p *SimParams) []controlParam {
+	return []controlParam{
+		{name: "maxForce", flag: "max-force", update: u.MaxForce, param: &p.MaxForce},
+		{name: "maxSpeed", flag: "max-speed", update: u.MaxSpeed, param: &p.MaxSpeed},
+		{name: "minSpeed", flag: "min-speed", update: u.MinSpeed, param: &p.MinSpeed},
+		{name: "alignmentWeight", flag: "alignment-weight", update: u.AlignmentWeight, param: &p.AlignmentWeight},
+		{name: "cohesionWeight", flag: "cohesion-weight", update: u.CohesionWeight, param: &p.CohesionWeight},
+		{name: "separationWeight", flag: "separation-weight", update: u.SeparationWeight, param: &p.SeparationWeight},
+		{name: "separationRadius", flag: "separation-radius", update: u.SeparationRadius, param: &p.SeparationRadius},
+		{name: "alignmentRadius", flag: "alignment-radius", update: u.AlignmentRadius, param: &p.AlignmentRadius},
+		{name: "cohesionRadius", flag: "cohesion-radius", update: u.CohesionRadius, param: &p.CohesionRadius},
+		{name: "falloff", flag: "falloff", update: u.Falloff, param: &p.Falloff},
+		{name: "windX", flag: "wind-x", update: u.WindX, param: &p.WindX},
+		{name: "windY", flag: "wind-y", update: u.WindY, param: &p.WindY},
+		{name: "turbulence", flag: "turbulence", update: u.Turbulence, param: &p.Turbulence},
+		{name: "turnForce", flag: "turn-force", update: u.TurnForce, param: &p.TurnForce},
+	}
+}
+
+// DecodeParamUpdate decodes a control message. Unknown parameters are rejected, so typos don't go unnoticed.
+func DecodeParamUpdate(data []byte) (ParamUpdate, error) {
+	var u ParamUpdate
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&u)
+	if err != nil {
+		return ParamUpdate{}, fmt.Errorf("invalid control message: %w", err)
+	}
+	return u, nil
+}
+
+// Validate checks the parameters p has with u applied with the same limits as their command-line flags, so
+// an update can't lower maxSpeed below minSpeed either. Errors name the parameters of u by their JSON names.
+func (u ParamUpdate) Validate(p SimParams) error {
+	names := map[string]string{}
+	empty := true
+	for _, c := range u.params(&p) {
+		names[c.flag] = c.name
+		if c.update == nil {
+			continue
+		}
+		empty = false
+		if v := *c.update; math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return fmt.Errorf("invalid %s value %g: must be finite", c.name, v)
+		}
+		*c.param = *c.update
+	}
+	if empty {
+		return fmt.Errorf("invalid control message: no parameters to change")
+	}
+	return validateParams(p, func(flag string) string {
+		if name, ok := names[flag]; ok {
+			return name
+		}
+		return flagName(flag)
+	})
+}
+
+// ApplyParams applies an update to the simulation parameters from the next frame on. Invalid updates are
+// rejected as a whole, see ParamUpdate.Validate.
+func (s *State) ApplyParams(u ParamUpdate) error {
+	err := u.Validate(s.params)
+	if err != nil {
+		return err
+	}
+	for _, c := range u.params(&s.params) {
+		if c.update != nil {
+			*c.param = *c.update
+			fmt.Printf("%s set to %g\n", c.name, *c.update)
+		}
+	}
+	err = s.queue.WriteBuffer(s.simParamBuffer, 0, s.params.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to update simulation parameters: %w", err)
+	}
+	if u.MaxSpeed != nil {
+		// The speed colors are relative to the maximum speed
+		s.drawParams.MaxSpeed = s.params.MaxSpeed
+		err = s.queue.WriteBuffer(s.drawParamBuffer, 0, s.drawParams.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to update draw parameters: %w", err)
+		}
+	}
+	return nil
+}
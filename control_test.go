@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+// float32Ptr returns a pointer to v, for the fields of a ParamUpdate.
+func float32Ptr(v float32) *float32 {
+	return &v
+}
+
+func TestParamUpdateValidate(t *testing.T) {
+	current := DefaultSimParams()
+	current.MinSpeed = 0.2
+	tests := []struct {
+		name    string
+		update  ParamUpdate
+		wantErr string
+	}{
+		{"valid", ParamUpdate{AlignmentWeight: float32Ptr(1.5), WindX: float32Ptr(-0.2)}, ""},
+		{"empty", ParamUpdate{}, "invalid control message: no parameters to change"},
+		{"negative", ParamUpdate{CohesionWeight: float32Ptr(-1)}, "invalid cohesionWeight value -1: must not be negative"},
+		{"zero radius", ParamUpdate{SeparationRadius: float32Ptr(0)}, "invalid separationRadius value 0: must be positive"},
+		{"min speed above max speed", ParamUpdate{MinSpeed: float32Ptr(0.6)}, "invalid minSpeed value 0.6: must be between 0 and maxSpeed"},
+		// The current minimum speed limits the maximum speed as well
+		{"max speed below min speed", ParamUpdate{MaxSpeed: float32Ptr(0.1)}, "invalid minSpeed value 0.2: must be between 0 and maxSpeed"},
+		{"both speeds", ParamUpdate{MinSpeed: float32Ptr(0.05), MaxSpeed: float32Ptr(0.1)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.update.Validate(current)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("got %v, want no error", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("got %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseConfigRejectsMinSpeedAboveMaxSpeed(t *testing.T) {
+	_, err := ParseConfig([]string{"-min-speed", "0.6", "-max-speed", "0.5"})
+	if want := "invalid -min-speed value 0.6: must be between 0 and -max-speed"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
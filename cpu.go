@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"math"
+)
+
+// Constants of compute.wgsl that stepCPU needs. They must match the shader.
+const (
+	fleeWeight         = 2.0
+	seekWeight         = 1.0
+	predatorSpeed      = 1.2
+	turbulenceDrift    = 0.3
+	maxCombinedForce   = 4.0
+	minFalloffDistance = 0.0001
+	attractorRange     = 1.0
+	attractorWeight    = 1.5
+	avoidanceWeight    = 2.0
+	referenceDeltaTime = 1.0 / 60.0
+)
+
+// stepCPU is a CPU reference of one step of the compute shader, for checking its results. It returns the
+// particle data after the step and leaves particles unchanged. The first ObstacleCount obstacles are avoided
+// and forces holds the external force on every boid as x, y pairs like a ForceProvider, nil for none. It
+// follows the shader step by step, so the results agree up to float rounding, with these differences:
+//   - Every boid sees the others as they were before the step. The shader updates the buffer in place, so
+//     some boids may already see the new state of others.
+//   - Neighbors are always searched among all boids, the neighbor grid finds the same ones in another
+//     order, which only changes the rounding.
+func stepCPU(particles []float32, p SimParams, obstacles []Obstacle, forces []float32) ([]float32, error) {
+	p = p.derived()
+	boids, err := boid.Boids(particles)
+	if err != nil {
+		return nil, err
+	}
+	total := min(int(p.ParticleCount), len(boids))
+	if forces != nil && len(forces) < 2*total {
+		return nil, fmt.Errorf("%d external force values for %d boids, expected %d", len(forces), total, 2*total)
+	}
+	obstacles = obstacles[:min(int(p.ObstacleCount), len(obstacles))]
+	next := append([]float32(nil), particles...)
+	for index := range total {
+		var force boid.Vec3
+		if forces != nil {
+			force = boid.Vec3{X: forces[2*index], Y: forces[2*index+1]}
+		}
+		b := stepBoid(boids, index, total, p, hash(p.Frame), obstacles, force)
+		offset := index * boid.Stride
+		copy(next[offset:], []float32{
+			b.Pos.X, b.Pos.Y, b.Pos.Z, float32(b.Neighbors),
+			b.Vel.X, b.Vel.Y, b.Vel.Z, b.Force,
+		})
+	}
+	return next, nil
+}
+
+// neighborhood mirrors Neighborhood in compute.wgsl.
+type neighborhood struct {
+	alignment, cohesion, separation boid.Vec3
+	count                           uint32
+	cohesionWeight                  float32
+}
+
+// stepBoid mirrors main in compute.wgsl for the boid at index, which is pushed by the external force.
+func stepBoid(boids []boid.Boid, index, total int, p SimParams, frameHash uint32, obstacles []Obstacle, force boid.Vec3) boid.Boid {
+	current := boids[index]
+	var n neighborhood
+	if p.SampleSize == 0 {
+		for i := range total {
+			if i != index {
+				n.accumulate(current, boids[i], p)
+			}
+		}
+	} else {
+		seed := hash(uint32(index) ^ frameHash)
+		for k := range p.SampleSize {
+			i := int(hash(seed+k) % uint32(total))
+			if i != index {
+				n.accumulate(current, boids[i], p)
+			}
+		}
+	}
+	current.Neighbors = n.count
+
+	agility := 1 + current.SpeedJitter
+	maxForce := p.MaxForce * agility
+	maxSpeed := p.MaxSpeed * agility
+
+	alignment := limitVector(sub3(normalize3(n.alignment).Scale(maxSpeed), current.Vel), maxForce)
+	center := n.cohesion.Scale(1 / n.cohesionWeight)
+	cohesion := limitVector(sub3(normalize3(sub3(center, current.Pos)).Scale(maxSpeed), current.Vel), maxForce)
+	separation := limitVector(sub3(normalize3(n.separation).Scale(maxSpeed), current.Vel), maxForce)
+
+	// An underflowing flockCount - 1 selects the last flock, like the clamped index on the GPU
+	weights := p.Flocks[min(current.Flock, p.FlockCount-1, MaxFlocks-1)]
+	acceleration := alignment.Scale(p.AlignmentWeight * weights.Alignment).
+		Add(cohesion.Scale(p.CohesionWeight * weights.Cohesion)).
+		Add(separation.Scale(p.SeparationWeight * weights.Separation))
+	if current.Predator {
+		acceleration = seekPrey(boids, current, total, p)
+		maxSpeed *= predatorSpeed
+	} else {
+		acceleration = acceleration.Add(fleePredators(boids, current, total, p))
+	}
+	acceleration = acceleration.Add(limitVector(avoidObstacles(current, obstacles, p).Scale(maxForce), maxForce).Scale(avoidanceWeight))
+	acceleration = acceleration.Add(limitVector(escapeObstacles(current, obstacles).Scale(maxForce), maxForce).Scale(avoidanceWeight))
+	acceleration = acceleration.Add(limitVector(force, p.MaxForce))
+	acceleration = acceleration.Add(limitVector(attractorForce(current, p), p.MaxForce*attractorWeight))
+	acceleration = acceleration.Add(limitVector(windForce(p), p.MaxForce))
+	acceleration = acceleration.Add(turbulenceForce(current, p))
+	if p.BoundaryMode == BoundaryMargin {
+		acceleration = acceleration.Add(marginForce(current, p).Scale(maxForce))
+	}
+	acceleration = limitVector(acceleration, maxForce*maxCombinedForce)
+	current.Force = acceleration.Len()
+
+	steps := p.DeltaTime / referenceDeltaTime
+	velocity := limitVector(current.Vel.Add(acceleration.Scale(steps)), maxSpeed)
+	velocity = limitTurn(current.Vel, velocity, p.MaxTurnRate*p.DeltaTime)
+	velocity = raiseSpeed(velocity, min(p.MinSpeed, maxSpeed))
+	retained := float32(math.Pow(float64(p.Smoothing), float64(steps)))
+	current.Vel = velocity.Scale(1 - retained).Add(current.Vel.Scale(retained))
+	current.Pos = current.Pos.Add(current.Vel.Scale(p.DeltaTime))
+	if p.BoundaryMode == BoundaryBounce {
+		current.Pos.X, current.Vel.X = bounceAxis(current.Pos.X, current.Vel.X)
+		current.Pos.Y, current.Vel.Y = bounceAxis(current.Pos.Y, current.Vel.Y)
+		current.Pos.Z, current.Vel.Z = bounceAxis(current.Pos.Z, current.Vel.Z)
+	} else if p.BoundaryMode == BoundaryMargin {
+		current.Pos = boid.Vec3{X: min(max(current.Pos.X, -1), 1), Y: min(max(current.Pos.Y, -1), 1), Z: min(max(current.Pos.Z, -1), 1)}
+	} else {
+		current.Pos = boid.Vec3{X: wrapAxis(current.Pos.X), Y: wrapAxis(current.Pos.Y), Z: wrapAxis(current.Pos.Z)}
+	}
+	return current
+}
+
+// accumulate mirrors accumulate in compute.wgsl.
+func (n *neighborhood) accumulate(current, other boid.Boid, p SimParams) {
+	if other.Flock != current.Flock || other.Predator {
+		return
+	}
+	diff := sub3(current.Pos, other.Pos)
+	offset := boid.Vec3{X: diff.X * p.AspectX, Y: diff.Y * p.AspectY, Z: diff.Z}
+	d2 := dot3(offset, offset)
+	if d2 >= p.PerceptionRadiusSq {
+		return
+	}
+	heading := boid.Vec3{X: current.Vel.X * p.AspectX, Y: current.Vel.Y * p.AspectY, Z: current.Vel.Z}
+	if dot3(heading, boid.Vec3{X: -offset.X, Y: -offset.Y, Z: -offset.Z}) < p.FieldOfViewCos*heading.Len()*sqrt32(d2) {
+		return
+	}
+	n.count++
+	weight := float32(1)
+	if p.Falloff > 0 {
+		weight = float32(math.Pow(float64(max(sqrt32(d2), minFalloffDistance)), float64(-p.Falloff)))
+	}
+	if d2 < p.AlignmentRadius*p.AlignmentRadius {
+		n.alignment = n.alignment.Add(other.Vel.Scale(weight))
+	}
+	if d2 < p.CohesionRadius*p.CohesionRadius {
+		n.cohesion = n.cohesion.Add(other.Pos.Scale(weight))
+		n.cohesionWeight += weight
+	}
+	if d2 < p.SeparationRadius*p.SeparationRadius {
+		n.separation = n.separation.Add(normalize3(diff).Scale(1 / sqrt32(d2)))
+	}
+}
+
+// fleePredators mirrors flee_predators in compute.wgsl.
+func fleePredators(boids []boid.Boid, b boid.Boid, total int, p SimParams) boid.Vec3 {
+	var flee boid.Vec3
+	for i := range min(int(p.PredatorCount), total) {
+		offset := sub3(b.Pos, boids[i].Pos)
+		d := offset.Len()
+		if d == 0 || d >= p.PerceptionRadius {
+			continue
+		}
+		flee = flee.Add(offset.Scale((1 - d/p.PerceptionRadius) / d))
+	}
+	return limitVector(flee, 1).Scale(p.MaxForce * fleeWeight)
+}
+
+// seekPrey mirrors seek_prey in compute.wgsl.
+func seekPrey(boids []boid.Boid, b boid.Boid, total int, p SimParams) boid.Vec3 {
+	nearest := float32(-1)
+	var targetOffset boid.Vec3
+	for i := int(p.PredatorCount); i < total; i++ {
+		offset := sub3(boids[i].Pos, b.Pos)
+		dSq := dot3(offset, offset)
+		if nearest < 0 || dSq < nearest {
+			nearest = dSq
+			targetOffset = offset
+		}
+	}
+	if nearest <= 0 {
+		return boid.Vec3{}
+	}
+	desired := normalize3(targetOffset).Scale(p.MaxSpeed * predatorSpeed)
+	return limitVector(sub3(desired, b.Vel), p.MaxForce).Scale(seekWeight)
+}
+
+// avoidObstacles mirrors avoid_obstacles in compute.wgsl.
+func avoidObstacles(b boid.Boid, obstacles []Obstacle, p SimParams) boid.Vec3 {
+	speed := sqrt32(b.Vel.X*b.Vel.X + b.Vel.Y*b.Vel.Y)
+	if len(obstacles) == 0 || p.Lookahead <= 0 || speed == 0 {
+		return boid.Vec3{}
+	}
+	dirX, dirY := b.Vel.X/speed, b.Vel.Y/speed
+	nearest := p.Lookahead
+	var steer boid.Vec3
+	for _, o := range obstacles {
+		t := (o.X-b.Pos.X)*dirX + (o.Y-b.Pos.Y)*dirY
+		offsetX, offsetY := b.Pos.X+dirX*t-o.X, b.Pos.Y+dirY*t-o.Y
+		distSq := offsetX*offsetX + offsetY*offsetY
+		if distSq >= o.Radius*o.Radius {
+			continue
+		}
+		halfChord := sqrt32(o.Radius*o.Radius - distSq)
+		hit := t - halfChord
+		if hit > nearest || t+halfChord < 0 {
+			continue
+		}
+		nearest = max(hit, 0)
+		sideX, sideY := -dirY, dirX
+		if sideX*offsetX+sideY*offsetY < 0 {
+			sideX, sideY = -sideX, -sideY
+		}
+		steer = boid.Vec3{X: sideX, Y: sideY}.Scale(1 - nearest/p.Lookahead)
+	}
+	return steer
+}
+
+// escapeObstacles mirrors escape_obstacles in compute.wgsl.
+func escapeObstacles(b boid.Boid, obstacles []Obstacle) boid.Vec3 {
+	var escape boid.Vec3
+	for _, o := range obstacles {
+		offset := boid.Vec3{X: b.Pos.X - o.X, Y: b.Pos.Y - o.Y}
+		d := offset.Len()
+		if d >= o.Radius {
+			continue
+		}
+		if d == 0 {
+			escape = escape.Add(boid.Vec3{X: 1})
+		} else {
+			escape = escape.Add(offset.Scale(1 / d))
+		}
+	}
+	if dot3(escape, escape) == 0 {
+		return boid.Vec3{}
+	}
+	return normalize3(escape)
+}
+
+// attractorForce mirrors attractor_force in compute.wgsl.
+func attractorForce(b boid.Boid, p SimParams) boid.Vec3 {
+	if p.AttractorMode == AttractorOff {
+		return boid.Vec3{}
+	}
+	offset := sub3(boid.Vec3{X: p.AttractorX, Y: p.AttractorY}, b.Pos)
+	d := offset.Len()
+	if d == 0 || d >= attractorRange {
+		return boid.Vec3{}
+	}
+	force := offset.Scale(p.MaxForce * attractorWeight * (1 - d/attractorRange) / d)
+	if p.AttractorMode == AttractorRepel {
+		force = force.Scale(-1)
+	}
+	return force
+}
+
+// windForce mirrors wind_force in compute.wgsl.
+func windForce(p SimParams) boid.Vec3 {
+	strength := float32(1)
+	if p.WindPeriod > 0 {
+		strength = float32(math.Sin(float64(p.Time * 6.2831853 / p.WindPeriod)))
+	}
+	return boid.Vec3{X: p.WindX, Y: p.WindY}.Scale(strength)
+}
+
+// turbulenceForce mirrors turbulence_force in compute.wgsl.
+func turbulenceForce(b boid.Boid, p SimParams) boid.Vec3 {
+	if p.Turbulence == 0 {
+		return boid.Vec3{}
+	}
+	drift := p.Time * turbulenceDrift
+	dx, dy := valueNoiseGradient(b.Pos.X*p.TurbulenceScale+drift, b.Pos.Y*p.TurbulenceScale+drift)
+	swirl := boid.Vec3{X: dy, Y: -dx}
+	return limitVector(swirl.Scale(p.MaxForce), p.MaxForce).Scale(p.Turbulence)
+}
+
+// valueNoiseGradient mirrors the gradient returned by value_noise in compute.wgsl.
+func valueNoiseGradient(x, y float32) (float32, float32) {
+	cellX, cellY := floor32(x), floor32(y)
+	fx, fy := x-cellX, y-cellY
+	ux, uy := fx*fx*(3-2*fx), fy*fy*(3-2*fy)
+	dux, duy := 6*fx*(1-fx), 6*fy*(1-fy)
+	ix, iy := int32(cellX), int32(cellY)
+	a := latticeValue(ix, iy)
+	b := latticeValue(ix+1, iy)
+	c := latticeValue(ix, iy+1)
+	d := latticeValue(ix+1, iy+1)
+	return dux * mix32(b-a, d-c, uy), duy * mix32(c-a, d-b, ux)
+}
+
+// latticeValue mirrors lattice_value in compute.wgsl.
+func latticeValue(x, y int32) float32 {
+	return float32(hash((uint32(x)*73856093)^(uint32(y)*19349663))) / 4294967295.0
+}
+
+// hash mirrors the PCG hash in compute.wgsl.
+func hash(value uint32) uint32 {
+	state := value*747796405 + 2891336453
+	word := ((state >> ((state >> 28) + 4)) ^ state) * 277803737
+	return (word >> 22) ^ word
+}
+
+// limitVector mirrors limit_vector in compute.wgsl. Like on the GPU, vectors with NaN components, e.g. the
+// normalized zero vector, become zero.
+func limitVector(v boid.Vec3, maxLength float32) boid.Vec3 {
+	lengthSq := dot3(v, v)
+	if lengthSq > 0 {
+		if lengthSq > maxLength*maxLength {
+			return normalize3(v).Scale(maxLength)
+		}
+		return v
+	}
+	return boid.Vec3{}
+}
+
+// raiseSpeed mirrors raise_speed in compute.wgsl.
+func raiseSpeed(v boid.Vec3, minLength float32) boid.Vec3 {
+	l := v.Len()
+	if l == 0 || l >= minLength {
+		return v
+	}
+	return v.Scale(minLength / l)
+}
+
+// limitTurn mirrors limit_turn in compute.wgsl.
+func limitTurn(v, desired boid.Vec3, maxAngle float32) boid.Vec3 {
+	speed := desired.Len()
+	if dot3(v, v) == 0 || speed == 0 {
+		return desired
+	}
+	heading := normalize3(v)
+	desiredDir := desired.Scale(1 / speed)
+	cosDelta := dot3(heading, desiredDir)
+	if float32(math.Acos(float64(min(max(cosDelta, -1), 1)))) <= maxAngle {
+		return desired
+	}
+	side := sub3(desiredDir, heading.Scale(cosDelta))
+	if dot3(side, side) < 1e-12 {
+		side = boid.Vec3{X: -heading.Y, Y: heading.X}
+		if dot3(side, side) < 1e-12 {
+			side = boid.Vec3{X: 1}
+		}
+	}
+	side = normalize3(side)
+	sin, cos := math.Sincos(float64(maxAngle))
+	return heading.Scale(float32(cos)).Add(side.Scale(float32(sin))).Scale(speed)
+}
+
+// marginForce mirrors margin_force in compute.wgsl.
+func marginForce(b boid.Boid, p SimParams) boid.Vec3 {
+	inner := 1 - p.MarginSize
+	axis := func(position float32) float32 {
+		switch {
+		case position < -inner:
+			return p.TurnForce
+		case position > inner:
+			return -p.TurnForce
+		}
+		return 0
+	}
+	return boid.Vec3{X: axis(b.Pos.X), Y: axis(b.Pos.Y), Z: axis(b.Pos.Z)}
+}
+
+// bounceAxis mirrors one axis of bounce in compute.wgsl.
+func bounceAxis(position, velocity float32) (float32, float32) {
+	if abs32(position) < 1 {
+		return position, velocity
+	}
+	position = min(max(position, -1), 1)
+	return position, -sign32(position) * abs32(velocity)
+}
+
+// wrapAxis mirrors one axis of the wrapping at the end of main in compute.wgsl.
+func wrapAxis(position float32) float32 {
+	return min(max(position-2*floor32((position+1)/2), -1), 1)
+}
+
+func sub3(a, b boid.Vec3) boid.Vec3 {
+	return boid.Vec3{X: a.X - b.X, Y: a.Y - b.Y, Z: a.Z - b.Z}
+}
+
+func dot3(a, b boid.Vec3) float32 {
+	return a.X*b.X + a.Y*b.Y + a.Z*b.Z
+}
+
+// normalize3 returns v with length 1, or NaN components for the zero vector like normalize in WGSL.
+func normalize3(v boid.Vec3) boid.Vec3 {
+	return v.Scale(1 / v.Len())
+}
+
+func sqrt32(f float32) float32 {
+	return float32(math.Sqrt(float64(f)))
+}
+
+func floor32(f float32) float32 {
+	return float32(math.Floor(float64(f)))
+}
+
+func abs32(f float32) float32 {
+	return float32(math.Abs(float64(f)))
+}
+
+func sign32(f float32) float32 {
+	switch {
+	case f > 0:
+		return 1
+	case f < 0:
+		return -1
+	}
+	return 0
+}
+
+func mix32(a, b, t float32) float32 {
+	return a*(1-t) + b*t
+}
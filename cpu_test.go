@@ -0,0 +1,194 @@
+package main
+
+import (
+	"github.com/brodo/goBoids/boid"
+	"math/rand"
+	"testing"
+)
+
+// compareBoids fails the test for every boid whose position, velocity or steering force differ by more than
+// tolerance between got and want, or whose neighbor count differs.
+func compareBoids(t *testing.T, got, want []float32, tolerance float32) {
+	t.Helper()
+	gotBoids, err := boid.Boids(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBoids, err := boid.Boids(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotBoids) != len(wantBoids) {
+		t.Fatalf("got %d boids, want %d", len(gotBoids), len(wantBoids))
+	}
+	mismatches := 0
+	for i, g := range gotBoids {
+		w := wantBoids[i]
+		if sub3(g.Pos, w.Pos).Len() > tolerance || sub3(g.Vel, w.Vel).Len() > tolerance ||
+			abs32(g.Force-w.Force) > tolerance || g.Neighbors != w.Neighbors {
+			mismatches++
+			if mismatches <= 5 {
+				t.Errorf("boid %d is %+v, want %+v", i, g, w)
+			}
+		}
+	}
+	if mismatches > 5 {
+		t.Errorf("%d boids differ in total", mismatches)
+	}
+}
+
+func TestStepCPUMatchesGPU(t *testing.T) {
+	cfg := testConfig(256)
+	cfg.Seed = 7
+	cfg.Obstacles = []Obstacle{{X: 0.3, Y: 0.2, Radius: 0.2}, {X: -0.5, Y: -0.4, Radius: 0.1}}
+	cfg.SpeedVariance = 0.2
+	cfg.Params.PredatorCount = 2
+	// Neighbors may already see the new velocity of a boid on the GPU, see stepCPU, so alignment is
+	// left out. The short time step keeps the positions they see close to the old ones.
+	cfg.Params.AlignmentWeight = 0
+	cfg.Params.DeltaTime = 1e-4
+	cfg.Params.MinSpeed = 0.05
+	cfg.Params.MaxTurnRate = 2000
+	cfg.Params.Smoothing = 0.3
+	cfg.Params.Falloff = 1
+	cfg.Params.FieldOfView = 270
+	cfg.Params.WindX, cfg.Params.WindY, cfg.Params.WindPeriod = 0.02, -0.01, 3
+	cfg.Params.Turbulence = 0.5
+	cfg.Params.Time = 1.3
+	cfg.Params.BoundaryMode = BoundaryMargin
+	s := newTestState(t, cfg)
+	s.SetAttractor([2]float32{0.1, -0.1}, AttractorRepel)
+	forces := make([]float32, 2*s.numParticles)
+	for i := range forces {
+		forces[i] = float32(i%7-3) * 0.01
+	}
+	err := s.SetForceProvider(func(uint64) []float32 { return forces })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, after := stepGPU(t, s, 1)
+	want, err := stepCPU(before, s.params, cfg.Obstacles, forces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBoids(t, after, want, 1e-3)
+}
+
+func TestStepCPURejectsPartialBoids(t *testing.T) {
+	_, err := stepCPU(make([]float32, boid.Stride+1), DefaultSimParams(), nil, nil)
+	if err == nil {
+		t.Error("partial boid accepted")
+	}
+}
+
+// substepCPU advances particles by one frame of p in n steps of stepCPU, like Render with n sub-steps.
+func substepCPU(t *testing.T, particles []float32, p SimParams, n int) []float32 {
+	t.Helper()
+	p.DeltaTime /= float32(n)
+	for range n {
+		var err error
+		particles, err = stepCPU(particles, p, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return particles
+}
+
+// maxDistance returns the largest distance between the positions of a boid in a and b.
+func maxDistance(t *testing.T, a, b []float32) float32 {
+	t.Helper()
+	aBoids, err := boid.Boids(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bBoids, err := boid.Boids(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var distance float32
+	for i := range aBoids {
+		distance = max(distance, sub3(aBoids[i].Pos, bBoids[i].Pos).Len())
+	}
+	return distance
+}
+
+// substepParams returns the parameters of a flock of boids that fly at speed and steer with the default
+// strength relative to it.
+func substepParams(boids int, speed float32) SimParams {
+	p := DefaultSimParams()
+	p.ParticleCount = uint32(boids)
+	p.AspectX, p.AspectY = 1, 1
+	p.MaxSpeed = speed
+	p.MaxForce = speed / 5
+	return p
+}
+
+// runSubsteps simulates frames of p from particles with n sub-steps per frame. It returns the particles
+// after the last frame and calls each with those after every frame.
+func runSubsteps(t *testing.T, particles []float32, p SimParams, frames, n int, each func([]float32)) []float32 {
+	t.Helper()
+	for frame := range frames {
+		p.Frame = uint32(frame)
+		particles = substepCPU(t, particles, p, n)
+		if each != nil {
+			each(particles)
+		}
+	}
+	return particles
+}
+
+func TestSubstepsMatchSingleStepAtLowSpeed(t *testing.T) {
+	const boids, frames = 256, 3
+	// At the default speed, boids move a fraction of the separation radius per frame
+	p := DefaultSimParams()
+	p.ParticleCount = boids
+	p.AspectX, p.AspectY = 1, 1
+	speeds := SpeedDistribution{Kind: SpeedConstant, Speed: p.MaxSpeed}
+	initial := generateInitialParticles(rand.New(rand.NewSource(5)), boids, LayoutCluster, speeds, 0, false, 1, 0)
+	single := runSubsteps(t, initial, p, frames, 1, nil)
+	substepped := runSubsteps(t, initial, p, frames, 4, nil)
+	fine := runSubsteps(t, initial, p, frames, 16, nil)
+
+	// Sub-steps only change when within a frame the steering takes effect, which moves a boid by at most
+	// the largest velocity change times the frame time
+	bound := maxCombinedForce * p.MaxForce * p.DeltaTime * frames
+	if d := maxDistance(t, single, fine); d > bound {
+		t.Errorf("boids are up to %v apart with 1 and 16 sub-steps per frame, want at most %v", d, bound)
+	}
+	// More sub-steps converge
+	if coarse, finer := maxDistance(t, single, fine), maxDistance(t, substepped, fine); finer > coarse/2 {
+		t.Errorf("boids are up to %v apart with 4 and 16 sub-steps per frame and %v with 1 and 16, want at most half", finer, coarse)
+	}
+}
+
+func TestSubstepsReduceOverlapsAtHighSpeed(t *testing.T) {
+	const boids, frames = 256, 30
+	p := substepParams(boids, 2)
+	speeds := SpeedDistribution{Kind: SpeedConstant, Speed: p.MaxSpeed}
+	initial := generateInitialParticles(rand.New(rand.NewSource(5)), boids, LayoutCluster, speeds, 0, false, 1, 0)
+	// overlaps counts the pairs of boids within half the separation radius over all frames
+	overlaps := func(n int) int {
+		count := 0
+		runSubsteps(t, initial, p, frames, n, func(particles []float32) {
+			b, err := boid.Boids(particles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range b {
+				for j := i + 1; j < len(b); j++ {
+					if sub3(b[i].Pos, b[j].Pos).Len() < p.SeparationRadius/2 {
+						count++
+					}
+				}
+			}
+		})
+		return count
+	}
+	// Fast boids overshoot each other within a frame, so separation only keeps them apart with sub-steps
+	single, substepped := overlaps(1), overlaps(4)
+	if substepped >= single*3/4 {
+		t.Errorf("got %d overlaps with 4 sub-steps per frame and %d without, want at least a quarter fewer", substepped, single)
+	}
+}
@@ -3,27 +3,120 @@ struct VertexOutput {
     @location(0) color: vec4<f32>,
 }
 
+struct DrawParams {
+    boidColor: vec4<f32>, // the color of all boids in COLOR_SOLID mode
+    colorMode: u32, // one of the COLOR_ constants
+    maxSpeed: f32,
+    aspect: vec2<f32>, // scales simulation offsets to their proportions on screen, the shorter side is 1
+    viewCenter: vec2<f32>, // world position in the center of the window
+    viewZoom: f32, // magnification of the world around viewCenter, 1 shows all of it
+    boidSize: f32, // scale of the boid mesh
+    time: f32, // simulated seconds, only updated in COLOR_RAINBOW mode
+    colorPeriod: f32, // seconds the hue of COLOR_RAINBOW takes to cycle once
+}
+
+struct PickOutput {
+    @builtin(position) position: vec4<f32>,
+    @location(0) @interpolate(flat) id: u32,
+}
+
+// Color modes, see ColorMode in params.go
+const COLOR_SOLID = 0u;
+const COLOR_SPEED = 1u;
+const COLOR_FLOCK = 2u;
+const COLOR_DENSITY = 3u;
+const COLOR_RAINBOW = 4u;
+// Saturation of the COLOR_RAINBOW hues, below 1 to keep them from glaring
+const RAINBOW_SATURATION = 0.8;
+// Neighbor count drawn in the middle of the density ramp. The ramp approaches its end for crowded boids
+// without a fixed maximum, which depends on the number of boids and the perception radius.
+const DENSITY_HALF = 8.0;
+// Colors of the flocks in COLOR_FLOCK mode, repeating after the last one
+const FLOCK_COLORS = array<vec3<f32>, 8>(
+    vec3<f32>(1.0, 0.8, 0.0),
+    vec3<f32>(0.2, 0.6, 1.0),
+    vec3<f32>(1.0, 0.3, 0.3),
+    vec3<f32>(0.3, 0.9, 0.4),
+    vec3<f32>(0.8, 0.4, 1.0),
+    vec3<f32>(1.0, 0.5, 0.1),
+    vec3<f32>(0.2, 0.9, 0.9),
+    vec3<f32>(1.0, 0.5, 0.8),
+);
+
+@group(0) @binding(0) var<uniform> draw_params: DrawParams;
+
+// Predators are drawn this much larger, in PREDATOR_COLOR regardless of the color mode
+const PREDATOR_SCALE = 3.0;
+const PREDATOR_COLOR = vec3<f32>(1.0, 0.1, 0.1);
+
+// How much smaller boids get with depth. The plane z = 0 is drawn unscaled, so 2D runs are unaffected.
+const PERSPECTIVE = 0.5;
+
+// Converts a color from HSV to RGB, all components between 0 and 1. The hue wraps around.
+fn hsv_to_rgb(h: f32, s: f32, v: f32) -> vec3<f32> {
+    let p = abs(fract(vec3<f32>(h) + vec3<f32>(1.0, 2.0 / 3.0, 1.0 / 3.0)) * 6.0 - 3.0);
+    return v * mix(vec3<f32>(1.0), clamp(p - 1.0, vec3<f32>(0.0), vec3<f32>(1.0)), s);
+}
+
+// Rotates the vertex of the boid mesh to point along the velocity as seen on screen and moves it to the particle.
+// The shape is undone from the window's stretching by aspect, so boids keep their shape in any window.
+// The view transform zooms and pans the result. Boids grow when zooming in, but keep their size when
+// zooming out, so they stay visible.
+fn boid_position(particle_pos: vec3<f32>, particle_vel: vec3<f32>, position: vec2<f32>, params: DrawParams) -> vec4<f32> {
+    // The mesh points along +y, the rotation turns +y into the heading. Boids at rest point up,
+    // instead of normalizing a zero vector into NaNs.
+    let heading = particle_vel.xy * params.aspect;
+    let speed = length(heading);
+    let dir = select(vec2<f32>(0.0, 1.0), heading / speed, speed > 1e-8);
+    let rotation = mat2x2<f32>(vec2<f32>(dir.y, -dir.x), dir);
+    let pos = rotation * position / params.aspect;
+    let size = params.boidSize * max(params.viewZoom, 1.0);
+    // Dividing by w moves distant boids (larger z) towards the center and shrinks them
+    let w = 1.0 + particle_pos.z * PERSPECTIVE;
+    return vec4<f32>(pos * size + (particle_pos.xy - params.viewCenter) * params.viewZoom, 0.0, w);
+}
+
 @vertex
 fn main_vs(
-    @location(0) particle_pos: vec2<f32>,
-    @location(1) particle_vel: vec2<f32>,
+    @location(0) particle_pos: vec3<f32>,
+    @location(1) particle_vel: vec3<f32>,
     @location(2) position: vec2<f32>,
+    @location(3) flock: f32,
+    @location(4) predator: f32,
+    @location(5) neighbors: f32,
 ) -> VertexOutput{
-    let angle = -atan2(particle_vel.x, particle_vel.y);
-    let pos = vec2<f32>(
-        position.x * cos(angle) - position.y * sin(angle),
-        position.x * sin(angle) + position.y * cos(angle)
-    );
-    // Calculate color based on velocity
-    let speed = length(particle_vel);
-    let color = vec3<f32>(
-        min(speed * 2, 1.0),       // Red increases with speed
-        0.5,                          // Fixed green component
-        max(1.0 - speed * 2.0, 0.0)   // Blue decreases with speed
-    );
+    var color = draw_params.boidColor.rgb;
+    if (draw_params.colorMode == COLOR_SPEED) {
+        // Calculate color based on velocity, relative to the maximum speed
+        let speed = length(particle_vel) / draw_params.maxSpeed;
+        color = vec3<f32>(
+            min(speed, 1.0),            // Red increases with speed
+            0.5,                        // Fixed green component
+            max(1.0 - speed, 0.0)       // Blue decreases with speed
+        );
+    } else if (draw_params.colorMode == COLOR_FLOCK) {
+        // Constant arrays can't be indexed dynamically, copies in variables can
+        var colors = FLOCK_COLORS;
+        color = colors[u32(flock) % 8u];
+    } else if (draw_params.colorMode == COLOR_DENSITY) {
+        // Isolated boids are dark blue, crowded ones turn green and then yellow
+        let density = neighbors / (neighbors + DENSITY_HALF);
+        color = mix(
+            mix(vec3<f32>(0.1, 0.2, 0.6), vec3<f32>(0.1, 0.8, 0.4), min(density * 2.0, 1.0)),
+            vec3<f32>(1.0, 0.9, 0.1),
+            max(density * 2.0 - 1.0, 0.0)
+        );
+    } else if (draw_params.colorMode == COLOR_RAINBOW) {
+        color = hsv_to_rgb(draw_params.time / draw_params.colorPeriod, RAINBOW_SATURATION, 1.0);
+    }
+    var shape = position;
+    if (predator != 0.0) {
+        color = PREDATOR_COLOR;
+        shape *= PREDATOR_SCALE;
+    }
 
     var output: VertexOutput;
-    output.position = vec4<f32>(pos + particle_pos, 0.0, 1.0);
+    output.position = boid_position(particle_pos, particle_vel, shape, draw_params);
     output.color = vec4<f32>(color, 1.0);
     return output;
 }
@@ -32,3 +125,28 @@ fn main_vs(
 fn main_fs(@location(0) color: vec4<f32>) -> @location(0) vec4<f32> {
     return color;
 }
+
+// The pick pass draws every boid with its index + 1 into an integer texture, 0 is the background
+@vertex
+fn pick_vs(
+    @builtin(instance_index) instance: u32,
+    @location(0) particle_pos: vec3<f32>,
+    @location(1) particle_vel: vec3<f32>,
+    @location(2) position: vec2<f32>,
+    @location(4) predator: f32,
+) -> PickOutput {
+    // Predators are picked by the same, larger shape they are drawn with
+    var shape = position;
+    if (predator != 0.0) {
+        shape *= PREDATOR_SCALE;
+    }
+    var output: PickOutput;
+    output.position = boid_position(particle_pos, particle_vel, shape, draw_params);
+    output.id = instance + 1u;
+    return output;
+}
+
+@fragment
+fn pick_fs(@location(0) @interpolate(flat) id: u32) -> @location(0) u32 {
+    return id;
+}
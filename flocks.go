@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxFlocks is the number of flocks SimParams has room for. It must match MAX_FLOCKS in compute.wgsl.
+const MaxFlocks = 8
+
+// FlockWeights scale the flocking rule weights of SimParams for the boids of one flock.
+// It mirrors the FlockWeights struct in compute.wgsl.
+type FlockWeights struct {
+	Alignment  float32 `json:"alignment"`
+	Cohesion   float32 `json:"cohesion"`
+	Separation float32 `json:"separation"`
+	_          float32 // pads the struct to the 16 byte array stride of uniforms
+}
+
+// ParseFlockWeights parses a semicolon-separated list of weight scales in the form
+// "alignment,cohesion,separation;alignment,cohesion,separation", one entry per flock.
+// Flocks without an entry keep the weights of SimParams.
+func ParseFlockWeights(s string, flocks uint32) ([MaxFlocks]FlockWeights, error) {
+	var weights [MaxFlocks]FlockWeights
+	for i := range weights {
+		weights[i] = FlockWeights{Alignment: 1, Cohesion: 1, Separation: 1}
+	}
+	if strings.TrimSpace(s) == "" {
+		return weights, nil
+	}
+	defs := strings.Split(s, ";")
+	if len(defs) > int(flocks) {
+		return weights, fmt.Errorf("%d flock weights given for %d flocks", len(defs), flocks)
+	}
+	for i, def := range defs {
+		parts := strings.Split(def, ",")
+		if len(parts) != 3 {
+			return weights, fmt.Errorf("invalid flock weights %q: expected alignment,cohesion,separation", def)
+		}
+		var values [3]float32
+		for j, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+			if err != nil {
+				return weights, fmt.Errorf("invalid flock weights %q: %w", def, err)
+			}
+			if v < 0 {
+				return weights, fmt.Errorf("invalid flock weights %q: weights must not be negative", def)
+			}
+			values[j] = float32(v)
+		}
+		weights[i] = FlockWeights{Alignment: values[0], Cohesion: values[1], Separation: values[2]}
+	}
+	return weights, nil
+}
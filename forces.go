@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/cogentcore/webgpu/wgpu"
+	"math"
+	"time"
+)
+
+// ForceProvider returns the external force on every boid for a frame as x, y pairs in boid index order,
+// so it has a length of 2 times the number of particles. Forces use the coordinate system of the particle positions:
+// x points right and y points up, and the screen spans -1 to 1 on both axes. In 3D, forces act parallel to the
+// screen. A force is an acceleration that is added to the flocking forces and capped at SimParams.MaxForce.
+// Returning nil applies no force.
+type ForceProvider func(frame uint64) []float32
+
+// SetForceProvider sets the function that supplies external forces each frame. nil, the default,
+// removes all external forces. It must be called from the goroutine that calls Render.
+func (s *State) SetForceProvider(provider ForceProvider) error {
+	s.forceProvider = provider
+	if provider == nil && s.forceBuffer != nil {
+		return s.queue.WriteBuffer(s.forceBuffer, 0, wgpu.ToBytes(make([]float32, 2*s.numParticles)))
+	}
+	return nil
+}
+
+// forceBufferSize is the size of the external force buffer in bytes, one vec2<f32> per boid.
+func (s *State) forceBufferSize() uint64 {
+	return uint64(2 * 4 * s.numParticles)
+}
+
+// uploadForces asks the force provider for this frame's forces and uploads them.
+func (s *State) uploadForces() error {
+	if s.forceProvider == nil {
+		return nil
+	}
+	forces := s.forceProvider(s.frameNum)
+	if forces == nil {
+		forces = make([]float32, 2*s.numParticles)
+	}
+	if len(forces) != 2*int(s.numParticles) {
+		return fmt.Errorf("force provider returned %d values, expected %d", len(forces), 2*s.numParticles)
+	}
+	err := s.queue.WriteBuffer(s.forceBuffer, 0, wgpu.ToBytes(forces))
+	if err != nil {
+		return fmt.Errorf("failed to upload external forces: %w", err)
+	}
+	return nil
+}
+
+// forceLogInterval is how often logForces prints the force statistics.
+const forceLogInterval = 5 * time.Second
+
+// logForces prints the smallest, mean and largest steering force magnitude of a frame received on frames
+// every forceLogInterval, until the channel is closed. maxForce is printed alongside as the per-rule limit.
+func logForces(frames <-chan []float32, maxForce float32) {
+	var last time.Time
+	for data := range frames {
+		if time.Since(last) < forceLogInterval {
+			continue
+		}
+		boids, err := boid.Boids(data)
+		if err != nil || len(boids) == 0 {
+			continue
+		}
+		last = time.Now()
+
+		least, most, sum := float32(math.Inf(1)), float32(0), float64(0)
+		for _, b := range boids {
+			least = min(least, b.Force)
+			most = max(most, b.Force)
+			sum += float64(b.Force)
+		}
+		fmt.Printf("steering forces of %d boids: min %.4g, mean %.4g, max %.4g (max-force %g per rule)\n",
+			len(boids), least, sum/float64(len(boids)), most, maxForce)
+	}
+}
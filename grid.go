@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+)
+
+const (
+	// gridMaxWidth is the largest number of grid cells along each axis. It must match MAX_GRID_WIDTH in compute.wgsl.
+	// The number of cells must be a multiple of every workgroup size.
+	gridMaxWidth = 128
+	// gridCells is the number of cells the grid buffers have room for.
+	gridCells = gridMaxWidth * gridMaxWidth
+)
+
+// computeBindings describes the bindings of compute.wgsl. All compute pipelines share this layout,
+// so a single bind group serves the grid passes and the simulation.
+var computeBindings = []wgpu.BufferBindingType{
+	wgpu.BufferBindingTypeStorage,         // 0: boids
+	wgpu.BufferBindingTypeUniform,         // 1: params
+	wgpu.BufferBindingTypeReadOnlyStorage, // 2: obstacles
+	wgpu.BufferBindingTypeReadOnlyStorage, // 3: externalForces
+	wgpu.BufferBindingTypeStorage,         // 4: cellCounts
+	wgpu.BufferBindingTypeStorage,         // 5: cellOffsets
+	wgpu.BufferBindingTypeStorage,         // 6: boidSlots
+	wgpu.BufferBindingTypeStorage,         // 7: sortedIndices
+}
+
+// createComputeLayout creates the bind group layout of computeBindings and a pipeline layout with it.
+func (s *State) createComputeLayout() (*wgpu.BindGroupLayout, *wgpu.PipelineLayout, error) {
+	entries := make([]wgpu.BindGroupLayoutEntry, len(computeBindings))
+	for i, typ := range computeBindings {
+		entries[i] = wgpu.BindGroupLayoutEntry{
+			Binding:    uint32(i),
+			Visibility: wgpu.ShaderStageCompute,
+			Buffer:     wgpu.BufferBindingLayout{Type: typ},
+		}
+	}
+	bindGroupLayout, err := s.device.CreateBindGroupLayout(&wgpu.BindGroupLayoutDescriptor{
+		Label:   "Compute bind group layout",
+		Entries: entries,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create compute bind group layout: %w", err)
+	}
+	pipelineLayout, err := s.device.CreatePipelineLayout(&wgpu.PipelineLayoutDescriptor{
+		Label:            "Compute pipeline layout",
+		BindGroupLayouts: []*wgpu.BindGroupLayout{bindGroupLayout},
+	})
+	if err != nil {
+		bindGroupLayout.Release()
+		return nil, nil, fmt.Errorf("failed to create compute pipeline layout: %w", err)
+	}
+	return bindGroupLayout, pipelineLayout, nil
+}
+
+// createGridPipelines creates the passes that sort the boids into the neighbor grid before each simulation step.
+func (s *State) createGridPipelines(computeShader *wgpu.ShaderModule, layout *wgpu.PipelineLayout) error {
+	for _, p := range []struct {
+		pipeline   **wgpu.ComputePipeline
+		entryPoint string
+	}{
+		{&s.gridClearPipeline, "grid_clear"},
+		{&s.gridCountPipeline, "grid_count"},
+		{&s.gridScanPipeline, "grid_scan"},
+		{&s.gridScatterPipeline, "grid_scatter"},
+	} {
+		pipeline, err := s.device.CreateComputePipeline(&wgpu.ComputePipelineDescriptor{
+			Label:  p.entryPoint + " pipeline",
+			Layout: layout,
+			Compute: wgpu.ProgrammableStageDescriptor{
+				Module:     computeShader,
+				EntryPoint: p.entryPoint,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %s pipeline: %w", p.entryPoint, err)
+		}
+		*p.pipeline = pipeline
+	}
+	return nil
+}
+
+// createGridBuffers creates the buffers of the neighbor grid: the boid count and the offset into
+// sortedIndices of every cell, the cell and rank within the cell of every boid, and the boid indices
+// sorted by cell.
+func (s *State) createGridBuffers() error {
+	for _, b := range []struct {
+		buffer **wgpu.Buffer
+		label  string
+		size   uint64
+	}{
+		{&s.cellCountBuffer, "Cell Count Buffer", gridCells * 4},
+		{&s.cellOffsetBuffer, "Cell Offset Buffer", gridCells * 4},
+		{&s.boidSlotBuffer, "Boid Slot Buffer", uint64(s.numParticles) * 2 * 4},
+		{&s.sortedIndexBuffer, "Sorted Index Buffer", uint64(s.numParticles) * 4},
+	} {
+		buffer, err := s.device.CreateBuffer(&wgpu.BufferDescriptor{
+			Label: b.label,
+			Size:  b.size,
+			Usage: wgpu.BufferUsageStorage,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", b.label, err)
+		}
+		*b.buffer = buffer
+	}
+	return nil
+}
+
+// sortIntoGrid records the passes that sort the boids into the neighbor grid: clearing the cell counts,
+// counting the boids per cell, computing where each cell starts and writing the boid indices in cell order.
+func (s *State) sortIntoGrid(computePass *wgpu.ComputePassEncoder) {
+	computePass.SetPipeline(s.gridClearPipeline)
+	computePass.DispatchWorkgroups(gridCells/s.workgroupSize, 1, 1)
+	computePass.SetPipeline(s.gridCountPipeline)
+	computePass.DispatchWorkgroups(s.workGroupCount, 1, 1)
+	// A single workgroup scans all cells
+	computePass.SetPipeline(s.gridScanPipeline)
+	computePass.DispatchWorkgroups(1, 1, 1)
+	computePass.SetPipeline(s.gridScatterPipeline)
+	computePass.DispatchWorkgroups(s.workGroupCount, 1, 1)
+	s.metrics.Dispatched(4)
+}
+
+// releaseGrid releases the grid buffers and pipelines.
+func (s *State) releaseGrid() {
+	for _, buffer := range []**wgpu.Buffer{&s.cellCountBuffer, &s.cellOffsetBuffer, &s.boidSlotBuffer, &s.sortedIndexBuffer} {
+		if *buffer != nil {
+			(*buffer).Release()
+			*buffer = nil
+		}
+	}
+	for _, pipeline := range []**wgpu.ComputePipeline{&s.gridClearPipeline, &s.gridCountPipeline, &s.gridScanPipeline, &s.gridScatterPipeline} {
+		if *pipeline != nil {
+			(*pipeline).Release()
+			*pipeline = nil
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/brodo/goBoids/stream"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck serves the liveness of the simulation over HTTP for orchestration probes.
+type HealthCheck struct {
+	// StallAfter is how long the render loop may go without a frame before it counts as stalled.
+	StallAfter time.Duration
+	// RequireNATS makes the check fail while no NATS server is connected.
+	RequireNATS bool
+
+	frames    atomic.Uint64
+	lastFrame atomic.Int64 // Unix nanoseconds
+	sink      atomic.Pointer[stream.MultiSink]
+}
+
+// healthStatus is the JSON body of the health endpoint.
+type healthStatus struct {
+	Frames           uint64  `json:"frames"`
+	SinceLastFrame   float64 `json:"sinceLastFrameSeconds"`
+	NATSConnected    bool    `json:"natsConnected"`
+	LastPublishError string  `json:"lastPublishError,omitempty"`
+	PublishErrors    uint64  `json:"publishErrors"`
+	DroppedMessages  uint64  `json:"droppedMessages"`
+}
+
+// FrameRendered records that the render loop completed a frame. A nil HealthCheck ignores it.
+func (h *HealthCheck) FrameRendered() {
+	if h == nil {
+		return
+	}
+	h.frames.Add(1)
+	h.lastFrame.Store(time.Now().UnixNano())
+}
+
+// SetSink sets the sink whose connection state and errors are reported. A nil HealthCheck ignores it.
+func (h *HealthCheck) SetSink(sink *stream.MultiSink) {
+	if h == nil {
+		return
+	}
+	h.sink.Store(sink)
+}
+
+// ServeHTTP responds with 200 and the health status, or 503 if the render loop stalled or a
+// required NATS connection is down.
+func (h *HealthCheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Frames: h.frames.Load()}
+	healthy := true
+
+	if last := h.lastFrame.Load(); last != 0 {
+		since := time.Since(time.Unix(0, last))
+		status.SinceLastFrame = since.Seconds()
+		healthy = since <= h.StallAfter
+	} else {
+		healthy = false
+	}
+	if sink := h.sink.Load(); sink != nil {
+		status.NATSConnected = sink.Connected()
+		if err := sink.LastError(); err != nil {
+			status.LastPublishError = err.Error()
+		}
+		status.PublishErrors, status.DroppedMessages = sink.Failures()
+	}
+	if h.RequireNATS && !status.NATSConnected {
+		healthy = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		fmt.Printf("failed to write health status: %v\n", err)
+	}
+}
+
+// ListenAndServe serves the health check on addr in the background.
+func (h *HealthCheck) ListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("health endpoint stopped: %v\n", err)
+		}
+	}()
+}
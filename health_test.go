@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/brodo/goBoids/stream"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeNATSSink is a Sink with a connection state, whose Publish fails with err.
+type fakeNATSSink struct {
+	connected bool
+	err       error
+}
+
+func (s *fakeNATSSink) Publish(subject string, msg []byte) error { return s.err }
+func (s *fakeNATSSink) Close() error                             { return nil }
+func (s *fakeNATSSink) Connected() bool                          { return s.connected }
+
+// checkHealth requests the health status from h and checks the response code.
+func checkHealth(t *testing.T, h *HealthCheck, wantCode int) healthStatus {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != wantCode {
+		t.Errorf("got status %d, want %d", rec.Code, wantCode)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q, want application/json", ct)
+	}
+	var status healthStatus
+	err := json.NewDecoder(rec.Body).Decode(&status)
+	if err != nil {
+		t.Fatalf("failed to decode health status: %v", err)
+	}
+	return status
+}
+
+func TestHealthCheckHealthy(t *testing.T) {
+	h := &HealthCheck{StallAfter: time.Minute}
+	h.FrameRendered()
+	h.FrameRendered()
+	status := checkHealth(t, h, http.StatusOK)
+	if status.Frames != 2 {
+		t.Errorf("got %d frames, want 2", status.Frames)
+	}
+}
+
+func TestHealthCheckBeforeFirstFrame(t *testing.T) {
+	checkHealth(t, &HealthCheck{StallAfter: time.Minute}, http.StatusServiceUnavailable)
+}
+
+func TestHealthCheckStalled(t *testing.T) {
+	h := &HealthCheck{StallAfter: time.Second}
+	h.FrameRendered()
+	h.lastFrame.Store(time.Now().Add(-2 * time.Second).UnixNano())
+	status := checkHealth(t, h, http.StatusServiceUnavailable)
+	if status.SinceLastFrame < 2 {
+		t.Errorf("got %v seconds since the last frame, want at least 2", status.SinceLastFrame)
+	}
+}
+
+func TestHealthCheckNATS(t *testing.T) {
+	tests := []struct {
+		name        string
+		requireNATS bool
+		connected   bool
+		wantCode    int
+	}{
+		{"connected", true, true, http.StatusOK},
+		{"disconnected", true, false, http.StatusServiceUnavailable},
+		{"disconnected but not required", false, false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HealthCheck{StallAfter: time.Minute, RequireNATS: tt.requireNATS}
+			h.FrameRendered()
+			sink := &stream.MultiSink{}
+			sink.Add("nats", &fakeNATSSink{connected: tt.connected})
+			h.SetSink(sink)
+			status := checkHealth(t, h, tt.wantCode)
+			if status.NATSConnected != tt.connected {
+				t.Errorf("got natsConnected %v, want %v", status.NATSConnected, tt.connected)
+			}
+		})
+	}
+}
+
+func TestHealthCheckReportsPublishErrors(t *testing.T) {
+	h := &HealthCheck{StallAfter: time.Minute, RequireNATS: true}
+	h.FrameRendered()
+	sink := &stream.MultiSink{}
+	sink.Add("nats", &fakeNATSSink{connected: true, err: errors.New("broken pipe")})
+	h.SetSink(sink)
+	err := sink.Publish("boids", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing waits until the queued message was published
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Publish errors are reported, but don't make the check fail
+	status := checkHealth(t, h, http.StatusOK)
+	if status.PublishErrors != 1 || status.LastPublishError != "nats: broken pipe" {
+		t.Errorf("got %d publish errors, the last %q, want 1 and %q", status.PublishErrors, status.LastPublishError, "nats: broken pipe")
+	}
+}
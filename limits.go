@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/brodo/goBoids/boid"
+	"github.com/cogentcore/webgpu/wgpu"
+)
+
+// Limits every WebGPU device supports without requesting more.
+const (
+	defaultMaxStorageBufferBindingSize      = 128 << 20
+	defaultMaxBufferSize                    = 256 << 20
+	defaultMaxComputeWorkgroupsPerDimension = 65535
+)
+
+// deviceLimits returns the limits the device needs for numParticles particles. Limits the defaults
+// already cover are left undefined.
+func deviceLimits(numParticles, workgroupSize uint32) wgpu.Limits {
+	limits := wgpu.DefaultLimits()
+	// The particle buffer is the largest buffer and bound as a whole, the staging buffers have the same size
+	size := uint64(boid.Stride * 4 * numParticles)
+	if size > defaultMaxStorageBufferBindingSize {
+		limits.MaxStorageBufferBindingSize = size
+	}
+	if size > defaultMaxBufferSize {
+		limits.MaxBufferSize = size
+	}
+	if groups := (numParticles + workgroupSize - 1) / workgroupSize; groups > defaultMaxComputeWorkgroupsPerDimension {
+		limits.MaxComputeWorkgroupsPerDimension = groups
+	}
+	return limits
+}
+
+// exceededLimit returns the name of the first limit numParticles particles need more of than the adapter
+// supports, and the most particles that stay within all of them. The name is empty if the adapter supports
+// all required limits.
+func exceededLimit(numParticles, workgroupSize uint32, adapter wgpu.Limits) (string, uint32) {
+	required := deviceLimits(numParticles, workgroupSize)
+	name := ""
+	fits := numParticles
+	exceeded := func(limit string, supported uint32) {
+		if name == "" {
+			name = limit
+		}
+		fits = min(fits, supported)
+	}
+	perParticle := uint64(boid.Stride * 4)
+	if required.MaxStorageBufferBindingSize != wgpu.LimitU64Undefined && required.MaxStorageBufferBindingSize > adapter.MaxStorageBufferBindingSize {
+		exceeded("maxStorageBufferBindingSize", uint32(adapter.MaxStorageBufferBindingSize/perParticle))
+	}
+	if required.MaxBufferSize != wgpu.LimitU64Undefined && required.MaxBufferSize > adapter.MaxBufferSize {
+		exceeded("maxBufferSize", uint32(adapter.MaxBufferSize/perParticle))
+	}
+	if required.MaxComputeWorkgroupsPerDimension != wgpu.LimitU32Undefined && required.MaxComputeWorkgroupsPerDimension > adapter.MaxComputeWorkgroupsPerDimension {
+		exceeded("maxComputeWorkgroupsPerDimension", adapter.MaxComputeWorkgroupsPerDimension*workgroupSize)
+	}
+	return name, fits
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/brodo/goBoids/stream"
 	"github.com/cogentcore/webgpu/wgpu"
 	"github.com/cogentcore/webgpu/wgpuglfw"
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"math"
 	"math/rand"
 	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -36,11 +45,16 @@ func init() {
 }
 
 const (
-	// number of boid particles to simulate
-	NumParticles = 4096
-	// number of single-particle calculations (invocations) in each gpu work group
-	ParticlesPerGroup = 256 // if you update this, also update it in the shader.
-	NumBuffers        = 15  // Number of staging buffers
+	// number of boid particles to simulate unless configured otherwise
+	DefaultNumParticles = 4096
+	// largest number of single-particle calculations (invocations) in each gpu work group, see chooseWorkgroupSize
+	MaxParticlesPerGroup = 256
+	// number of staging buffers particle data is read back through unless configured otherwise
+	DefaultReadbackBuffers = 15
+	// how long main waits for the GPU adapter and device before giving up
+	initTimeout = 10 * time.Second
+	// consecutive frames with an outdated or lost surface after which reconfiguring it is given up
+	maxSurfaceFailures = 10
 )
 
 //go:embed compute.wgsl
@@ -50,25 +64,84 @@ var compute string
 var draw string
 
 type State struct {
-	surface           *wgpu.Surface
-	adapter           *wgpu.Adapter
-	device            *wgpu.Device
-	queue             *wgpu.Queue
-	config            *wgpu.SurfaceConfiguration
-	renderPipeline    *wgpu.RenderPipeline
-	computePipeline   *wgpu.ComputePipeline
-	vertexBuffer      *wgpu.Buffer
-	particleBindGroup *wgpu.BindGroup
-	particleBuffer    *wgpu.Buffer
-	frameNum          uint64
-	workGroupCount    uint32
-	stagingBuffers    [NumBuffers]*wgpu.Buffer // For reading back data from GPU
-	bufferMappedState [NumBuffers]bool         // Track which buffers are currently mapped
-	nextReadbackIndex uint32                   // Next buffer to use for readback
-	particleData      chan []float32           // Store the current particle data
-}
-
-func InitState(window *glfw.Window) (s *State, err error) {
+	surface             *wgpu.Surface
+	adapter             *wgpu.Adapter
+	device              *wgpu.Device
+	queue               *wgpu.Queue
+	config              *wgpu.SurfaceConfiguration
+	renderPipeline      *wgpu.RenderPipeline
+	pickPipeline        *wgpu.RenderPipeline // Draws boid indices for PickBoid
+	pickBindGroup       *wgpu.BindGroup      // Draw parameters of pickPipeline, whose layout can't be shared
+	computePipeline     *wgpu.ComputePipeline
+	vertexBuffer        *wgpu.Buffer // Boid mesh, see boidShapes
+	vertexCount         uint32       // Vertices of the boid mesh
+	particleBindGroup   *wgpu.BindGroup
+	drawParamBuffer     *wgpu.Buffer
+	drawBindGroup       *wgpu.BindGroup
+	drawParams          DrawParams // CPU-side copy of the draw parameters in drawParamBuffer
+	particleBuffer      *wgpu.Buffer
+	simParamBuffer      *wgpu.Buffer
+	obstacleBuffer      *wgpu.Buffer
+	forceBuffer         *wgpu.Buffer // External force per boid, see SetForceProvider
+	cellCountBuffer     *wgpu.Buffer // Neighbor grid buffers, see grid.go
+	cellOffsetBuffer    *wgpu.Buffer
+	boidSlotBuffer      *wgpu.Buffer
+	sortedIndexBuffer   *wgpu.Buffer
+	gridClearPipeline   *wgpu.ComputePipeline
+	gridCountPipeline   *wgpu.ComputePipeline
+	gridScanPipeline    *wgpu.ComputePipeline
+	gridScatterPipeline *wgpu.ComputePipeline
+	forceProvider       ForceProvider // nil when no external forces are applied
+	params              SimParams     // CPU-side copy of the simulation parameters in simParamBuffer
+	timeScale           float32       // Multiplier for the simulated time that passes each frame
+	substeps            uint32        // Compute dispatches per frame, each advancing by a fraction of the frame time
+	paused              bool          // Skips the compute pass, the last frame stays on screen
+	hidden              bool          // The window is minimized or has no area, so nothing is drawn to the surface
+	stepOnce            bool          // Runs the compute pass for one frame while paused
+	frameNum            uint64
+	simTime             float32 // Simulated seconds so far, drives time dependent forces such as the wind
+	numParticles        uint32  // Capacity of the particle buffer
+	publishEvery        uint64  // Particle data is read back every publishEvery frames
+	readback            bool    // Particle data is read back at all, see Config.ReadsBack
+	workgroupSize       uint32  // Invocations per compute workgroup, injected into compute.wgsl
+	workGroupCount      uint32
+	stagingBuffers      []*wgpu.Buffer // For reading back data from GPU, see Config.ReadbackBuffers
+	bufferMappedState   []bool         // Track which buffers are currently mapped
+	nextReadbackIndex   uint32         // Next buffer to use for readback
+	skippedReadbacks    uint64         // Frames not read back because every staging buffer was mapped
+	failedReadbacks     uint64         // Readbacks whose staging buffer could not be mapped
+	readbacks           uint64         // Frames read back, see logReadbackUtilization
+	mappedTotal         uint64         // Staging buffers in use summed over the readbacks, including their own
+	mappedPeak          int            // Most staging buffers in use at once
+	particleData        chan []float32 // Store the current particle data
+	particleCount       uint32         // Number of particles that are drawn
+	background          wgpu.Color     // Clear color of the render pass
+	sampleCount         uint32         // MSAA samples per pixel
+	msaaTexture         *wgpu.Texture  // Multisampled render target, nil when sampleCount is 1
+	msaaView            *wgpu.TextureView
+	trailDecay          float32              // Fraction of the trails that fades each frame, 0 when trails are disabled
+	fadePipeline        *wgpu.RenderPipeline // Fades the trail texture, see trails.go
+	trailBoidPipeline   *wgpu.RenderPipeline // Draws the boids into the trail texture
+	compositePipeline   *wgpu.RenderPipeline // Draws the trail texture underneath the boids
+	trailDrawBindGroup  *wgpu.BindGroup
+	trailTexture        *wgpu.Texture // Boids of previous frames, faded by trailDecay each frame
+	trailView           *wgpu.TextureView
+	trailBindGroup      *wgpu.BindGroup
+	metrics             *Metrics // Receives dispatch and readback counts, nil when metrics are disabled
+	computeSource       string   // compute.wgsl template the compute pipelines are created from, see ReloadShaders
+	drawSource          string   // draw.wgsl the render and pick pipelines are created from
+}
+
+// InitState is InitStateContext without a deadline.
+func InitState(window *glfw.Window, cfg Config) (*State, error) {
+	return InitStateContext(context.Background(), window, cfg)
+}
+
+// InitStateContext sets up the GPU and all simulation resources. Acquiring the adapter and the device
+// fails with context.DeadlineExceeded once ctx expires instead of hanging on a broken driver.
+// Without a window (headless mode) there is no surface and Render only simulates, unless frames are
+// rendered off-screen with cfg.RenderFrames. A zero Config is replaced with DefaultConfig.
+func InitStateContext(ctx context.Context, window *glfw.Window, cfg Config) (s *State, err error) {
 	defer func() {
 		if err != nil {
 			fmt.Printf("Error initializing state: %v\n", err)
@@ -76,118 +149,296 @@ func InitState(window *glfw.Window) (s *State, err error) {
 			s = nil
 		}
 	}()
-	s = &State{}
-	s.particleData = make(chan []float32, NumBuffers)
+	if reflect.ValueOf(cfg).IsZero() {
+		cfg = DefaultConfig()
+	}
+	s = &State{timeScale: 1, substeps: max(cfg.Substeps, 1), publishEvery: max(cfg.NATS.PublishEvery, 1), readback: cfg.ReadsBack()}
+	s.particleData = make(chan []float32, max(cfg.ReadbackBuffers, 1))
+	s.computeSource, s.drawSource = compute, draw
+	if cfg.WatchShaders {
+		s.computeSource, s.drawSource, err = readShaders()
+		if err != nil {
+			return s, err
+		}
+	}
 
 	instance := wgpu.CreateInstance(nil)
 	defer instance.Release()
 
-	s.surface = instance.CreateSurface(wgpuglfw.GetSurfaceDescriptor(window))
+	if window != nil {
+		s.surface = instance.CreateSurface(wgpuglfw.GetSurfaceDescriptor(window))
+	}
 
-	s.adapter, err = instance.RequestAdapter(&wgpu.RequestAdapterOptions{
-		ForceFallbackAdapter: forceFallbackAdapter,
-		CompatibleSurface:    s.surface,
-	})
+	s.adapter, err = requestAdapter(ctx, instance, s.surface, cfg)
 	if err != nil {
 		return s, err
 	}
 	defer s.adapter.Release()
+	printAdapterInfo(s.adapter)
+
+	// Off-screen frames are drawn like those of a window, only at a fixed size
+	drawing := window != nil || cfg.RenderFrames > 0
 
-	s.device, err = s.adapter.RequestDevice(nil)
+	// The sample count is checked against the format of the target once the device is there
+	s.sampleCount = 1
+	if drawing {
+		s.sampleCount = max(cfg.SampleCount, 1)
+	}
+
+	err = s.requestDevice(ctx, cfg)
+	if err != nil {
+		return s, err
+	}
+	err = s.configureTarget(window, cfg)
+	if err != nil {
+		return s, err
+	}
+
+	s.params = cfg.Params
+	s.params.ObstacleCount = uint32(len(cfg.Obstacles))
+	s.params.ParticleCount = s.numParticles
+	aspect := aspectScale(s.config.Width, s.config.Height)
+	s.params.AspectX, s.params.AspectY = aspect[0], aspect[1]
+
+	err = s.createBuffers(cfg)
+	if err != nil {
+		return s, err
+	}
+	// Trails need a surface or off-screen frames to draw to
+	if drawing {
+		s.trailDecay = cfg.TrailDecay
+	}
+	err = s.createPipelines(cfg.Simulated())
+	if err != nil {
+		return s, err
+	}
+	err = s.createBindGroups()
 	if err != nil {
 		return s, err
 	}
+
+	s.particleCount = s.numParticles
+	if !cfg.Simulated() {
+		// Nothing is drawn until the first frame has been received
+		s.particleCount = 0
+	}
+	s.workGroupCount = uint32(math.Ceil(float64(s.numParticles) / float64(s.workgroupSize)))
+	s.frameNum = uint64(0)
+
+	return s, nil
+}
+
+// requestDevice requests a device with the limits cfg.Particles need. If the adapter can't provide them,
+// it retries with as many particles as fit.
+func (s *State) requestDevice(ctx context.Context, cfg Config) error {
+	var err error
+	deviceDescriptor := &wgpu.DeviceDescriptor{}
+	// Other sample counts than 1 and 4 are only available with adapter specific format features
+	if s.sampleCount != 1 && s.sampleCount != 4 && s.adapter.HasFeature(wgpu.NativeFeatureTextureAdapterSpecificFormatFeatures) {
+		deviceDescriptor.RequiredFeatures = []wgpu.FeatureName{wgpu.NativeFeatureTextureAdapterSpecificFormatFeatures}
+	}
+
+	adapterLimits := s.adapter.GetLimits().Limits
+	s.workgroupSize = chooseWorkgroupSize(adapterLimits)
+	s.numParticles = max(cfg.Particles, 1)
+	for {
+		deviceDescriptor.RequiredLimits = &wgpu.RequiredLimits{Limits: deviceLimits(s.numParticles, s.workgroupSize)}
+		s.device, err = withContext(ctx, "device request", func() (*wgpu.Device, error) {
+			return s.adapter.RequestDevice(deviceDescriptor)
+		})
+		if err == nil {
+			break
+		}
+		// Retry with fewer particles if the particle count is what the adapter can't handle
+		limit, fits := exceededLimit(s.numParticles, s.workgroupSize, adapterLimits)
+		if limit == "" || fits == 0 || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		fmt.Printf("warning: device request failed, %d particles exceed the adapter's %s limit; retrying with %d particles: %v\n",
+			s.numParticles, limit, fits, err)
+		s.numParticles = fits
+	}
 	s.queue = s.device.GetQueue()
+	return nil
+}
 
-	caps := s.surface.GetCapabilities(s.adapter)
+// configureTarget configures what is drawn to: the window surface, an off-screen frame of the size in cfg,
+// or nothing at all in headless mode.
+func (s *State) configureTarget(window *glfw.Window, cfg Config) error {
+	if window != nil {
+		caps := s.surface.GetCapabilities(s.adapter)
+
+		width, height := window.GetSize()
+		s.config = &wgpu.SurfaceConfiguration{
+			Usage:       wgpu.TextureUsageRenderAttachment,
+			Format:      caps.Formats[0],
+			Width:       uint32(width),
+			Height:      uint32(height),
+			PresentMode: supportedPresentMode(caps.PresentModes, cfg.PresentMode),
+			AlphaMode:   caps.AlphaModes[0],
+		}
+
+		s.surface.Configure(s.adapter, s.device, s.config)
 
-	width, height := window.GetSize()
-	s.config = &wgpu.SurfaceConfiguration{
-		Usage:       wgpu.TextureUsageRenderAttachment,
-		Format:      caps.Formats[0],
-		Width:       uint32(width),
-		Height:      uint32(height),
-		PresentMode: wgpu.PresentModeFifo,
-		AlphaMode:   caps.AlphaModes[0],
+		s.sampleCount = s.supportedSampleCount(s.config.Format, s.sampleCount)
+		err := s.createMSAATexture()
+		if err != nil {
+			return err
+		}
+	} else if cfg.RenderFrames > 0 {
+		s.config = &wgpu.SurfaceConfiguration{
+			Format: wgpu.TextureFormatRGBA8Unorm,
+			Width:  cfg.FrameWidth,
+			Height: cfg.FrameHeight,
+		}
+		s.sampleCount = s.supportedSampleCount(s.config.Format, s.sampleCount)
+		err := s.createMSAATexture()
+		if err != nil {
+			return err
+		}
+	} else {
+		// The render pipelines are still created, so they need a format, but they never draw anything
+		s.config = &wgpu.SurfaceConfiguration{Format: wgpu.TextureFormatBGRA8Unorm}
 	}
+	return nil
+}
 
-	s.surface.Configure(s.adapter, s.device, s.config)
+// createBuffers creates the parameter, vertex and particle buffers, and for simulations the buffers only
+// the compute shader uses. s.params must be set.
+func (s *State) createBuffers(cfg Config) error {
+	var err error
+	s.simParamBuffer, err = s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
+		Label:    "Simulation Param Buffer",
+		Contents: s.params.Bytes(),
+		Usage:    wgpu.BufferUsageUniform | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.drawParams = DrawParams{BoidColor: cfg.BoidColor, ColorMode: cfg.ColorMode, MaxSpeed: s.params.MaxSpeed, Aspect: [2]float32{s.params.AspectX, s.params.AspectY}, ViewZoom: 1, BoidSize: cfg.BoidSize, ColorPeriod: float32(cfg.ColorPeriod.Seconds())}
+	s.background = cfg.Background.WGPU()
+	s.drawParamBuffer, err = s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
+		Label:    "Draw Param Buffer",
+		Contents: s.drawParams.Bytes(),
+		Usage:    wgpu.BufferUsageUniform | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return err
+	}
+
+	// this defines the small triangle for each boid
+	// Configurations from before there were shapes have none
+	shape, ok := boidShapes[cfg.BoidShape]
+	if !ok {
+		shape = boidShapes[ShapeTriangle]
+	}
+	s.vertexCount = uint32(len(shape) / 2)
+	s.vertexBuffer, err = s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
+		Label:    "Vertex Buffer",
+		Contents: wgpu.ToBytes(shape),
+		Usage:    wgpu.BufferUsageVertex | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return err
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	initialParticleData := generateInitialParticles(rng, int(s.numParticles), cfg.Layout, cfg.Speeds, cfg.SpeedVariance, cfg.ThreeD, s.params.FlockCount, s.params.PredatorCount)
+
+	particleBuffer, err := s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
+		Label:    "Particle Buffer",
+		Contents: wgpu.ToBytes(initialParticleData[:]),
+		Usage: wgpu.BufferUsageVertex |
+			wgpu.BufferUsageStorage |
+			wgpu.BufferUsageCopySrc |
+			wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.particleBuffer = particleBuffer
+
+	if !cfg.Simulated() {
+		return nil
+	}
 
+	// Initialize staging buffers
+	s.stagingBuffers = make([]*wgpu.Buffer, max(cfg.ReadbackBuffers, 1))
+	s.bufferMappedState = make([]bool, len(s.stagingBuffers)) // All false by default
+
+	for i := range s.stagingBuffers {
+		s.stagingBuffers[i], err = s.createStagingBuffer(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.nextReadbackIndex = 0
+
+	// Storage buffers can't be empty, so there is always at least one (unused) obstacle
+	obstacles := cfg.Obstacles
+	if len(obstacles) == 0 {
+		obstacles = make([]Obstacle, 1)
+	}
+	s.obstacleBuffer, err = s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
+		Label:    "Obstacle Buffer",
+		Contents: wgpu.ToBytes(obstacles),
+		Usage:    wgpu.BufferUsageStorage,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.forceBuffer, err = s.device.CreateBuffer(&wgpu.BufferDescriptor{
+		Label: "External Force Buffer",
+		Size:  s.forceBufferSize(),
+		Usage: wgpu.BufferUsageStorage | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.createGridBuffers()
+}
+
+// createPipelines creates the render and pick pipelines, the trail pipelines if they are drawn and if simulate
+// is set the compute pipelines. The trail pipelines need the buffers of createBuffers.
+func (s *State) createPipelines(simulate bool) error {
+	computeCode, err := computeShaderCode(s.computeSource, s.workgroupSize)
+	if err != nil {
+		return err
+	}
 	computeShader, err := s.device.CreateShaderModule(&wgpu.ShaderModuleDescriptor{
 		Label: "compute.wgsl",
 		WGSLDescriptor: &wgpu.ShaderModuleWGSLDescriptor{
-			Code: compute,
+			Code: computeCode,
 		},
 	})
 	if err != nil {
-		return s, err
+		return shaderError("compute.wgsl", computeCode, err)
 	}
 	defer computeShader.Release()
 
 	drawShader, err := s.device.CreateShaderModule(&wgpu.ShaderModuleDescriptor{
 		Label: "draw.wgsl",
 		WGSLDescriptor: &wgpu.ShaderModuleWGSLDescriptor{
-			Code: draw,
+			Code: s.drawSource,
 		},
 	})
 	if err != nil {
-		return s, err
+		return shaderError("draw.wgsl", s.drawSource, err)
 	}
 	defer drawShader.Release()
 
-	simParamData := []float32{
-		1.0 / 60.0, // deltaTime - 60 fps
-		0.1,        // maxForce
-		0.5,        // maxSpeed
-		0.8,        // alignmentWeight
-		0.7,        // cohesionWeight
-		0.9,        // separationWeight
-		0.1,        // perceptionRadius
-	}
-
-	simParamBuffer, err := s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
-		Label:    "Simulation Param Buffer",
-		Contents: wgpu.ToBytes(simParamData[:]),
-		Usage:    wgpu.BufferUsageUniform | wgpu.BufferUsageCopyDst,
-	})
-	if err != nil {
-		return s, err
-	}
-	defer simParamBuffer.Release()
+	vertexBuffers := particleVertexLayout()
 
 	s.renderPipeline, err = s.device.CreateRenderPipeline(&wgpu.RenderPipelineDescriptor{
 		Vertex: wgpu.VertexState{
 			Module:     drawShader,
 			EntryPoint: "main_vs",
-			Buffers: []wgpu.VertexBufferLayout{
-				{
-					ArrayStride: 4 * 4, // 4 f32s
-					StepMode:    wgpu.VertexStepModeInstance,
-					Attributes: []wgpu.VertexAttribute{
-						{
-							Format:         wgpu.VertexFormatFloat32x2,
-							Offset:         0, // position
-							ShaderLocation: 0,
-						},
-						{
-							Format:         wgpu.VertexFormatFloat32x2,
-							Offset:         0 + wgpu.VertexFormatFloat32x2.Size(), // velocity
-							ShaderLocation: 1,
-						},
-					},
-				},
-				{
-					ArrayStride: 2 * 4, // 2 f32s -> one vertex. This is filled by `vertexBufferData`
-					StepMode:    wgpu.VertexStepModeVertex,
-					Attributes: []wgpu.VertexAttribute{
-						{
-							Format:         wgpu.VertexFormatFloat32x2,
-							Offset:         0,
-							ShaderLocation: 2,
-						},
-					},
-				},
-			},
+			Buffers:    vertexBuffers,
 		},
 		Fragment: &wgpu.FragmentState{
 			Module:     drawShader,
@@ -205,132 +456,586 @@ func InitState(window *glfw.Window) (s *State, err error) {
 			FrontFace: wgpu.FrontFaceCCW,
 		},
 		Multisample: wgpu.MultisampleState{
-			Count:                  1,
+			Count:                  s.sampleCount,
 			Mask:                   0xFFFFFFFF,
 			AlphaToCoverageEnabled: false,
 		},
 	})
 	if err != nil {
-		return s, err
+		return err
 	}
 
-	s.computePipeline, err = s.device.CreateComputePipeline(&wgpu.ComputePipelineDescriptor{
-		Label: "Compute pipeline",
-		Compute: wgpu.ProgrammableStageDescriptor{
-			Module:     computeShader,
-			EntryPoint: "main",
+	if s.trailDecay > 0 {
+		err := s.createTrailPipelines(drawShader, vertexBuffers)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.pickPipeline, err = s.device.CreateRenderPipeline(&wgpu.RenderPipelineDescriptor{
+		Label: "Pick pipeline",
+		Vertex: wgpu.VertexState{
+			Module:     drawShader,
+			EntryPoint: "pick_vs",
+			Buffers:    vertexBuffers,
+		},
+		Fragment: &wgpu.FragmentState{
+			Module:     drawShader,
+			EntryPoint: "pick_fs",
+			Targets: []wgpu.ColorTargetState{
+				{
+					Format:    pickFormat,
+					WriteMask: wgpu.ColorWriteMaskAll,
+				},
+			},
+		},
+		Primitive: wgpu.PrimitiveState{
+			Topology:  wgpu.PrimitiveTopologyTriangleList,
+			FrontFace: wgpu.FrontFaceCCW,
+		},
+		Multisample: wgpu.MultisampleState{
+			Count: 1,
+			Mask:  0xFFFFFFFF,
 		},
 	})
 	if err != nil {
-		return s, err
+		return err
 	}
-	// this defines the small triangle for each boid
-	vertexBufferData := [...]float32{-0.0025, -0.005, 0.0025, -0.005, 0.001, 0.0025}
-	s.vertexBuffer, err = s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
-		Label:    "Vertex Buffer",
-		Contents: wgpu.ToBytes(vertexBufferData[:]),
-		Usage:    wgpu.BufferUsageVertex | wgpu.BufferUsageCopyDst,
+	// The viewer and replays render particles they receive from elsewhere and don't simulate anything themselves
+	if simulate {
+		computeBindGroupLayout, pipelineLayout, err := s.createComputeLayout()
+		if err != nil {
+			return err
+		}
+		defer computeBindGroupLayout.Release()
+		defer pipelineLayout.Release()
+
+		s.computePipeline, err = s.device.CreateComputePipeline(&wgpu.ComputePipelineDescriptor{
+			Label:  "Compute pipeline",
+			Layout: pipelineLayout,
+			Compute: wgpu.ProgrammableStageDescriptor{
+				Module:     computeShader,
+				EntryPoint: "main",
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = s.createGridPipelines(computeShader, pipelineLayout)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createBindGroups creates the bind groups of the draw, pick and compute pipelines.
+func (s *State) createBindGroups() error {
+	var err error
+	drawBindGroupLayout := s.renderPipeline.GetBindGroupLayout(0)
+	defer drawBindGroupLayout.Release()
+
+	s.drawBindGroup, err = s.device.CreateBindGroup(&wgpu.BindGroupDescriptor{
+		Layout: drawBindGroupLayout,
+		Entries: []wgpu.BindGroupEntry{
+			{
+				Binding: 0,
+				Buffer:  s.drawParamBuffer,
+				Size:    wgpu.WholeSize,
+			},
+		},
 	})
 	if err != nil {
-		return s, err
+		return err
+	}
+
+	pickBindGroupLayout := s.pickPipeline.GetBindGroupLayout(0)
+	defer pickBindGroupLayout.Release()
+	s.pickBindGroup, err = s.device.CreateBindGroup(&wgpu.BindGroupDescriptor{
+		Layout: pickBindGroupLayout,
+		Entries: []wgpu.BindGroupEntry{
+			{
+				Binding: 0,
+				Buffer:  s.drawParamBuffer,
+				Size:    wgpu.WholeSize,
+			},
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	var initialParticleData [4 * NumParticles]float32
-	rng := rand.NewSource(42)
+	if s.computePipeline == nil {
+		return nil
+	}
 
-	for i := 0; i < len(initialParticleData); i += 4 {
-		initialParticleData[i+0] = float32(rng.Int63())/math.MaxInt64*2 - 1 // position x
-		initialParticleData[i+1] = float32(rng.Int63())/math.MaxInt64*2 - 1 // position y
+	// The compute pipeline was created with an explicit layout, which it returns here
+	computeBindGroupLayout := s.computePipeline.GetBindGroupLayout(0)
+	defer computeBindGroupLayout.Release()
 
-		// Random velocity direction with a consistent speed
-		angle := float32(rng.Int63()) / math.MaxInt64 * 2 * math.Pi
-		speed := float32(0.1)
-		initialParticleData[i+2] = speed * float32(math.Cos(float64(angle))) // velocity x
-		initialParticleData[i+3] = speed * float32(math.Sin(float64(angle))) // velocity y
+	particleBindGroup, err := s.device.CreateBindGroup(&wgpu.BindGroupDescriptor{
+		Layout: computeBindGroupLayout,
+		Entries: []wgpu.BindGroupEntry{
+			{
+				Binding: 0,
+				Buffer:  s.particleBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 1,
+				Buffer:  s.simParamBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 2,
+				Buffer:  s.obstacleBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 3,
+				Buffer:  s.forceBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 4,
+				Buffer:  s.cellCountBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 5,
+				Buffer:  s.cellOffsetBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 6,
+				Buffer:  s.boidSlotBuffer,
+				Size:    wgpu.WholeSize,
+			},
+			{
+				Binding: 7,
+				Buffer:  s.sortedIndexBuffer,
+				Size:    wgpu.WholeSize,
+			},
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	particleBuffer, err := s.device.CreateBufferInit(&wgpu.BufferInitDescriptor{
-		Label:    "Particle Buffer",
-		Contents: wgpu.ToBytes(initialParticleData[:]),
-		Usage: wgpu.BufferUsageVertex |
-			wgpu.BufferUsageStorage |
-			wgpu.BufferUsageCopySrc,
+	s.particleBindGroup = particleBindGroup
+
+	return nil
+}
+
+// particleVertexLayout is the vertex buffer layout of the pipelines that draw boids: the particle buffer,
+// one instance per boid, and the boid triangle.
+func particleVertexLayout() []wgpu.VertexBufferLayout {
+	return []wgpu.VertexBufferLayout{
+		{
+			ArrayStride: boid.Stride * 4, // one particle, see boid.Stride
+			StepMode:    wgpu.VertexStepModeInstance,
+			Attributes: []wgpu.VertexAttribute{
+				{
+					Format:         wgpu.VertexFormatFloat32x3,
+					Offset:         0, // position
+					ShaderLocation: 0,
+				},
+				{
+					Format:         wgpu.VertexFormatFloat32x3,
+					Offset:         4 * 4, // velocity, after the position and the neighbor count
+					ShaderLocation: 1,
+				},
+				{
+					Format:         wgpu.VertexFormatFloat32,
+					Offset:         8 * 4, // flock, after the velocity and the force magnitude
+					ShaderLocation: 3,
+				},
+				{
+					Format:         wgpu.VertexFormatFloat32,
+					Offset:         9 * 4, // predator flag
+					ShaderLocation: 4,
+				},
+				{
+					Format:         wgpu.VertexFormatFloat32,
+					Offset:         3 * 4, // neighbor count, after the position
+					ShaderLocation: 5,
+				},
+			},
+		},
+		{
+			ArrayStride: 2 * 4, // 2 f32s -> one vertex of the boid mesh, see boidShapes
+			StepMode:    wgpu.VertexStepModeVertex,
+			Attributes: []wgpu.VertexAttribute{
+				{
+					Format:         wgpu.VertexFormatFloat32x2,
+					Offset:         0,
+					ShaderLocation: 2,
+				},
+			},
+		},
+	}
+}
+
+// ReconfigureSurface configures the surface again with its current configuration, which makes an outdated
+// or lost surface usable again. It reports whether the surface was configured, which headless states and
+// hidden windows, whose surface can't be configured, are not.
+func (s *State) ReconfigureSurface() bool {
+	if s.surface == nil || s.hidden || s.config.Width == 0 || s.config.Height == 0 {
+		return false
+	}
+	s.surface.Configure(s.adapter, s.device, s.config)
+	return true
+}
+
+func (s *State) Resize(width, height int) {
+	if width > 0 && height > 0 {
+		s.config.Width = uint32(width)
+		s.config.Height = uint32(height)
+
+		s.surface.Configure(s.adapter, s.device, s.config)
+
+		err := s.createMSAATexture()
+		if err != nil {
+			fmt.Printf("failed to recreate MSAA texture: %v\n", err)
+		}
+		if s.trailDecay > 0 {
+			err = s.createTrailTexture()
+			if err != nil {
+				fmt.Printf("failed to recreate trail texture: %v\n", err)
+			}
+		}
+
+		// The simulation parameters are uploaded with the next simulated frame
+		aspect := aspectScale(s.config.Width, s.config.Height)
+		s.params.AspectX, s.params.AspectY = aspect[0], aspect[1]
+		s.drawParams.Aspect = aspect
+		err = s.queue.WriteBuffer(s.drawParamBuffer, 0, s.drawParams.Bytes())
+		if err != nil {
+			fmt.Printf("failed to update draw parameters: %v\n", err)
+		}
+	}
+}
+
+// particleBufferSize is the size of the particle buffer in bytes.
+func (s *State) particleBufferSize() uint64 {
+	return uint64(boid.Stride * 4 * s.numParticles)
+}
+
+// withContext runs request in the background and waits for it until ctx is done. A request that
+// finishes after ctx is done is abandoned; it is only used during startup, which fails in that case.
+func withContext[T any](ctx context.Context, what string, request func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := request()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, fmt.Errorf("%s did not finish: %w", what, ctx.Err())
+	}
+}
+
+// supportedSampleCount returns the requested MSAA sample count if the device can render to format with it.
+// Otherwise, it warns and falls back to 4 samples, which WebGPU guarantees for the formats that can be
+// multisampled at all, or to no multisampling for the others.
+func (s *State) supportedSampleCount(format wgpu.TextureFormat, requested uint32) uint32 {
+	if requested <= 1 || s.canMultisample(format, requested) {
+		return max(requested, 1)
+	}
+	fallback := uint32(1)
+	if requested != 4 && s.canMultisample(format, 4) {
+		fallback = 4
+	}
+	fmt.Printf("warning: %s does not support %dx MSAA, falling back to %dx\n", format, requested, fallback)
+	return fallback
+}
+
+// canMultisample reports whether the device can render to format with count samples per pixel. The
+// supported counts of a format can't be queried, so it tries to create a render target with them.
+func (s *State) canMultisample(format wgpu.TextureFormat, count uint32) bool {
+	texture, err := s.device.CreateTexture(&wgpu.TextureDescriptor{
+		Label:         "MSAA Probe Texture",
+		Size:          wgpu.Extent3D{Width: 1, Height: 1, DepthOrArrayLayers: 1},
+		MipLevelCount: 1,
+		SampleCount:   count,
+		Dimension:     wgpu.TextureDimension2D,
+		Format:        format,
+		Usage:         wgpu.TextureUsageRenderAttachment,
 	})
 	if err != nil {
-		return s, err
+		return false
 	}
+	texture.Release()
+	return true
+}
 
-	s.particleBuffer = particleBuffer
+// supportedPresentMode returns the present mode named requested if the surface supports it. Otherwise,
+// it warns and falls back to fifo, which all surfaces support.
+func supportedPresentMode(supported []wgpu.PresentMode, requested string) wgpu.PresentMode {
+	for _, mode := range supported {
+		if mode.String() == requested {
+			return mode
+		}
+	}
+	fmt.Printf("warning: surface does not support present mode %s, falling back to fifo\n", requested)
+	return wgpu.PresentModeFifo
+}
 
-	// Initialize staging buffers
-	s.stagingBuffers = [NumBuffers]*wgpu.Buffer{}
-	s.bufferMappedState = [NumBuffers]bool{} // All false by default
-
-	for i := 0; i < NumBuffers; i++ {
-		s.stagingBuffers[i], err = s.device.CreateBuffer(&wgpu.BufferDescriptor{
-			Label:            fmt.Sprintf("Staging Buffer %d", i),
-			Size:             uint64(4 * NumParticles * 4),
-			Usage:            wgpu.BufferUsageMapRead | wgpu.BufferUsageCopyDst,
-			MappedAtCreation: false,
-		})
+// chooseWorkgroupSize returns the largest power of two up to MaxParticlesPerGroup that fits the compute
+// workgroup limits of the adapter.
+func chooseWorkgroupSize(limits wgpu.Limits) uint32 {
+	size := uint32(MaxParticlesPerGroup)
+	for size > 1 && (size > limits.MaxComputeWorkgroupSizeX || size > limits.MaxComputeInvocationsPerWorkgroup) {
+		size /= 2
+	}
+	return size
+}
+
+// computeShaderCode fills the workgroup size into the compute.wgsl template source.
+func computeShaderCode(source string, workgroupSize uint32) (string, error) {
+	tmpl, err := template.New("compute.wgsl").Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse compute shader template: %w", err)
+	}
+	var code strings.Builder
+	err = tmpl.Execute(&code, struct{ WorkgroupSize uint32 }{workgroupSize})
+	if err != nil {
+		return "", fmt.Errorf("failed to fill in compute shader template: %w", err)
+	}
+	return code.String(), nil
+}
+
+// createMSAATexture (re)creates the multisampled render target to match the current surface size.
+func (s *State) createMSAATexture() error {
+	s.releaseMSAATexture()
+	if s.sampleCount <= 1 {
+		return nil
+	}
+
+	texture, err := s.device.CreateTexture(&wgpu.TextureDescriptor{
+		Label: "MSAA Texture",
+		Size: wgpu.Extent3D{
+			Width:              s.config.Width,
+			Height:             s.config.Height,
+			DepthOrArrayLayers: 1,
+		},
+		MipLevelCount: 1,
+		SampleCount:   s.sampleCount,
+		Dimension:     wgpu.TextureDimension2D,
+		Format:        s.config.Format,
+		Usage:         wgpu.TextureUsageRenderAttachment,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create MSAA texture: %w", err)
+	}
+	view, err := texture.CreateView(nil)
+	if err != nil {
+		texture.Release()
+		return fmt.Errorf("failed to create MSAA texture view: %w", err)
+	}
+
+	s.msaaTexture = texture
+	s.msaaView = view
+	return nil
+}
+
+func (s *State) releaseMSAATexture() {
+	if s.msaaView != nil {
+		s.msaaView.Release()
+		s.msaaView = nil
+	}
+	if s.msaaTexture != nil {
+		s.msaaTexture.Release()
+		s.msaaTexture = nil
+	}
+}
+
+func (s *State) Render() error {
+	// Headless states have no surface and hidden windows can't be drawn to, they only simulate and read back
+	headless := s.surface == nil || s.hidden
+	var view *wgpu.TextureView
+	if !headless {
+		nextTexture, err := s.surface.GetCurrentTexture()
+		if err != nil {
+			return fmt.Errorf("failed to get current texture: %w", err)
+		}
+		view, err = nextTexture.CreateView(nil)
+		if err != nil {
+			return fmt.Errorf("failed to create view for texture: %w", err)
+
+		}
+		defer view.Release()
+	}
+
+	commandEncoder, err := s.device.CreateCommandEncoder(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create command encoder: %w", err)
+	}
+	defer commandEncoder.Release()
+
+	// Without a compute pipeline (viewer mode) the particle buffer is filled from outside
+	simulate := s.computePipeline != nil && (!s.paused || s.stepOnce)
+	s.stepOnce = false
+	readback := false
+	var readbackBufferIndex uint32 = s.nextReadbackIndex
+	// Only the active particles are read back
+	readbackSize := uint64(boid.Stride * 4 * s.particleCount)
+
+	if simulate {
+		params := s.params
+		// The frame number seeds the neighbor sampling in the compute shader
+		params.Frame = uint32(s.frameNum)
+		// The shader scales the steering and the smoothing to the time step as well, so the sub-steps together
+		// simulate the same frame as one step, only integrated more finely, and a time scale is slow motion
+		params.DeltaTime *= s.timeScale / float32(s.substeps)
+		params.Time = s.simTime
+		s.simTime += s.params.DeltaTime * s.timeScale
+		err = s.queue.WriteBuffer(s.simParamBuffer, 0, params.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to update simulation parameters: %w", err)
+		}
+		err = s.uploadForces()
+		if err != nil {
+			return err
+		}
+
+		computePass := commandEncoder.BeginComputePass(nil)
+		computePass.SetBindGroup(0, s.particleBindGroup, nil)
+		// Each dispatch sees the results of the previous one, so sub-steps integrate one after another
+		for range s.substeps {
+			if s.params.NeighborGrid != 0 && s.params.SampleSize == 0 {
+				s.sortIntoGrid(computePass)
+			}
+			computePass.SetPipeline(s.computePipeline)
+			computePass.DispatchWorkgroups(s.workGroupCount, 1, 1)
+			s.metrics.Dispatched(1)
+		}
+		err = computePass.End()
+		if err != nil {
+			return fmt.Errorf("failed to complete compute pass for texture: %w", err)
+		}
+
+		computePass.Release()
+
+		// Frames that are not published are not read back either
+		publish := s.readback && s.frameNum%s.publishEvery == 0
+
+		// Find a currently unmapped buffer for this frame's readback
+		found := false
+		numBuffers := uint32(len(s.stagingBuffers))
+		for i := uint32(0); publish && i < numBuffers; i++ {
+			candidateIndex := (s.nextReadbackIndex + i) % numBuffers
+			if !s.bufferMappedState[candidateIndex] {
+				readbackBufferIndex = candidateIndex
+				found = true
+				break
+			}
+		}
+
+		// Without an available buffer the frame is not read back, and not published
+		if publish && !found {
+			s.skippedReadbacks++
+			s.metrics.ReadbackSkipped()
+			// Only log occasionally, a slow consumer would otherwise log every frame
+			if s.skippedReadbacks == 1 || s.skippedReadbacks%100 == 0 {
+				fmt.Printf("all %d staging buffers are in use, skipped reading back %d frames so far; raise -readback-buffers if this persists\n", numBuffers, s.skippedReadbacks)
+			}
+		}
+		if found {
+			err = commandEncoder.CopyBufferToBuffer(
+				s.particleBuffer, // Source buffer (your particle buffer)
+				0,
+				s.stagingBuffers[readbackBufferIndex], // Destination buffer (one that's not mapped)
+				0,
+				readbackSize,
+			)
+
+			if err != nil {
+				return fmt.Errorf("failed to copy buffer to buffer: %w", err)
+			}
+
+			// Update next readback index for next frame
+			s.nextReadbackIndex = (readbackBufferIndex + 1) % numBuffers
+			readback = true
+		}
+	} else if s.computePipeline == nil && !s.paused {
+		// Viewers don't simulate, but keep the time going for the rainbow colors
+		s.simTime += s.params.DeltaTime * s.timeScale
+	}
+
+	if s.drawParams.ColorMode == ColorRainbow {
+		s.drawParams.Time = s.simTime
+		err = s.queue.WriteBuffer(s.drawParamBuffer, 0, s.drawParams.Bytes())
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to update draw parameters: %w", err)
 		}
 	}
 
-	s.nextReadbackIndex = 0
+	// Trails are only enabled when there is something to draw them on, which may be off-screen frames
+	if s.trailDecay > 0 {
+		err = s.drawTrails(commandEncoder)
+		if err != nil {
+			return err
+		}
+	}
+	if !headless {
+		err = s.draw(commandEncoder, view)
+		if err != nil {
+			return err
+		}
+	}
 
-	computeBindGroupLayout := s.computePipeline.GetBindGroupLayout(0)
-	defer computeBindGroupLayout.Release()
+	s.frameNum += 1
 
-	particleBindGroup, err := s.device.CreateBindGroup(&wgpu.BindGroupDescriptor{
-		Layout: computeBindGroupLayout,
-		Entries: []wgpu.BindGroupEntry{
-			{
-				Binding: 0,
-				Buffer:  s.particleBuffer,
-				Size:    wgpu.WholeSize,
-			},
-			{
-				Binding: 1,
-				Buffer:  simParamBuffer,
-				Size:    wgpu.WholeSize,
-			},
-		},
-	})
+	cmdBuffer, err := commandEncoder.Finish(nil)
 	if err != nil {
-		return s, err
+		return fmt.Errorf("failed to finish command buffer: %w", err)
 	}
+	defer cmdBuffer.Release()
 
-	s.particleBindGroup = particleBindGroup
-
-	s.workGroupCount = uint32(math.Ceil(float64(NumParticles) / float64(ParticlesPerGroup)))
-	s.frameNum = uint64(0)
+	// Submit command buffer and present
+	s.queue.Submit(cmdBuffer)
+	if !headless {
+		s.surface.Present()
+	}
 
-	return s, nil
-}
+	if readback {
+		// Mark the buffer as mapped before starting the async operation
+		s.bufferMappedState[readbackBufferIndex] = true
+		s.countMappedBuffers()
 
-func (s *State) Resize(width, height int) {
-	if width > 0 && height > 0 {
-		s.config.Width = uint32(width)
-		s.config.Height = uint32(height)
+		index := readbackBufferIndex
+		err = s.stagingBuffers[index].MapAsync(wgpu.MapModeRead, 0, readbackSize,
+			func(status wgpu.BufferMapAsyncStatus) {
+				s.finishReadback(index, readbackSize, status)
+			})
 
-		s.surface.Configure(s.adapter, s.device, s.config)
+		if err != nil {
+			// The callback won't run, so the buffer is free again
+			s.bufferMappedState[index] = false
+			fmt.Printf("failed to start reading back staging buffer %d: %v\n", index, err)
+		}
 	}
-}
 
-func (s *State) Render() error {
-	nextTexture, err := s.surface.GetCurrentTexture()
-	if err != nil {
-		return fmt.Errorf("failed to get current texture: %w", err)
-	}
-	view, err := nextTexture.CreateView(nil)
-	if err != nil {
-		return fmt.Errorf("failed to create view for texture: %w", err)
+	// MapAsync callbacks only run when the device is polled, which some backends don't do on Present.
+	// Polling once per frame without waiting runs the callbacks of every readback the GPU has finished,
+	// typically that of the previous frame, without stalling the CPU on the work just submitted.
+	// The staging buffers cover the readbacks still in flight.
+	s.device.Poll(false, nil)
 
-	}
-	defer view.Release()
+	return nil
+}
 
+// simulateSteps submits n compute steps, including the neighbor grid passes, and waits until the GPU has run them.
+func (s *State) simulateSteps(n int) error {
 	commandEncoder, err := s.device.CreateCommandEncoder(nil)
 	if err != nil {
 		return fmt.Errorf("failed to create command encoder: %w", err)
@@ -338,137 +1043,265 @@ func (s *State) Render() error {
 	defer commandEncoder.Release()
 
 	computePass := commandEncoder.BeginComputePass(nil)
-	computePass.SetPipeline(s.computePipeline)
 	computePass.SetBindGroup(0, s.particleBindGroup, nil)
-	computePass.DispatchWorkgroups(s.workGroupCount, 1, 1)
+	for range n {
+		if s.params.NeighborGrid != 0 && s.params.SampleSize == 0 {
+			s.sortIntoGrid(computePass)
+		}
+		computePass.SetPipeline(s.computePipeline)
+		computePass.DispatchWorkgroups(s.workGroupCount, 1, 1)
+	}
 	err = computePass.End()
 	if err != nil {
-		return fmt.Errorf("failed to complete compute pass for texture: %w", err)
+		return fmt.Errorf("failed to complete compute pass: %w", err)
 	}
-
 	computePass.Release()
 
-	// Find a currently unmapped buffer for this frame's readback
-	var readbackBufferIndex uint32 = s.nextReadbackIndex
-	for i := 0; i < NumBuffers; i++ {
-		candidateIndex := (s.nextReadbackIndex + uint32(i)) % NumBuffers
-		if !s.bufferMappedState[candidateIndex] {
-			readbackBufferIndex = candidateIndex
-			break
-		}
+	cmdBuffer, err := commandEncoder.Finish(nil)
+	if err != nil {
+		return fmt.Errorf("failed to finish command buffer: %w", err)
 	}
+	defer cmdBuffer.Release()
+	s.queue.Submit(cmdBuffer)
+	s.device.Poll(true, nil)
+	return nil
+}
 
-	// Only proceed with readback if we found an available buffer
-	if !s.bufferMappedState[readbackBufferIndex] {
-		// Now we can safely copy to this buffer
-		err = commandEncoder.CopyBufferToBuffer(
-			s.particleBuffer, // Source buffer (your particle buffer)
-			0,
-			s.stagingBuffers[readbackBufferIndex], // Destination buffer (one that's not mapped)
-			0,
-			uint64(4*NumParticles*4),
-		)
-
-		if err != nil {
-			return fmt.Errorf("failed to copy buffer to buffer: %w", err)
-		}
-
-		// Update next readback index for next frame
-		s.nextReadbackIndex = (readbackBufferIndex + 1) % NumBuffers
+// draw records the render pass that draws all boids to view.
+func (s *State) draw(commandEncoder *wgpu.CommandEncoder, view *wgpu.TextureView) error {
+	colorAttachment := wgpu.RenderPassColorAttachment{
+		View:       view,
+		LoadOp:     wgpu.LoadOpClear,
+		StoreOp:    wgpu.StoreOpStore,
+		ClearValue: s.background,
+	}
+	if s.msaaView != nil {
+		// Render into the multisampled texture and resolve it to the surface
+		colorAttachment.View = s.msaaView
+		colorAttachment.ResolveTarget = view
 	}
 
 	renderPass := commandEncoder.BeginRenderPass(&wgpu.RenderPassDescriptor{
-		ColorAttachments: []wgpu.RenderPassColorAttachment{
-			{
-				View:    view,
-				LoadOp:  wgpu.LoadOpLoad,
-				StoreOp: wgpu.StoreOpStore,
-			},
-		},
+		ColorAttachments: []wgpu.RenderPassColorAttachment{colorAttachment},
 	})
+	if s.trailDecay > 0 {
+		// The trails cover the whole screen, underneath the boids
+		renderPass.SetPipeline(s.compositePipeline)
+		renderPass.SetBindGroup(0, s.trailBindGroup, nil)
+		renderPass.Draw(3, 1, 0, 0)
+	}
 	renderPass.SetPipeline(s.renderPipeline)
+	renderPass.SetBindGroup(0, s.drawBindGroup, nil)
 	renderPass.SetVertexBuffer(0, s.particleBuffer, 0, wgpu.WholeSize)
 	renderPass.SetVertexBuffer(1, s.vertexBuffer, 0, wgpu.WholeSize)
-	renderPass.Draw(3, NumParticles, 0, 0)
-	err = renderPass.End()
+	renderPass.Draw(s.vertexCount, s.particleCount, 0, 0)
+	err := renderPass.End()
 	if err != nil {
 		return fmt.Errorf("failed to complete render pass for texture: %w", err)
 	}
 	renderPass.Release() // must release
+	return nil
+}
 
-	s.frameNum += 1
+// Bounds for the time scale, so the simulation can neither freeze nor become unstable
+const (
+	minTimeScale = 1.0 / 16
+	maxTimeScale = 16
+)
 
-	cmdBuffer, err := commandEncoder.Finish(nil)
+// SetTimeScale changes how much simulated time passes per frame relative to real time,
+// e.g. 0.25 for slow motion or 4 for fast-forward. Steering is scaled with the time step, so boids take about the
+// same paths at any time scale.
+func (s *State) SetTimeScale(scale float32) {
+	s.timeScale = min(max(scale, minTimeScale), maxTimeScale)
+	fmt.Printf("time scale: %gx\n", s.timeScale)
+}
+
+// TogglePause pauses or resumes the simulation. Paused states keep drawing the last frame.
+func (s *State) TogglePause() {
+	s.paused = !s.paused
+	if s.paused {
+		fmt.Println("paused")
+	} else {
+		fmt.Println("resumed")
+	}
+}
+
+// Step advances a paused simulation by a single frame.
+func (s *State) Step() {
+	if s.paused {
+		s.stepOnce = true
+	}
+}
+
+// SetAttractor moves the point that attracts or repels boids, AttractorOff disables it.
+func (s *State) SetAttractor(point [2]float32, mode AttractorMode) {
+	s.params.AttractorX, s.params.AttractorY = point[0], point[1]
+	s.params.AttractorMode = mode
+}
+
+// weightStep is how much a key press changes a flocking rule weight, maxWeight is the highest weight it allows.
+const (
+	weightStep = 0.1
+	maxWeight  = 5
+)
+
+// AdjustWeight changes the weight of a flocking rule by delta, clamped between 0 and maxWeight, and uploads
+// the parameters. key selects the rule: A for alignment, C for cohesion and S for separation.
+func (s *State) AdjustWeight(key glfw.Key, delta float32) error {
+	var name string
+	var weight *float32
+	switch key {
+	case glfw.KeyA:
+		name, weight = "alignment", &s.params.AlignmentWeight
+	case glfw.KeyC:
+		name, weight = "cohesion", &s.params.CohesionWeight
+	case glfw.KeyS:
+		name, weight = "separation", &s.params.SeparationWeight
+	default:
+		return fmt.Errorf("no weight is bound to key %v", key)
+	}
+	*weight = min(max(*weight+delta, 0), maxWeight)
+	fmt.Printf("%s weight: %.2f\n", name, *weight)
+
+	err := s.queue.WriteBuffer(s.simParamBuffer, 0, s.params.Bytes())
 	if err != nil {
-		return fmt.Errorf("failed to finish command buffer: %w", err)
+		return fmt.Errorf("failed to update simulation parameters: %w", err)
 	}
-	defer cmdBuffer.Release()
+	return nil
+}
 
-	// Submit command buffer and present
-	s.queue.Submit(cmdBuffer)
-	s.surface.Present()
+// createStagingBuffer creates the staging buffer at index i of stagingBuffers, sized for all particles.
+func (s *State) createStagingBuffer(i int) (*wgpu.Buffer, error) {
+	return s.device.CreateBuffer(&wgpu.BufferDescriptor{
+		Label:            fmt.Sprintf("Staging Buffer %d", i),
+		Size:             s.particleBufferSize(),
+		Usage:            wgpu.BufferUsageMapRead | wgpu.BufferUsageCopyDst,
+		MappedAtCreation: false,
+	})
+}
 
-	if !s.bufferMappedState[readbackBufferIndex] {
-		// Mark the buffer as mapped before starting the async operation
-		s.bufferMappedState[readbackBufferIndex] = true
+// finishReadback is the MapAsync callback of the staging buffer at index, which runs while the device is polled.
+// It sends the particle data on to particleData and always returns the buffer to the pool. A buffer that fails
+// to unmap would fail every later copy into it, so it is replaced with a new one.
+func (s *State) finishReadback(index uint32, size uint64, status wgpu.BufferMapAsyncStatus) {
+	defer func() {
+		s.bufferMappedState[index] = false
+	}()
+	if status != wgpu.BufferMapAsyncStatusSuccess {
+		s.failedReadbacks++
+		// Only log occasionally, a lost device would otherwise log every frame
+		if s.failedReadbacks == 1 || s.failedReadbacks%100 == 0 {
+			fmt.Printf("failed to map staging buffer %d: %s, %d readbacks failed so far\n", index, status, s.failedReadbacks)
+		}
+		return
+	}
 
-		err = s.stagingBuffers[readbackBufferIndex].MapAsync(wgpu.MapModeRead, 0, uint64(4*NumParticles*4),
-			func(status wgpu.BufferMapAsyncStatus) {
-				if status == wgpu.BufferMapAsyncStatusSuccess {
-					// Read the data
-					buffer := make([]byte, 4*NumParticles*4)
-					copy(buffer, s.stagingBuffers[readbackBufferIndex].GetMappedRange(0, uint(4*NumParticles*4)))
-					err = s.stagingBuffers[readbackBufferIndex].Unmap()
-					floatData := wgpu.FromBytes[float32](buffer)
-					// Copy to our CPU-side array
-					select {
-					case s.particleData <- floatData:
-					default:
-						fmt.Println("failed to send particle data to buffer")
+	buffer := make([]byte, size)
+	copy(buffer, s.stagingBuffers[index].GetMappedRange(0, uint(size)))
+	err := s.stagingBuffers[index].Unmap()
+	if err != nil {
+		fmt.Printf("failed to unmap staging buffer %d, replacing it: %v\n", index, err)
+		s.replaceStagingBuffer(index)
+	}
 
-					}
-					if err != nil {
-						fmt.Printf("failed to unmap staging buffer: %v\n", err)
-					}
-				}
-				// Mark buffer as no longer mapped
-				s.bufferMappedState[readbackBufferIndex] = false
-			})
+	// The copy is complete even if unmapping failed
+	select {
+	case s.particleData <- wgpu.FromBytes[float32](buffer):
+	default:
+		fmt.Println("failed to send particle data to buffer")
+		s.metrics.ReadbackDropped()
+	}
+}
 
-		if err != nil {
-			fmt.Println("Error starting buffer readback:", err)
+// replaceStagingBuffer releases the staging buffer at index and creates a new one in its place. If that fails
+// the old buffer stays in the pool.
+func (s *State) replaceStagingBuffer(index uint32) {
+	replacement, err := s.createStagingBuffer(int(index))
+	if err != nil {
+		fmt.Printf("failed to replace staging buffer %d: %v\n", index, err)
+		return
+	}
+	s.stagingBuffers[index].Release()
+	s.stagingBuffers[index] = replacement
+}
+
+// CloseParticleData waits for all outstanding readbacks to complete and closes the particle data channel,
+// so its consumer can drain the remaining frames and return. Render must not be called afterwards.
+func (s *State) CloseParticleData() {
+	for s.readbackPending() {
+		s.device.Poll(true, nil)
+	}
+	close(s.particleData)
+	s.logReadbackUtilization()
+}
+
+// countMappedBuffers adds the staging buffers currently in use to the utilization statistics, once per readback.
+func (s *State) countMappedBuffers() {
+	mapped := 0
+	for _, m := range s.bufferMappedState {
+		if m {
+			mapped++
 		}
 	}
+	s.readbacks++
+	s.mappedTotal += uint64(mapped)
+	s.mappedPeak = max(s.mappedPeak, mapped)
+}
 
-	return nil
+// logReadbackUtilization prints how many staging buffers were in use on average and at most when reading back,
+// to tune -readback-buffers. A peak well below the pool size wastes memory, a full pool skips frames.
+func (s *State) logReadbackUtilization() {
+	if s.readbacks == 0 {
+		return
+	}
+	fmt.Printf("staging buffers: %.1f of %d in use on average, %d at most, %d frames skipped\n",
+		float64(s.mappedTotal)/float64(s.readbacks), len(s.stagingBuffers), s.mappedPeak, s.skippedReadbacks)
+}
+
+func (s *State) readbackPending() bool {
+	for _, mapped := range s.bufferMappedState {
+		if mapped {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *State) Destroy() {
 	// Release staging buffers
-	for i := 0; i < NumBuffers; i++ {
+	for i := range s.stagingBuffers {
 		if s.stagingBuffers[i] != nil {
 			s.stagingBuffers[i].Release()
 			s.stagingBuffers[i] = nil
 		}
 	}
-	if s.particleBindGroup != nil {
-		s.particleBindGroup.Release()
+	s.releaseMSAATexture()
+	s.releasePipelines()
+	s.releaseGrid()
+	if s.drawParamBuffer != nil {
+		s.drawParamBuffer.Release()
+		s.drawParamBuffer = nil
 	}
 	if s.particleBuffer != nil {
 		s.particleBuffer.Release()
 	}
+	if s.simParamBuffer != nil {
+		s.simParamBuffer.Release()
+		s.simParamBuffer = nil
+	}
+	if s.obstacleBuffer != nil {
+		s.obstacleBuffer.Release()
+		s.obstacleBuffer = nil
+	}
+	if s.forceBuffer != nil {
+		s.forceBuffer.Release()
+		s.forceBuffer = nil
+	}
 	if s.vertexBuffer != nil {
 		s.vertexBuffer.Release()
 		s.vertexBuffer = nil
 	}
-	if s.computePipeline != nil {
-		s.computePipeline.Release()
-		s.computePipeline = nil
-	}
-	if s.renderPipeline != nil {
-		s.renderPipeline.Release()
-		s.renderPipeline = nil
-	}
 	if s.config != nil {
 		s.config = nil
 	}
@@ -487,53 +1320,271 @@ func (s *State) Destroy() {
 }
 
 func main() {
-	if err := glfw.Init(); err != nil {
-		panic(err)
+	// `goBoids view` renders a flock published by another instance instead of simulating one
+	args := os.Args[1:]
+	viewer := len(args) > 0 && args[0] == "view"
+	if viewer {
+		args = args[1:]
 	}
-	defer glfw.Terminate()
 
-	glfw.WindowHint(glfw.ClientAPI, glfw.NoAPI)
-	window, err := glfw.CreateWindow(1024, 768, "Boids", nil, nil)
+	cfg, err := ParseConfig(args)
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	cfg.Viewer = viewer
+
+	if cfg.DumpConfig != "" {
+		err = cfg.WriteFile(cfg.DumpConfig)
+		if err != nil {
+			fmt.Println("failed to dump configuration:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.PrintAdapter {
+		ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+		defer cancel()
+		err = PrintAdapter(ctx, cfg)
+		if err != nil {
+			fmt.Println("failed to get GPU adapter:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.Simulated() {
+		// Logged so that a run can be reproduced with -seed
+		fmt.Println("seed:", cfg.Seed)
+	}
+
+	if (cfg.Headless || cfg.RenderFrames > 0) && !cfg.Simulated() {
+		fmt.Println("the viewer and replays can't run headless or render frames")
+		os.Exit(2)
+	}
+	if cfg.Viewer && cfg.Replay != "" {
+		fmt.Println("the viewer can't replay a recording")
+		os.Exit(2)
+	}
+
+	// Headless runs have no window and stop on an interrupt, windowed runs stop on either. On the way out the
+	// particle channel is closed, the outputs and NATS are drained and the GPU resources are released, all by
+	// the deferred calls below. A second interrupt kills the process in case draining hangs.
+	interrupted, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(interrupted, func() {
+		stop()
+		fmt.Println("shutting down, interrupt again to quit immediately")
+	})
+
+	title := "Boids"
+	if cfg.Viewer {
+		title = "Boids Viewer"
+	} else if cfg.Replay != "" {
+		title = "Boids Replay"
+	}
+
+	var window *glfw.Window
+	if !cfg.Headless && cfg.RenderFrames == 0 {
+
+		if err := glfw.Init(); err != nil {
+			panic(err)
+		}
+		defer glfw.Terminate()
+
+		glfw.WindowHint(glfw.ClientAPI, glfw.NoAPI)
+		window, err = glfw.CreateWindow(1024, 768, title, nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		defer window.Destroy()
 	}
-	defer window.Destroy()
 
-	s, err := InitState(window)
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	s, err := InitStateContext(ctx, window, cfg)
+	cancel()
 	if err != nil {
 		panic(err)
 	}
 	defer s.Destroy()
 
-	window.SetSizeCallback(func(w *glfw.Window, width, height int) {
-		s.Resize(width, height)
-	})
+	if window != nil {
+		setupInput(window, s, cfg)
+	}
 
-	go Connect(s.particleData)
+	// nil unless shaders are watched, which Poll handles
+	var shaderWatcher *ShaderWatcher
+	if cfg.WatchShaders {
+		shaderWatcher, err = NewShaderWatcher()
+		if err != nil {
+			panic(err)
+		}
+		defer shaderWatcher.Close()
+		fmt.Println("watching compute.wgsl and draw.wgsl for changes")
+	}
 
-	const targetFPS = 60
-	const frameTime = time.Second / targetFPS
+	// Publishing is the point of the simulation, so it is only healthy while connected to NATS
+	var health *HealthCheck
+	if cfg.HealthAddr != "" {
+		health = &HealthCheck{StallAfter: cfg.HealthStall, RequireNATS: cfg.Simulated() && cfg.NATS.Publish}
+		health.ListenAndServe(cfg.HealthAddr)
+	}
+	var metrics *Metrics
+	if cfg.MetricsAddr != "" {
+		metrics = &Metrics{}
+		metrics.ListenAndServe(cfg.MetricsAddr)
+		s.metrics = metrics
+	}
 
-	nextFrame := time.Now()
+	var frames <-chan []float32
+	// Parameter updates received over NATS, nil unless simulating
+	var controls chan ControlRequest
+	if cfg.Viewer {
+		var unsubscribe func()
+		frames, unsubscribe, err = SubscribeFrames(cfg.NATS)
+		if err != nil {
+			panic(err)
+		}
+		defer unsubscribe()
+	} else if cfg.Replay != "" {
+		var stopReplay func()
+		frames, stopReplay, err = ReplayFrames(cfg.Replay)
+		if err != nil {
+			panic(err)
+		}
+		defer stopReplay()
+	} else {
+		particles := (<-chan []float32)(s.particleData)
+		controls = make(chan ControlRequest, maxPendingControls)
+		var consumers []func(<-chan []float32)
+		if cfg.Record != "" {
+			recorder, err := stream.NewRecorder(cfg.Record, cfg.ForceColumn)
+			if err != nil {
+				panic(err)
+			}
+			consumers = append(consumers, recorder.Run)
+		}
+		if cfg.CSV != "" {
+			csvWriter, err := stream.NewCSVWriter(cfg.CSV)
+			if err != nil {
+				panic(err)
+			}
+			consumers = append(consumers, csvWriter.Run)
+		}
+		if cfg.WebSocketAddr != "" {
+			publisher := &stream.Publisher{
+				Sink:       stream.NewWebSocketSink(cfg.WebSocketAddr),
+				Serializer: stream.Arrow{ForceMagnitude: cfg.ForceColumn, Sample: cfg.NetworkSample},
+				Subject:    cfg.NATS.Subject,
+			}
+			consumers = append(consumers, publisher.Run)
+			fmt.Printf("streaming frames to WebSocket clients on %s\n", cfg.WebSocketAddr)
+		}
+		if cfg.LogForces {
+			consumers = append(consumers, func(frames <-chan []float32) {
+				logForces(frames, cfg.Params.MaxForce)
+			})
+		}
+		if cfg.NATS.Publish {
+			consumers = append(consumers, func(frames <-chan []float32) {
+				Connect(frames, cfg.NATS.Subject, cfg, health, metrics, controls)
+			})
+		}
+		// Wait for Connect to publish all queued frames, and the other consumers to process them, before the process exits
+		defer runConsumers(particles, consumers)()
+		defer s.CloseParticleData()
+	}
+
+	// Without a target frame rate frames are rendered back to back
+	var frameTime time.Duration
+	if cfg.FPS > 0 {
+		frameTime = time.Second / time.Duration(cfg.FPS)
+	}
+
+	var budget *FrameBudget
+	if cfg.TargetFrameTime > 0 && cfg.Simulated() {
+		budget = &FrameBudget{Target: cfg.TargetFrameTime, Min: cfg.MinParticles, Max: cfg.MaxParticles}
+		s.SetActiveParticles(cfg.MaxParticles)
+	}
+
+	if cfg.RenderFrames > 0 {
+		err = s.ExportFrames(interrupted, cfg.RenderFrames, cfg.FramesDir)
+		if err != nil {
+			fmt.Println("failed to render frames:", err)
+		}
+		return
+	}
 
-	for !window.ShouldClose() {
+	nextFrame := time.Now()
+	// The window title shows the frame rate, measured over about a second
+	titleFrames, titleSince := 0, time.Now()
+	// Frames in a row that failed because the surface was outdated or lost, despite reconfiguring it.
+	// Only failures after the surface was reconfigured count, a window that was just restored fails once.
+	surfaceFailures := 0
+	reconfigured := false
+
+	for interrupted.Err() == nil && (window == nil || !window.ShouldClose()) {
 		now := time.Now()
 		// Only render if it's time for the next frame
 		if now.After(nextFrame) || now.Equal(nextFrame) {
 
-			glfw.PollEvents()
+			if window != nil {
+				glfw.PollEvents()
+				// A minimized window has a framebuffer without area, which its surface can't be configured for
+				width, height := window.GetFramebufferSize()
+				s.hidden = window.GetAttrib(glfw.Iconified) == glfw.True || width == 0 || height == 0
+			}
+
+			// frames is nil unless running as a viewer or replaying
+			select {
+			case particles := <-frames:
+				err = s.SetParticles(particles)
+				if err != nil {
+					fmt.Println(err)
+				}
+			default:
+			}
+			select {
+			case r := <-controls:
+				r.Answer(s.ApplyParams(r.Update))
+			default:
+			}
+			shaderWatcher.Poll(s)
+
+			renderStart := time.Now()
 			err = s.Render()
+			if budget != nil {
+				s.adaptParticles(budget, time.Since(renderStart))
+			}
+			health.FrameRendered()
+			metrics.FrameRendered(time.Since(renderStart))
+			titleFrames++
+			if elapsed := time.Since(titleSince); window != nil && elapsed >= time.Second {
+				fps := float64(titleFrames) / elapsed.Seconds()
+				window.SetTitle(fmt.Sprintf("%s — %.1f FPS — %d particles", title, fps, s.particleCount))
+				titleFrames, titleSince = 0, time.Now()
+			}
 			if err != nil {
 				fmt.Println("an error occurred while rendering:", err)
 
 				errstr := err.Error()
 				switch {
 				case strings.Contains(errstr, "Surface timed out"): // do nothing
-				case strings.Contains(errstr, "Surface is outdated"): // do nothing
-				case strings.Contains(errstr, "Surface was lost"): // do nothing
+				case strings.Contains(errstr, "Surface is outdated"), strings.Contains(errstr, "Surface was lost"):
+					// e.g. after a resize or display change the surface works again once it is reconfigured
+					if reconfigured {
+						surfaceFailures++
+						if surfaceFailures > maxSurfaceFailures {
+							panic(fmt.Errorf("surface still unusable after reconfiguring it %d times: %w", maxSurfaceFailures, err))
+						}
+					}
+					reconfigured = s.ReconfigureSurface()
 				default:
 					panic(err)
 				}
+			} else {
+				surfaceFailures = 0
+				reconfigured = false
 			}
 			// Schedule next frame
 			nextFrame = nextFrame.Add(frameTime)
@@ -548,3 +1599,169 @@ func main() {
 		}
 	}
 }
+
+// runConsumers runs every consumer in its own goroutine on all frames received on particles. The returned
+// function waits until every consumer returned, which they do once particles is closed and they processed
+// the remaining frames.
+func runConsumers(particles <-chan []float32, consumers []func(<-chan []float32)) (wait func()) {
+	// Without consumers nothing is read back, see Config.ReadsBack
+	receivers := []<-chan []float32{particles}
+	if len(consumers) > 1 {
+		receivers = stream.FanOut(particles, len(consumers))
+	}
+	var wg sync.WaitGroup
+	for i, consume := range consumers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consume(receivers[i])
+		}()
+	}
+	return wg.Wait
+}
+
+// setupInput registers the window callbacks for resizing, keyboard shortcuts and picking.
+func setupInput(window *glfw.Window, s *State, cfg Config) {
+	window.SetSizeCallback(func(w *glfw.Window, width, height int) {
+		s.Resize(width, height)
+	})
+
+	window.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+		if action != glfw.Press {
+			return
+		}
+		switch key {
+		case glfw.KeyF5:
+			if err := s.SaveState(cfg.StateFile); err != nil {
+				fmt.Println("failed to save state:", err)
+			} else {
+				fmt.Println("saved state to", cfg.StateFile)
+			}
+		case glfw.KeyF9:
+			if err := s.LoadState(cfg.StateFile); err != nil {
+				fmt.Println("failed to load state:", err)
+			} else {
+				fmt.Println("loaded state from", cfg.StateFile)
+			}
+		case glfw.KeyR:
+			if err := s.ResetView(); err != nil {
+				fmt.Println(err)
+			}
+		case glfw.KeyEqual, glfw.KeyMinus:
+			// = (the unshifted +) grows the boids, - shrinks them
+			factor := float32(boidSizeStep)
+			if key == glfw.KeyMinus {
+				factor = 1 / factor
+			}
+			if err := s.SetBoidSize(s.drawParams.BoidSize * factor); err != nil {
+				fmt.Println(err)
+			}
+		case glfw.KeyLeftBracket:
+			s.SetTimeScale(s.timeScale / 2)
+		case glfw.KeyRightBracket:
+			s.SetTimeScale(s.timeScale * 2)
+		case glfw.KeyBackslash:
+			s.SetTimeScale(1)
+		case glfw.KeyP:
+			name, err := s.SaveScreenshot()
+			if err != nil {
+				fmt.Println("failed to save screenshot:", err)
+			} else {
+				fmt.Println("saved screenshot to", name)
+			}
+		case glfw.KeySpace:
+			s.TogglePause()
+		case glfw.KeyRight:
+			s.Step()
+		case glfw.KeyA, glfw.KeyC, glfw.KeyS:
+			// The key increases the weight of its rule, with shift it decreases it
+			step := float32(weightStep)
+			if mods&glfw.ModShift != 0 {
+				step = -step
+			}
+			err := s.AdjustWeight(key, step)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	})
+
+	// Dragging with shift and the left button pans the view, the last cursor position is in clip space
+	panning := false
+	var panFrom [2]float32
+
+	// Holding the left button attracts boids to the cursor, holding the right one repels them
+	window.SetMouseButtonCallback(func(w *glfw.Window, button glfw.MouseButton, action glfw.Action, mods glfw.ModifierKey) {
+		x, y := w.GetCursorPos()
+		if button == glfw.MouseButtonLeft && (panning || action == glfw.Press && mods&glfw.ModShift != 0) {
+			panning = action == glfw.Press
+			panFrom = cursorToClip(w, x, y)
+			return
+		}
+		var mode AttractorMode
+		switch button {
+		case glfw.MouseButtonLeft:
+			mode = AttractorAttract
+		case glfw.MouseButtonRight:
+			mode = AttractorRepel
+		case glfw.MouseButtonMiddle:
+			if action == glfw.Press {
+				pickAtCursor(w, s)
+			}
+			return
+		default:
+			return
+		}
+		if action == glfw.Release {
+			mode = AttractorOff
+		}
+		s.SetAttractor(s.clipToWorld(cursorToClip(w, x, y)), mode)
+	})
+	window.SetCursorPosCallback(func(w *glfw.Window, x, y float64) {
+		if panning {
+			to := cursorToClip(w, x, y)
+			if err := s.Pan([2]float32{to[0] - panFrom[0], to[1] - panFrom[1]}); err != nil {
+				fmt.Println(err)
+			}
+			panFrom = to
+		}
+		if s.params.AttractorMode != AttractorOff {
+			s.SetAttractor(s.clipToWorld(cursorToClip(w, x, y)), s.params.AttractorMode)
+		}
+	})
+	// The scroll wheel zooms around the cursor
+	window.SetScrollCallback(func(w *glfw.Window, xoff, yoff float64) {
+		x, y := w.GetCursorPos()
+		if err := s.ZoomAt(cursorToClip(w, x, y), yoff); err != nil {
+			fmt.Println(err)
+		}
+	})
+}
+
+// cursorToClip converts window coordinates to the [-1, 1] clip space of the window, with y pointing up.
+// Without zooming or panning, this is the simulation space, which is stretched over the whole window.
+func cursorToClip(w *glfw.Window, x, y float64) [2]float32 {
+	width, height := w.GetSize()
+	if width == 0 || height == 0 {
+		return [2]float32{}
+	}
+	return [2]float32{float32(2*x/float64(width) - 1), float32(1 - 2*y/float64(height))}
+}
+
+// pickAtCursor prints the index of the boid under the cursor.
+func pickAtCursor(w *glfw.Window, s *State) {
+	// The cursor position is in window coordinates, which can differ from surface pixels
+	x, y := w.GetCursorPos()
+	width, height := w.GetSize()
+	if width == 0 || height == 0 {
+		return
+	}
+	px := int(x * float64(s.config.Width) / float64(width))
+	py := int(y * float64(s.config.Height) / float64(height))
+	index, err := s.PickBoid(px, py)
+	if err != nil {
+		fmt.Println("failed to pick boid:", err)
+	} else if index >= 0 {
+		fmt.Println("picked boid", index)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/cogentcore/webgpu/wgpu"
+	"math"
+	"testing"
+	"time"
+)
+
+// skipWithoutAdapter skips tests that need a GPU when there is no adapter, not even a software one.
+func skipWithoutAdapter(tb testing.TB) {
+	tb.Helper()
+	instance := wgpu.CreateInstance(nil)
+	defer instance.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	defer cancel()
+	adapter, err := requestAdapter(ctx, instance, nil, Config{})
+	if err != nil {
+		tb.Skipf("no GPU adapter: %v", err)
+	}
+	adapter.Release()
+}
+
+// testConfig returns the default configuration for a headless simulation of particles boids.
+func testConfig(particles uint32) Config {
+	cfg := DefaultConfig()
+	cfg.Headless = true
+	cfg.Particles = particles
+	cfg.MaxParticles = particles
+	cfg.MinParticles = particles
+	return cfg
+}
+
+// newTestState initializes a headless simulation for cfg, which is destroyed when the test ends.
+// The test is skipped without a GPU adapter.
+func newTestState(tb testing.TB, cfg Config) *State {
+	tb.Helper()
+	skipWithoutAdapter(tb)
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	defer cancel()
+	s, err := InitStateContext(ctx, nil, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(s.Destroy)
+	return s
+}
+
+// stepGPU uploads the parameters and external forces of s, runs n compute steps and returns the particle
+// data before and after them.
+func stepGPU(tb testing.TB, s *State, n int) (before, after []float32) {
+	tb.Helper()
+	before, err := s.readParticleBuffer()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = s.queue.WriteBuffer(s.simParamBuffer, 0, s.params.Bytes())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = s.uploadForces()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = s.simulateSteps(n)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	after, err = s.readParticleBuffer()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return before, after
+}
+
+// benchmarkParticles are the particle counts BenchmarkComputeStep measures.
+var benchmarkParticles = []uint32{1 << 10, 1 << 12, 1 << 14, 1 << 16}
+
+// benchmarkBatch is the number of steps submitted at once. It is large enough that waiting for the GPU
+// after each batch doesn't dominate.
+const benchmarkBatch = 10
+
+// BenchmarkComputeStep measures a simulation step of the compute pipeline, including the neighbor grid
+// passes, without drawing or reading back particles.
+func BenchmarkComputeStep(b *testing.B) {
+	for _, particles := range benchmarkParticles {
+		b.Run(fmt.Sprintf("%dk", particles/1024), func(b *testing.B) {
+			benchmarkSteps(b, testConfig(particles))
+		})
+	}
+}
+
+// BenchmarkNeighborSearch compares finding neighbors in the uniform grid with comparing all pairs of
+// boids at 16k boids.
+func BenchmarkNeighborSearch(b *testing.B) {
+	for _, grid := range []bool{true, false} {
+		name := "all-pairs"
+		if grid {
+			name = "grid"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := testConfig(1 << 14)
+			cfg.Params.NeighborGrid = 0
+			if grid {
+				cfg.Params.NeighborGrid = 1
+			}
+			benchmarkSteps(b, cfg)
+		})
+	}
+}
+
+// benchmarkSteps runs b.N steps of a simulation configured by cfg in batches of benchmarkBatch and reports
+// the steps per second. A first batch warms up the pipeline and isn't measured.
+func benchmarkSteps(b *testing.B, cfg Config) {
+	s := newTestState(b, cfg)
+	err := s.queue.WriteBuffer(s.simParamBuffer, 0, s.params.Bytes())
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = s.simulateSteps(benchmarkBatch)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for done := 0; done < b.N; done += benchmarkBatch {
+		err = s.simulateSteps(min(benchmarkBatch, b.N-done))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "steps/s")
+}
+
+func TestRunConsumersWaitsForQueuedFrames(t *testing.T) {
+	frames := 10
+	particles := make(chan []float32, frames)
+	for range frames {
+		particles <- nil
+	}
+	close(particles)
+
+	// The consumers take a while for each frame, the wait must outlast them
+	counts := make([]int, 3)
+	var consumers []func(<-chan []float32)
+	for i := range counts {
+		consumers = append(consumers, func(frames <-chan []float32) {
+			for range frames {
+				time.Sleep(time.Millisecond)
+				counts[i]++
+			}
+		})
+	}
+	runConsumers(particles, consumers)()
+	for i, n := range counts {
+		if n != frames {
+			t.Errorf("consumer %d processed %d frames, want %d", i, n, frames)
+		}
+	}
+}
+
+func TestComputeForceMagnitude(t *testing.T) {
+	cfg := testConfig(512)
+	cfg.Seed = 3
+	s := newTestState(t, cfg)
+	_, after := stepGPU(t, s, 5)
+	boids, err := boid.Boids(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steering := 0
+	for i, b := range boids {
+		if b.Force < 0 || math.IsNaN(float64(b.Force)) || math.IsInf(float64(b.Force), 0) {
+			t.Fatalf("boid %d has force magnitude %v, want a non-negative number", i, b.Force)
+		}
+		if b.Force > 0 {
+			steering++
+		}
+	}
+	// Boids with neighbors steer
+	if steering == 0 {
+		t.Error("no boid steered")
+	}
+}
+
+func TestSupportedSampleCount(t *testing.T) {
+	s := newTestState(t, testConfig(16))
+	tests := []struct {
+		format    wgpu.TextureFormat
+		requested uint32
+		want      uint32
+	}{
+		{wgpu.TextureFormatRGBA8Unorm, 1, 1},
+		{wgpu.TextureFormatRGBA8Unorm, 4, 4},
+		// Without adapter specific format features, formats only support 1 and 4 samples
+		{wgpu.TextureFormatRGBA8Unorm, 8, 4},
+		// Formats that can't be rendered to can't be multisampled either
+		{wgpu.TextureFormatRGBA8Snorm, 4, 1},
+	}
+	for _, tt := range tests {
+		if got := s.supportedSampleCount(tt.format, tt.requested); got != tt.want {
+			t.Errorf("got %dx MSAA for %dx with %s, want %dx", got, tt.requested, tt.format, tt.want)
+		}
+	}
+}
+
+func TestTimeScaleIsSlowMotion(t *testing.T) {
+	cfg := testConfig(256)
+	cfg.Seed = 11
+	cfg.Layout = LayoutCluster
+	s := newTestState(t, cfg)
+	s.readback = false
+	initial, err := s.readParticleBuffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// render simulates frames at scale from the initial particles and returns the particles after them
+	render := func(scale float32, frames int) []float32 {
+		err := s.SetParticles(initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.timeScale = scale
+		for range frames {
+			err = s.Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		particles, err := s.readParticleBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return particles
+	}
+	halves, whole := render(0.5, 2), render(1, 1)
+	// Like sub-steps, the halves only change when within the frame the steering takes effect
+	bound := maxCombinedForce * cfg.Params.MaxForce * cfg.Params.DeltaTime
+	if d := maxDistance(t, halves, whole); d > bound {
+		t.Errorf("boids are up to %v apart after two frames at half speed and one at full speed, want at most %v", d, bound)
+	}
+	// Steering twice as much in the halves would turn the boids much further
+	halfBoids, err := boid.Boids(halves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wholeBoids, err := boid.Boids(whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var difference float32
+	for i, b := range halfBoids {
+		difference += sub3(b.Vel, wholeBoids[i].Vel).Len() / float32(len(halfBoids))
+	}
+	if limit := cfg.Params.MaxSpeed / 20; difference > limit {
+		t.Errorf("velocities differ by %v on average after two frames at half speed and one at full speed, want at most %v", difference, limit)
+	}
+}
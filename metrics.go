@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brodo/goBoids/stream"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects counters about rendering, the GPU readback and publishing, and serves them in the
+// Prometheus text format. All methods ignore a nil Metrics, so callers don't need to check whether
+// metrics are enabled.
+type Metrics struct {
+	renders        atomic.Uint64
+	renderNanos    atomic.Uint64 // total render duration
+	lastRenderNano atomic.Int64
+	dispatches     atomic.Uint64
+	noStaging      atomic.Uint64 // readbacks skipped because every staging buffer was mapped
+	channelFull    atomic.Uint64 // read back frames dropped because the particle channel was full
+	sink           atomic.Pointer[stream.MultiSink]
+}
+
+// FrameRendered records how long rendering a frame took.
+func (m *Metrics) FrameRendered(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.renders.Add(1)
+	m.renderNanos.Add(uint64(d))
+	m.lastRenderNano.Store(int64(d))
+}
+
+// Dispatched records n compute dispatches.
+func (m *Metrics) Dispatched(n int) {
+	if m == nil {
+		return
+	}
+	m.dispatches.Add(uint64(n))
+}
+
+// ReadbackSkipped records a frame that was due for publishing but had no unmapped staging buffer.
+func (m *Metrics) ReadbackSkipped() {
+	if m == nil {
+		return
+	}
+	m.noStaging.Add(1)
+}
+
+// ReadbackDropped records a read back frame that didn't fit into the particle channel.
+func (m *Metrics) ReadbackDropped() {
+	if m == nil {
+		return
+	}
+	m.channelFull.Add(1)
+}
+
+// SetSink sets the sink whose publish counts are reported.
+func (m *Metrics) SetSink(sink *stream.MultiSink) {
+	if m == nil {
+		return
+	}
+	m.sink.Store(sink)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var published, failed, dropped uint64
+	if sink := m.sink.Load(); sink != nil {
+		published = sink.Published()
+		failed, dropped = sink.Failures()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"boids_frame_render_seconds_sum", "", "", float64(m.renderNanos.Load()) / 1e9},
+		{"boids_frame_render_seconds_count", "", "", float64(m.renders.Load())},
+		{"boids_last_frame_render_seconds", "gauge", "Render duration of the last frame.", float64(m.lastRenderNano.Load()) / 1e9},
+		{"boids_compute_dispatches_total", "counter", "Compute shader dispatches, including the neighbor grid passes.", float64(m.dispatches.Load())},
+		{"boids_readback_skipped_total", "counter", "Frames due for publishing that were not read back because every staging buffer was in use.", float64(m.noStaging.Load())},
+		{"boids_readback_dropped_total", "counter", "Read back frames dropped because the particle channel was full.", float64(m.channelFull.Load())},
+		{"boids_nats_published_total", "counter", "Messages published to NATS, summed over all servers.", float64(published)},
+		{"boids_nats_publish_errors_total", "counter", "Messages that failed to publish to NATS, summed over all servers.", float64(failed)},
+		{"boids_nats_dropped_total", "counter", "Messages dropped because a server's publish queue was full.", float64(dropped)},
+	}
+	// The render duration is a summary without quantiles, its _sum and _count share the header
+	_, err := io.WriteString(w, "# HELP boids_frame_render_seconds Time spent rendering frames.\n# TYPE boids_frame_render_seconds summary\n")
+	for _, metric := range metrics {
+		if err != nil {
+			break
+		}
+		if metric.kind != "" {
+			_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s %g\n", metric.name, metric.value)
+		}
+	}
+	if err != nil {
+		fmt.Printf("failed to write metrics: %v\n", err)
+	}
+}
+
+// ListenAndServe serves the metrics on addr in the background.
+func (m *Metrics) ListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			fmt.Printf("metrics endpoint stopped: %v\n", err)
+		}
+	}()
+}
@@ -1,81 +1,173 @@
 package main
 
 import (
-	"bytes"
-	"github.com/apache/arrow/go/arrow"
-	"github.com/apache/arrow/go/arrow/array"
-	"github.com/apache/arrow/go/arrow/ipc"
-	"github.com/apache/arrow/go/arrow/memory"
+	"encoding/json"
+	"fmt"
+	"github.com/brodo/goBoids/stream"
 	"github.com/nats-io/nats.go"
-	"os"
+	"strings"
 	"time"
 )
 
-func buildArrow(particles []float32) []byte {
-	pool := memory.NewGoAllocator()
-	schema := arrow.NewSchema(
-		[]arrow.Field{
-			{Name: "time", Type: arrow.PrimitiveTypes.Int64},
-			{Name: "posX", Type: arrow.PrimitiveTypes.Float32},
-			{Name: "posY", Type: arrow.PrimitiveTypes.Float32},
-			{Name: "velX", Type: arrow.PrimitiveTypes.Float32},
-			{Name: "velY", Type: arrow.PrimitiveTypes.Float32},
-		},
-		nil,
-	)
-	b := array.NewRecordBuilder(pool, schema)
-	defer b.Release()
+// natsReconnectWait is how long to wait between attempts to reach a NATS server.
+const natsReconnectWait = 2 * time.Second
 
-	now := time.Now().UnixMicro()
-	for i := 0; i < NumParticles; i++ {
-		pos := i * 4
-		b.Field(0).(*array.Int64Builder).Append(now)
-		b.Field(1).(*array.Float32Builder).Append(particles[pos])
-		b.Field(2).(*array.Float32Builder).Append(particles[pos+1])
-		b.Field(3).(*array.Float32Builder).Append(particles[pos+2])
-		b.Field(4).(*array.Float32Builder).Append(particles[pos+3])
+// natsAuth returns the authentication option selected by cfg, nil for anonymous connections, and a
+// description of the method for logging. A credentials file takes precedence over a password.
+func natsAuth(cfg NATSConfig) (nats.Option, string) {
+	switch {
+	case cfg.Creds != "":
+		return nats.UserCredentials(cfg.Creds), fmt.Sprintf("credentials file %s", cfg.Creds)
+	case cfg.Password != "":
+		return nats.UserInfo("sys", cfg.Password), `password of user "sys"`
+	default:
+		return nil, "anonymous"
 	}
-	rec := b.NewRecord()
-	defer rec.Release()
+}
 
-	buf := bytes.NewBuffer(nil)
-	wr := ipc.NewWriter(buf, ipc.WithSchema(schema))
-	err := wr.Write(rec)
-	if err != nil {
-		panic(err)
+// natsOptions returns the options for connecting to the NATS server at url. Connections retry forever,
+// including the initial connection, so a server that is down or restarting never stops the simulation.
+// It authenticates as selected by natsAuth and logs the method.
+func natsOptions(url string, cfg NATSConfig) []nats.Option {
+	options := []nats.Option{
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				fmt.Printf("disconnected from NATS server %s: %v\n", url, err)
+			}
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			fmt.Printf("reconnected to NATS server %s\n", url)
+		}),
 	}
-	err = wr.Close()
-	if err != nil {
-		panic(err)
+	// Servers without authentication reject clients that send credentials, so only send them if configured
+	auth, method := natsAuth(cfg)
+	fmt.Printf("authenticating to NATS server %s with %s\n", url, method)
+	if auth != nil {
+		options = append(options, auth)
 	}
-	if len(buf.Bytes()) == 0 {
-		panic("buffer is empty")
-	}
-	return buf.Bytes()
+	return options
 }
 
-func Connect(particles chan []float32) {
+// Connect publishes every particle frame received on particles to subject on all NATS servers in cfg.NATS.
+// cfg.NATS.URL may contain a comma-separated list of servers, each of which receives every frame.
+// If density buckets are configured, a density histogram of each frame is published as well, and with
+// cfg.Stats the statistics of each frame on stream.StatsSubject(subject).
+// Every server also answers requests for the latest frame on stream.LatestSubject(subject).
+// With cfg.NATS.Control, every server also accepts parameter updates on stream.ControlSubject(subject),
+// which are sent to controls for the render loop to apply and answer.
+// Servers that are down are retried in the background, frames that can't be published are dropped.
+// The connection state is reported to health and the publish counts to metrics, both may be nil.
+func Connect(particles <-chan []float32, subject string, cfg Config, health *HealthCheck, metrics *Metrics, controls chan<- ControlRequest) {
+	sink := &stream.MultiSink{}
+	latest := &stream.Latest{}
+	for _, u := range strings.Split(cfg.NATS.URL, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		nc, err := nats.Connect(u, natsOptions(u, cfg.NATS)...)
+		if err != nil {
+			fmt.Printf("failed to connect to NATS server %s: %v\n", u, err)
+			continue
+		}
+		err = latest.Serve(nc, subject)
+		if err != nil {
+			fmt.Printf("failed to serve latest frame on %s: %v\n", u, err)
+		}
+		if cfg.NATS.Control {
+			err = ServeControl(nc, stream.ControlSubject(subject), controls)
+			if err != nil {
+				fmt.Printf("failed to serve parameter control on %s: %v\n", u, err)
+			}
+		}
+		sink.Add(u, stream.NewNATSSink(nc))
+	}
+	if sink.Len() == 0 {
+		// Keep consuming frames, so the renderer doesn't block or complain about a full channel
+		fmt.Printf("could not connect to any NATS server in %q, frames are not published\n", cfg.NATS.URL)
+		for range particles {
+		}
+		return
+	}
 
-	url := os.Getenv("NATS_URL")
-	if url == "" {
-		url = nats.DefaultURL
+	health.SetSink(sink)
+	metrics.SetSink(sink)
+
+	var serializer stream.Serializer = stream.Arrow{
+		ForceMagnitude: cfg.ForceColumn,
+		Compression:    cfg.NATS.Compression,
+		Stats:          &stream.CompressionStats{},
+		Sample:         cfg.NetworkSample,
+	}
+	if cfg.Format == "jsonl" {
+		serializer = stream.JSONLines{Sample: cfg.NetworkSample}
 	}
 
-	password := os.Getenv("NATS_PASSWORD")
+	publisher := &stream.Publisher{
+		Sink:           sink,
+		Serializer:     serializer,
+		Subject:        subject,
+		Batch:          cfg.NATS.Batch,
+		DensityBuckets: cfg.DensityBuckets,
+		Stats:          cfg.Stats,
+		Latest:         latest,
+	}
+	publisher.Run(particles)
+}
+
+// controlReply is the response to a control request.
+type controlReply struct {
+	Error string `json:"error,omitempty"`
+}
 
-	nc, err := nats.Connect(url, nats.UserInfo("sys", password))
+// ControlRequest is a parameter update received on the control subject. The render loop answers it once the
+// update is applied or rejected.
+type ControlRequest struct {
+	Update ParamUpdate
+	msg    *nats.Msg
+}
+
+// Answer responds to the request with {} if err is nil and the update was applied, or with {"error": "..."}
+// if it was rejected. Requests without a reply subject aren't answered.
+func (r ControlRequest) Answer(err error) {
+	var reply controlReply
 	if err != nil {
-		panic(err)
+		fmt.Println("rejected control message:", err)
+		reply.Error = err.Error()
 	}
-	defer nc.Drain()
-	for data := range particles {
-		if data == nil || len(data) < 4 {
-			continue
-		}
-		msg := buildArrow(data)
-		err := nc.Publish("sensors.flock", msg)
+	if r.msg == nil || r.msg.Reply == "" {
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err == nil {
+		err = r.msg.Respond(data)
+	}
+	if err != nil {
+		fmt.Printf("failed to answer control message: %v\n", err)
+	}
+}
+
+// ServeControl decodes the parameter updates received on subject and sends them to controls. Messages that
+// can't be decoded are answered right away, the others by the receiver of controls. Closing or draining nc
+// stops serving.
+func ServeControl(nc *nats.Conn, subject string, controls chan<- ControlRequest) error {
+	_, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		r := ControlRequest{msg: msg}
+		var err error
+		r.Update, err = DecodeParamUpdate(msg.Data)
 		if err != nil {
-			panic(err)
+			r.Answer(err)
+			return
 		}
-	}
+		// Don't block the subscription if the render loop doesn't keep up
+		select {
+		case controls <- r:
+		default:
+			r.Answer(fmt.Errorf("too many pending control messages"))
+		}
+	})
+	return err
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"testing"
+)
+
+// runTestServer starts a NATS server on a random port, which is shut down when the test ends.
+func runTestServer(t *testing.T) string {
+	t.Helper()
+	server := natsserver.RunRandClientPortServer()
+	t.Cleanup(server.Shutdown)
+	return server.ClientURL()
+}
+
+func TestConnectFlushesQueuedFrames(t *testing.T) {
+	url := runTestServer(t)
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("boids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every frame published fits in the subscription's pending limits
+	err = nc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.NATS.URL = url
+	cfg.NATS.Subject = "boids"
+	cfg.Stats = false
+	// No more frames than fit in the publish queue, which drops frames beyond it
+	frames := 16
+	particles := make(chan []float32, frames)
+	for range frames {
+		particles <- make([]float32, 1000*12)
+	}
+	// Shutting down closes the channel with frames still queued
+	close(particles)
+	Connect(particles, cfg.NATS.Subject, cfg, nil, nil, nil)
+
+	// Connect only returns once the connection is drained, so the server received every frame before the
+	// subscriber's flush
+	err = nc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, _, err := sub.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != frames {
+		t.Errorf("received %d frames, want %d", received, frames)
+	}
+}
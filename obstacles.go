@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Obstacle is a circle in the xy-plane boids steer around, a cylinder along z in 3D.
+// It mirrors the Obstacle struct in compute.wgsl.
+type Obstacle struct {
+	X      float32 `json:"x"`
+	Y      float32 `json:"y"`
+	Radius float32 `json:"radius"`
+	_      float32 // pads the struct to the 16 bytes the shader expects
+}
+
+// ParseObstacles parses a semicolon-separated list of circles in the form "x,y,radius;x,y,radius".
+func ParseObstacles(s string) ([]Obstacle, error) {
+	var obstacles []Obstacle
+	for _, def := range strings.Split(s, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		parts := strings.Split(def, ",")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid obstacle %q: expected x,y,radius", def)
+		}
+		var values [3]float32
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid obstacle %q: %w", def, err)
+			}
+			values[i] = float32(v)
+		}
+		if values[2] <= 0 {
+			return nil, fmt.Errorf("invalid obstacle %q: radius must be positive", def)
+		}
+		obstacles = append(obstacles, Obstacle{X: values[0], Y: values[1], Radius: values[2]})
+	}
+	return obstacles, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+	"math"
+)
+
+// SimParams mirrors the SimParams uniform in compute.wgsl.
+// The field order and types must match the shader's struct layout.
+type SimParams struct {
+	// DeltaTime is the simulated time of a step. The steering forces, limited by MaxForce, are velocity
+	// changes per 1/60 second and scaled to it, so shorter steps steer correspondingly less.
+	DeltaTime        float32 `json:"deltaTime"`
+	MaxForce         float32 `json:"maxForce"`
+	MaxSpeed         float32 `json:"maxSpeed"`
+	AlignmentWeight  float32 `json:"alignmentWeight"`
+	CohesionWeight   float32 `json:"cohesionWeight"`
+	SeparationWeight float32 `json:"separationWeight"`
+	// PerceptionRadius is the largest of the rule radii below, filled in by Bytes. Boids within it count
+	// as neighbors, it sizes the neighbor grid cells and predators within it are fled from.
+	PerceptionRadius float32 `json:"-"`
+	// Smoothing blends each boid's new velocity with its previous one (0 = no smoothing). It is the part of
+	// the previous velocity kept after 1/60 second, shorter steps keep correspondingly more of it.
+	// Higher values make motion look smoother and reduce frame-to-frame jitter in the
+	// published velocities, but make the flock react more slowly to steering forces.
+	Smoothing float32 `json:"smoothing"`
+	// SampleSize makes each boid consider only this many randomly chosen boids per frame instead
+	// of all of them, trading accuracy for O(n·k) instead of O(n²) work. 0 considers all boids.
+	SampleSize uint32 `json:"sampleSize"`
+	// Frame is the current frame number, it seeds the neighbor sampling.
+	Frame uint32 `json:"-"`
+	// MaxTurnRate limits how fast a boid's heading can change, in radians per second.
+	MaxTurnRate float32 `json:"maxTurnRate"`
+	// Lookahead is how far ahead along its velocity a boid detects obstacles.
+	Lookahead float32 `json:"lookahead"`
+	// ObstacleCount is the number of obstacles in the obstacle buffer. It depends on the
+	// running configuration and is therefore not part of snapshots.
+	ObstacleCount uint32 `json:"-"`
+	// ParticleCount is the number of boids that are simulated, the rest of the particle buffer is ignored.
+	// It is adjusted at runtime and therefore not part of snapshots.
+	ParticleCount uint32 `json:"-"`
+	// BoundaryMode decides what happens to boids that reach the edge of the world.
+	BoundaryMode BoundaryMode `json:"boundaryMode"`
+	// AttractorX and AttractorY are the point boids are pulled towards or pushed away from,
+	// depending on AttractorMode. It follows the mouse and is therefore not part of snapshots.
+	AttractorX    float32       `json:"-"`
+	AttractorY    float32       `json:"-"`
+	AttractorMode AttractorMode `json:"-"`
+	// FlockCount is the number of flocks the boids are split into, between 1 and MaxFlocks.
+	FlockCount uint32 `json:"flockCount"`
+	// PredatorCount is the number of predators, which are the first boids in the particle buffer.
+	// Predators chase the nearest prey and prey flee from them. It also aligns Flocks to 16 bytes like the shader.
+	PredatorCount uint32 `json:"predatorCount"`
+	// Flocks scale the rule weights above for each flock. Only the first FlockCount entries are used.
+	Flocks [MaxFlocks]FlockWeights `json:"flocks"`
+	// NeighborGrid is 1 if boids find their neighbors in a uniform grid instead of comparing all pairs.
+	// It has no effect with SampleSize.
+	NeighborGrid uint32 `json:"neighborGrid"`
+	// AspectX and AspectY scale offsets in the simulation space, which is stretched over the window,
+	// to their proportions on screen, see aspectScale. Neighborhoods are circular on screen.
+	AspectX float32 `json:"aspectX"`
+	AspectY float32 `json:"aspectY"`
+	// PerceptionRadiusSq is PerceptionRadius squared, so the shader can compare squared distances.
+	// It is filled in by Bytes.
+	PerceptionRadiusSq float32 `json:"-"`
+	// SeparationRadius, AlignmentRadius and CohesionRadius are the distances within which neighbors
+	// contribute to each flocking rule.
+	SeparationRadius float32 `json:"separationRadius"`
+	AlignmentRadius  float32 `json:"alignmentRadius"`
+	CohesionRadius   float32 `json:"cohesionRadius"`
+	// Falloff weights the neighbors of alignment and cohesion by 1/distance^Falloff, so closer
+	// neighbors count more. 0 weights all neighbors equally.
+	Falloff float32 `json:"falloff"`
+	// WindX and WindY are a force that pushes every boid alike, capped at MaxForce.
+	WindX float32 `json:"windX"`
+	WindY float32 `json:"windY"`
+	// WindPeriod makes the wind oscillate, reversing its direction every half period in seconds.
+	// 0 keeps it constant.
+	WindPeriod float32 `json:"windPeriod"`
+	// Time is the simulated time in seconds, set every frame by Render.
+	Time float32 `json:"time"`
+	// Turbulence weights a swirling force that varies smoothly with the position and time, relative to
+	// MaxForce. 0 disables it.
+	Turbulence float32 `json:"turbulence"`
+	// TurbulenceScale is the spatial frequency of the turbulence, about the number of swirls per unit.
+	TurbulenceScale float32 `json:"turbulenceScale"`
+	// MinSpeed is the speed boids that slow down are sped up to, keeping their heading. It is capped at
+	// MaxSpeed, 0 lets boids come to a halt.
+	MinSpeed float32 `json:"minSpeed"`
+	// FieldOfView is the angle around its heading in degrees within which a boid sees its neighbors.
+	// 360 sees all around.
+	FieldOfView float32 `json:"fieldOfView"`
+	// FieldOfViewCos is the cosine of half the FieldOfView, filled in by Bytes. It is below -1 if boids see
+	// all around, so the shader never has to tell the two cases apart.
+	FieldOfViewCos float32 `json:"-"`
+	// MarginSize is the distance from the edges of the world within which boids steer back inwards with
+	// BoundaryMargin.
+	MarginSize float32 `json:"marginSize"`
+	// TurnForce is how strongly boids within the margin steer inwards, relative to MaxForce.
+	TurnForce float32   `json:"turnForce"`
+	_         [1]uint32 // pads the struct to the 16 byte alignment of Flocks
+}
+
+// AttractorMode is how boids react to the attractor point.
+type AttractorMode uint32
+
+// The values must match the ATTRACTOR_ constants in compute.wgsl.
+const (
+	AttractorOff AttractorMode = iota
+	AttractorAttract
+	AttractorRepel
+)
+
+// BoundaryMode is the behavior of boids at the edges of the world.
+type BoundaryMode uint32
+
+// The values must match the BOUNDARY_ constants in compute.wgsl.
+const (
+	// BoundaryWrap moves boids leaving one edge to the opposite one, making the world a torus.
+	BoundaryWrap BoundaryMode = iota
+	// BoundaryBounce reflects boids off the edges.
+	BoundaryBounce
+	// BoundaryMargin steers boids back inwards once they are within SimParams.MarginSize of an edge.
+	// Boids that reach the edge anyway stop there until they have turned around.
+	BoundaryMargin
+)
+
+// ParseBoundaryMode parses "wrap", "bounce" or "margin".
+func ParseBoundaryMode(s string) (BoundaryMode, error) {
+	switch s {
+	case "wrap":
+		return BoundaryWrap, nil
+	case "bounce":
+		return BoundaryBounce, nil
+	case "margin":
+		return BoundaryMargin, nil
+	}
+	return 0, fmt.Errorf("unknown boundary mode %q, must be wrap, bounce or margin", s)
+}
+
+// DrawParams mirrors the DrawParams uniform in draw.wgsl.
+type DrawParams struct {
+	// BoidColor is the color of all boids with ColorSolid.
+	BoidColor Color
+	ColorMode ColorMode
+	// MaxSpeed is the speed drawn in the hottest color by ColorSpeed.
+	MaxSpeed float32
+	// Aspect keeps the boids from being stretched with the window, see SimParams.AspectX.
+	Aspect [2]float32
+	// ViewCenter is the world position drawn in the center of the window, see SetView.
+	ViewCenter [2]float32
+	// ViewZoom magnifies the world around ViewCenter, 1 shows the whole world.
+	ViewZoom float32
+	// BoidSize scales the boid triangle. Boids grow when zooming in, but don't shrink when zooming out.
+	BoidSize float32
+	// Time is the simulated time, which cycles the hue of ColorRainbow. It is only updated in that mode.
+	Time float32
+	// ColorPeriod is the time in seconds the hue of ColorRainbow takes to cycle once.
+	ColorPeriod float32
+	_           [2]uint32 // Pads the struct to the 16 byte alignment of the uniform
+}
+
+// aspectScale returns the factors that scale x and y offsets in the [-1, 1] simulation space, stretched
+// over a width x height surface, to proportions on screen. The shorter side of the surface has the factor 1,
+// so distances on screen are never shorter than in the simulation space. Without a size both are 1.
+func aspectScale(width, height uint32) [2]float32 {
+	if width == 0 || height == 0 {
+		return [2]float32{1, 1}
+	}
+	if width >= height {
+		return [2]float32{float32(width) / float32(height), 1}
+	}
+	return [2]float32{1, float32(height) / float32(width)}
+}
+
+// Bytes returns the uniform buffer representation of the parameters.
+func (p DrawParams) Bytes() []byte {
+	return wgpu.ToBytes([]DrawParams{p})
+}
+
+// ColorMode is how boids are colored.
+type ColorMode uint32
+
+// The values must match the COLOR_ constants in draw.wgsl.
+const (
+	// ColorSolid draws all boids in the same color.
+	ColorSolid ColorMode = iota
+	// ColorSpeed draws slow boids blue and fast boids red.
+	ColorSpeed
+	// ColorFlock draws each flock in a different color.
+	ColorFlock
+	// ColorDensity draws isolated boids blue and crowded boids yellow, by their neighbor count.
+	ColorDensity
+	// ColorRainbow draws all boids in the same color, whose hue cycles over time.
+	ColorRainbow
+)
+
+// ParseColorMode parses "solid", "speed", "flock", "density" or "rainbow".
+func ParseColorMode(s string) (ColorMode, error) {
+	switch s {
+	case "solid":
+		return ColorSolid, nil
+	case "speed":
+		return ColorSpeed, nil
+	case "flock":
+		return ColorFlock, nil
+	case "density":
+		return ColorDensity, nil
+	case "rainbow":
+		return ColorRainbow, nil
+	}
+	return 0, fmt.Errorf("unknown color mode %q, must be solid, speed, flock, density or rainbow", s)
+}
+
+// MaxSmoothing caps SimParams.Smoothing below 1 so boids keep responding to forces.
+const MaxSmoothing = 0.95
+
+// DefaultSimParams returns the parameters the simulation uses unless configured otherwise.
+func DefaultSimParams() SimParams {
+	flocks, _ := ParseFlockWeights("", 1)
+	return SimParams{
+		DeltaTime:        1.0 / 60.0, // 60 fps
+		MaxForce:         0.1,
+		MaxSpeed:         0.5,
+		AlignmentWeight:  0.8,
+		CohesionWeight:   0.7,
+		SeparationWeight: 0.9,
+		SeparationRadius: 0.05,
+		AlignmentRadius:  0.1,
+		CohesionRadius:   0.1,
+		MaxTurnRate:      1000, // high enough to never limit turning
+		Lookahead:        0.2,
+		TurbulenceScale:  3,
+		FieldOfView:      360,
+		MarginSize:       0.1,
+		TurnForce:        1,
+		FlockCount:       1,
+		Flocks:           flocks,
+	}
+}
+
+// Bytes returns the uniform buffer representation of the parameters.
+func (p SimParams) Bytes() []byte {
+	return wgpu.ToBytes([]SimParams{p.derived()})
+}
+
+// derived returns p with the fields that are derived from others filled in.
+func (p SimParams) derived() SimParams {
+	p.PerceptionRadius = max(p.SeparationRadius, p.AlignmentRadius, p.CohesionRadius)
+	p.PerceptionRadiusSq = p.PerceptionRadius * p.PerceptionRadius
+	// Snapshots from before there was a field of view have 0, they see all around too
+	p.FieldOfViewCos = -2
+	if p.FieldOfView > 0 && p.FieldOfView < 360 {
+		p.FieldOfViewCos = float32(math.Cos(float64(p.FieldOfView) / 2 * math.Pi / 180))
+	}
+	return p
+}
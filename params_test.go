@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+	"unsafe"
+)
+
+// wgslMember is a member of a WGSL struct with its byte offset and size.
+type wgslMember struct {
+	name         string
+	offset, size uintptr
+}
+
+// wgslStruct is the memory layout of a WGSL struct in the uniform address space.
+type wgslStruct struct {
+	members     []wgslMember
+	align, size uintptr
+}
+
+var (
+	wgslStructPattern = regexp.MustCompile(`(?s)struct (\w+) \{(.*?)\n\}`)
+	wgslMemberPattern = regexp.MustCompile(`^(?:@\S+\s+)*(\w+): ([^/]+?),?\s*(?://.*)?$`)
+	wgslConstPattern  = regexp.MustCompile(`const (\w+) = (\d+)u?;`)
+	wgslArrayPattern  = regexp.MustCompile(`^array<(\w+), (\w+)>$`)
+)
+
+// wgslLayouts computes the uniform layout of the structs declared in the shader source, following the
+// alignment and size rules of the WGSL spec for the types the shaders use.
+func wgslLayouts(t *testing.T, source string) map[string]wgslStruct {
+	t.Helper()
+	consts := map[string]uintptr{}
+	for _, m := range wgslConstPattern.FindAllStringSubmatch(source, -1) {
+		n, _ := strconv.ParseUint(m[2], 10, 64)
+		consts[m[1]] = uintptr(n)
+	}
+	structs := map[string]wgslStruct{}
+	// alignSize returns the alignment and size of a type in the uniform address space
+	var alignSize func(typ string) (uintptr, uintptr)
+	alignSize = func(typ string) (uintptr, uintptr) {
+		switch typ {
+		case "f32", "u32", "i32":
+			return 4, 4
+		case "vec2<f32>", "vec2<u32>":
+			return 8, 8
+		case "vec3<f32>":
+			return 16, 12
+		case "vec4<f32>":
+			return 16, 16
+		}
+		if m := wgslArrayPattern.FindStringSubmatch(typ); m != nil {
+			align, size := alignSize(m[1])
+			n, ok := consts[m[2]]
+			if !ok {
+				t.Fatalf("unknown array length %s", m[2])
+			}
+			// Arrays in uniforms have a stride and alignment of a multiple of 16 bytes
+			align = roundUp(16, align)
+			return align, n * roundUp(align, size)
+		}
+		s, ok := structs[typ]
+		if !ok {
+			t.Fatalf("unsupported WGSL type %s", typ)
+		}
+		return s.align, s.size
+	}
+	for _, m := range wgslStructPattern.FindAllStringSubmatch(source, -1) {
+		var s wgslStruct
+		var end uintptr
+		for _, line := range strings.Split(m[2], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "//") {
+				continue
+			}
+			member := wgslMemberPattern.FindStringSubmatch(line)
+			if member == nil {
+				t.Fatalf("failed to parse member %q of struct %s", line, m[1])
+			}
+			align, size := alignSize(member[2])
+			offset := roundUp(align, end)
+			s.members = append(s.members, wgslMember{name: member[1], offset: offset, size: size})
+			s.align = max(s.align, align)
+			end = offset + size
+		}
+		// Structs in uniforms are aligned to 16 bytes
+		s.align = roundUp(16, s.align)
+		s.size = roundUp(s.align, end)
+		structs[m[1]] = s
+	}
+	return structs
+}
+
+// roundUp rounds n up to a multiple of k.
+func roundUp(k, n uintptr) uintptr {
+	return (n + k - 1) / k * k
+}
+
+// wgslName is the name of the shader struct member corresponding to the Go field name.
+func wgslName(field string) string {
+	r := []rune(field)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+func TestSimParamsMatchesShaderLayout(t *testing.T) {
+	layout, ok := wgslLayouts(t, compute)["SimParams"]
+	if !ok {
+		t.Fatal("compute.wgsl declares no SimParams struct")
+	}
+	if size := unsafe.Sizeof(SimParams{}); size != layout.size {
+		t.Errorf("SimParams is %d bytes, the shader expects %d", size, layout.size)
+	}
+	if size := uintptr(len(DefaultSimParams().Bytes())); size != layout.size {
+		t.Errorf("uploaded SimParams are %d bytes, the shader expects %d", size, layout.size)
+	}
+
+	// The offsets of reflect are those of unsafe.Offsetof
+	typ := reflect.TypeOf(SimParams{})
+	var fields []reflect.StructField
+	for i := range typ.NumField() {
+		if f := typ.Field(i); f.Name != "_" {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) != len(layout.members) {
+		t.Errorf("SimParams has %d fields, the shader struct %d members", len(fields), len(layout.members))
+	}
+	for i, member := range layout.members[:min(len(fields), len(layout.members))] {
+		f := fields[i]
+		if wgslName(f.Name) != member.name || f.Offset != member.offset || f.Type.Size() != member.size {
+			t.Errorf("field %d is %s at offset %d with %d bytes, the shader expects %s at offset %d with %d bytes",
+				i, f.Name, f.Offset, f.Type.Size(), member.name, member.offset, member.size)
+		}
+	}
+}
+
+func TestSimParamsUploadsPerceptionRadiusSquared(t *testing.T) {
+	p := DefaultSimParams()
+	p.SeparationRadius, p.AlignmentRadius, p.CohesionRadius = 0.02, 0.05, 0.03
+	data := p.Bytes()
+	offset := -1
+	for _, member := range wgslLayouts(t, compute)["SimParams"].members {
+		if member.name == "perceptionRadiusSq" {
+			offset = int(member.offset)
+		}
+	}
+	if offset < 0 {
+		t.Fatal("the shader's SimParams have no perceptionRadiusSq")
+	}
+	got := math.Float32frombits(binary.LittleEndian.Uint32(data[offset:]))
+	if want := float32(0.05) * float32(0.05); got != want {
+		t.Errorf("got perceptionRadiusSq %v, want the largest radius squared %v", got, want)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"math"
+	"math/rand"
+)
+
+// Supported initial speed distributions.
+const (
+	SpeedConstant = "constant"
+	SpeedUniform  = "uniform"
+	SpeedNormal   = "normal"
+)
+
+// Supported initial layouts of the boids.
+const (
+	LayoutUniform = "uniform" // uniformly random in the square or cube
+	LayoutCircle  = "circle"  // evenly spaced on a ring around the center
+	LayoutGrid    = "grid"    // on a regular grid filling the square or cube
+	LayoutCluster = "cluster" // in a tight blob around the center
+)
+
+const (
+	// circleRadius is the radius of the ring of LayoutCircle.
+	circleRadius = 0.6
+	// clusterStdDev is the standard deviation of the positions of LayoutCluster from the center.
+	clusterStdDev = 0.05
+)
+
+// SpeedDistribution describes how the initial speeds of the boids are chosen.
+type SpeedDistribution struct {
+	// Kind is one of SpeedConstant, SpeedUniform or SpeedNormal.
+	Kind string `json:"kind"`
+	// Speed is the speed of every boid for SpeedConstant and the mean speed for SpeedNormal.
+	Speed float32 `json:"speed"`
+	// Min and Max bound the speeds for SpeedUniform.
+	Min float32 `json:"min"`
+	Max float32 `json:"max"`
+	// StdDev is the standard deviation for SpeedNormal.
+	StdDev float32 `json:"stdDev"`
+}
+
+// Validate checks that the distribution can only produce non-negative speeds.
+func (d SpeedDistribution) Validate() error {
+	switch d.Kind {
+	case SpeedConstant, SpeedNormal:
+		if d.Speed < 0 {
+			return fmt.Errorf("speed must not be negative, got %g", d.Speed)
+		}
+		if d.StdDev < 0 {
+			return fmt.Errorf("speed standard deviation must not be negative, got %g", d.StdDev)
+		}
+	case SpeedUniform:
+		if d.Min < 0 {
+			return fmt.Errorf("minimum speed must not be negative, got %g", d.Min)
+		}
+		if d.Max < d.Min {
+			return fmt.Errorf("maximum speed %g is less than minimum speed %g", d.Max, d.Min)
+		}
+	default:
+		return fmt.Errorf("unknown speed distribution %q, must be %s, %s or %s", d.Kind, SpeedConstant, SpeedUniform, SpeedNormal)
+	}
+	return nil
+}
+
+// sample draws a speed from the distribution. Negative samples of the normal distribution are clamped to 0.
+func (d SpeedDistribution) sample(rng *rand.Rand) float32 {
+	switch d.Kind {
+	case SpeedUniform:
+		return d.Min + float32(rng.Int63())/math.MaxInt64*(d.Max-d.Min)
+	case SpeedNormal:
+		return max(0, d.Speed+float32(rng.NormFloat64())*d.StdDev)
+	default:
+		return d.Speed
+	}
+}
+
+// generateInitialParticles places n boids in the [-1, 1] square, or cube if threeD is set, in the given layout,
+// moving in random directions with speeds drawn from speeds. The maximum speed and force of each boid deviate
+// from those of the simulation by a uniformly random fraction of at most speedVariance, see boid.Boid.SpeedJitter.
+// The first predators boids are predators.
+// The others are assigned to the flocks in turn, so every prefix of the particles, as simulated with
+// fewer active particles, mixes all flocks.
+func generateInitialParticles(rng *rand.Rand, n int, layout string, speeds SpeedDistribution, speedVariance float32, threeD bool, flocks, predators uint32) []float32 {
+	particles := make([]float32, boid.Stride*n)
+	// Uniform positions are drawn in between the velocities, as they always were, so a seed keeps placing
+	// the boids where it did before there were layouts
+	uniform := layout != LayoutCircle && layout != LayoutGrid && layout != LayoutCluster
+	for i := 0; i < len(particles); i += boid.Stride {
+		if uniform {
+			particles[i+0] = float32(rng.Int63())/math.MaxInt64*2 - 1 // position x
+			particles[i+1] = float32(rng.Int63())/math.MaxInt64*2 - 1 // position y
+		} else {
+			pos := layoutPosition(rng, layout, i/boid.Stride, n, threeD)
+			particles[i+0], particles[i+1], particles[i+2] = pos.X, pos.Y, pos.Z
+		}
+
+		// Random velocity direction
+		angle := float32(rng.Int63()) / math.MaxInt64 * 2 * math.Pi
+		speed := speeds.sample(rng)
+		// Elevation of the direction above the xy-plane, 0 in 2D
+		elevation := 0.0
+		if threeD {
+			if uniform {
+				particles[i+2] = float32(rng.Int63())/math.MaxInt64*2 - 1 // position z
+			}
+			// Uniform on the sphere: the sine of the elevation is uniform in [-1, 1]
+			elevation = math.Asin(rng.Float64()*2 - 1)
+		}
+		horizontal := speed * float32(math.Cos(elevation))
+		particles[i+4] = horizontal * float32(math.Cos(float64(angle))) // velocity x
+		particles[i+5] = horizontal * float32(math.Sin(float64(angle))) // velocity y
+		particles[i+6] = speed * float32(math.Sin(elevation))           // velocity z
+		if index := uint32(i / boid.Stride); index < predators {
+			particles[i+9] = 1 // predator
+		} else {
+			particles[i+8] = float32((index - predators) % flocks) // flock
+		}
+		// Drawn last and only if needed, so the other values stay those of the same seed without variance
+		if speedVariance > 0 {
+			particles[i+10] = (rng.Float32()*2 - 1) * speedVariance // speed jitter
+		}
+	}
+	return particles
+}
+
+// layoutPosition returns the position of boid index of n in LayoutCircle, LayoutGrid or LayoutCluster.
+// The ring of LayoutCircle lies in the xy-plane, the others fill the cube if threeD is set.
+func layoutPosition(rng *rand.Rand, layout string, index, n int, threeD bool) boid.Vec3 {
+	switch layout {
+	case LayoutCircle:
+		angle := 2 * math.Pi * float64(index) / float64(n)
+		return boid.Vec3{X: circleRadius * float32(math.Cos(angle)), Y: circleRadius * float32(math.Sin(angle))}
+	case LayoutGrid:
+		// Boids sit in the centers of side^2 or side^3 cells, filled row by row
+		side := int(math.Ceil(math.Sqrt(float64(n))))
+		if threeD {
+			side = int(math.Ceil(math.Cbrt(float64(n))))
+		}
+		cell := func(k int) float32 {
+			return (float32(k%side)+0.5)/float32(side)*2 - 1
+		}
+		pos := boid.Vec3{X: cell(index), Y: cell(index / side)}
+		if threeD {
+			pos.Z = cell(index / (side * side))
+		}
+		return pos
+	default:
+		coordinate := func() float32 {
+			return float32(min(max(rng.NormFloat64()*clusterStdDev, -1), 1))
+		}
+		pos := boid.Vec3{X: coordinate(), Y: coordinate()}
+		if threeD {
+			pos.Z = coordinate()
+		}
+		return pos
+	}
+}
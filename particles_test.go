@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/brodo/goBoids/boid"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// initialSpeeds generates n boids with speeds drawn from speeds and returns their speeds.
+func initialSpeeds(t *testing.T, n int, speeds SpeedDistribution, threeD bool) []float32 {
+	t.Helper()
+	boids, err := boid.Boids(generateInitialParticles(rand.New(rand.NewSource(1)), n, LayoutUniform, speeds, 0, threeD, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]float32, len(boids))
+	for i, b := range boids {
+		result[i] = b.Vel.Len()
+	}
+	return result
+}
+
+func TestInitialSpeedsUniform(t *testing.T) {
+	speeds := SpeedDistribution{Kind: SpeedUniform, Min: 0.05, Max: 0.2}
+	for _, threeD := range []bool{false, true} {
+		got := initialSpeeds(t, 10000, speeds, threeD)
+		lowest, highest := got[0], got[0]
+		for _, speed := range got {
+			lowest, highest = min(lowest, speed), max(highest, speed)
+		}
+		// The speeds are recomputed from the velocity components, which rounds them slightly
+		const tolerance = 1e-6
+		if lowest < speeds.Min-tolerance || highest > speeds.Max+tolerance {
+			t.Errorf("3D %v: got speeds in [%v, %v], want them in [%v, %v]", threeD, lowest, highest, speeds.Min, speeds.Max)
+		}
+		// They also cover the range
+		if lowest > speeds.Min+0.01 || highest < speeds.Max-0.01 {
+			t.Errorf("3D %v: got speeds in [%v, %v], want them to cover [%v, %v]", threeD, lowest, highest, speeds.Min, speeds.Max)
+		}
+	}
+}
+
+func TestInitialSpeedsConstant(t *testing.T) {
+	for _, speed := range initialSpeeds(t, 100, SpeedDistribution{Kind: SpeedConstant, Speed: 0.1}, true) {
+		if math.Abs(float64(speed)-0.1) > 1e-6 {
+			t.Fatalf("got speed %v, want 0.1", speed)
+		}
+	}
+}
+
+func TestInitialSpeedsNormal(t *testing.T) {
+	got := initialSpeeds(t, 10000, SpeedDistribution{Kind: SpeedNormal, Speed: 0.1, StdDev: 0.05}, false)
+	var sum float64
+	for _, speed := range got {
+		if speed < 0 {
+			t.Fatalf("got negative speed %v", speed)
+		}
+		sum += float64(speed)
+	}
+	// Clamping the few negative samples to 0 barely moves the mean
+	if mean := sum / float64(len(got)); math.Abs(mean-0.1) > 0.005 {
+		t.Errorf("got mean speed %v, want about 0.1", mean)
+	}
+}
+
+func TestSpeedDistributionValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		speeds SpeedDistribution
+		valid  bool
+	}{
+		{"default", DefaultConfig().Speeds, true},
+		{"constant", SpeedDistribution{Kind: SpeedConstant, Speed: 0.1}, true},
+		{"negative constant", SpeedDistribution{Kind: SpeedConstant, Speed: -0.1}, false},
+		{"uniform", SpeedDistribution{Kind: SpeedUniform, Min: 0, Max: 0.2}, true},
+		{"negative minimum", SpeedDistribution{Kind: SpeedUniform, Min: -0.1, Max: 0.2}, false},
+		{"maximum below minimum", SpeedDistribution{Kind: SpeedUniform, Min: 0.2, Max: 0.1}, false},
+		{"normal", SpeedDistribution{Kind: SpeedNormal, Speed: 0.1, StdDev: 0.02}, true},
+		{"negative standard deviation", SpeedDistribution{Kind: SpeedNormal, Speed: 0.1, StdDev: -0.02}, false},
+		{"unknown kind", SpeedDistribution{Kind: "exponential", Speed: 0.1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.speeds.Validate()
+			if valid := err == nil; valid != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+)
+
+// pickFormat is the format of the pick texture, which holds the index + 1 of the boid drawn at each pixel.
+const pickFormat = wgpu.TextureFormatR32Uint
+
+// pickRowPitch is the smallest bytesPerRow allowed for texture to buffer copies.
+const pickRowPitch = 256
+
+// PickBoid returns the index of the boid drawn at pixel (x, y) of the surface, or -1 if there is none.
+// It draws all boids with their index into an off-screen texture and reads back the single pixel.
+func (s *State) PickBoid(x, y int) (int, error) {
+	if x < 0 || y < 0 || x >= int(s.config.Width) || y >= int(s.config.Height) {
+		return -1, nil
+	}
+
+	texture, err := s.device.CreateTexture(&wgpu.TextureDescriptor{
+		Label: "Pick Texture",
+		Size: wgpu.Extent3D{
+			Width:              s.config.Width,
+			Height:             s.config.Height,
+			DepthOrArrayLayers: 1,
+		},
+		MipLevelCount: 1,
+		SampleCount:   1,
+		Dimension:     wgpu.TextureDimension2D,
+		Format:        pickFormat,
+		Usage:         wgpu.TextureUsageRenderAttachment | wgpu.TextureUsageCopySrc,
+	})
+	if err != nil {
+		return -1, fmt.Errorf("failed to create pick texture: %w", err)
+	}
+	defer texture.Release()
+	view, err := texture.CreateView(nil)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create pick texture view: %w", err)
+	}
+	defer view.Release()
+
+	buffer, err := s.device.CreateBuffer(&wgpu.BufferDescriptor{
+		Label: "Pick Buffer",
+		Size:  pickRowPitch,
+		Usage: wgpu.BufferUsageMapRead | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return -1, fmt.Errorf("failed to create pick buffer: %w", err)
+	}
+	defer buffer.Release()
+
+	commandEncoder, err := s.device.CreateCommandEncoder(nil)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create command encoder: %w", err)
+	}
+	defer commandEncoder.Release()
+
+	// The background stays 0, which is no boid
+	renderPass := commandEncoder.BeginRenderPass(&wgpu.RenderPassDescriptor{
+		ColorAttachments: []wgpu.RenderPassColorAttachment{
+			{
+				View:    view,
+				LoadOp:  wgpu.LoadOpClear,
+				StoreOp: wgpu.StoreOpStore,
+			},
+		},
+	})
+	renderPass.SetPipeline(s.pickPipeline)
+	renderPass.SetBindGroup(0, s.pickBindGroup, nil)
+	renderPass.SetVertexBuffer(0, s.particleBuffer, 0, wgpu.WholeSize)
+	renderPass.SetVertexBuffer(1, s.vertexBuffer, 0, wgpu.WholeSize)
+	renderPass.Draw(s.vertexCount, s.particleCount, 0, 0)
+	err = renderPass.End()
+	if err != nil {
+		return -1, fmt.Errorf("failed to complete pick pass: %w", err)
+	}
+	renderPass.Release()
+
+	err = commandEncoder.CopyTextureToBuffer(
+		&wgpu.ImageCopyTexture{
+			Texture: texture,
+			Origin:  wgpu.Origin3D{X: uint32(x), Y: uint32(y)},
+			Aspect:  wgpu.TextureAspectAll,
+		},
+		&wgpu.ImageCopyBuffer{
+			Buffer: buffer,
+			Layout: wgpu.TextureDataLayout{BytesPerRow: pickRowPitch, RowsPerImage: 1},
+		},
+		&wgpu.Extent3D{Width: 1, Height: 1, DepthOrArrayLayers: 1},
+	)
+	if err != nil {
+		return -1, fmt.Errorf("failed to copy pick pixel: %w", err)
+	}
+	cmdBuffer, err := commandEncoder.Finish(nil)
+	if err != nil {
+		return -1, fmt.Errorf("failed to finish command buffer: %w", err)
+	}
+	defer cmdBuffer.Release()
+	s.queue.Submit(cmdBuffer)
+
+	data, err := s.mapRead(buffer, 4)
+	if err != nil {
+		return -1, err
+	}
+	return int(binary.LittleEndian.Uint32(data)) - 1, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/brodo/goBoids/stream"
+	"io"
+	"time"
+)
+
+// ReplayFrames plays back a recording made with -record, sending each frame into the returned channel
+// at the time it was recorded relative to the first frame. Like with SubscribeFrames, only the newest
+// frame is kept in the channel. The last frame stays on screen after the replay has finished.
+// The returned function stops the replay and closes the recording.
+func ReplayFrames(path string) (<-chan []float32, func(), error) {
+	recording, err := stream.OpenRecording(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	frames := make(chan []float32, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var start, first time.Time
+		for {
+			boids, recorded, err := recording.Next()
+			if errors.Is(err, io.EOF) {
+				fmt.Println("replay finished")
+				return
+			}
+			if err != nil {
+				fmt.Println("stopping replay:", err)
+				return
+			}
+
+			if start.IsZero() {
+				start, first = time.Now(), recorded
+			}
+			select {
+			case <-time.After(time.Until(start.Add(recorded.Sub(first)))):
+			case <-stop:
+				return
+			}
+
+			// Replace a frame that hasn't been rendered yet with the newer one
+			select {
+			case <-frames:
+			default:
+			}
+			frames <- boid.FlattenBoids(boids)
+		}
+	}()
+
+	return frames, func() {
+		close(stop)
+		<-done
+		err := recording.Close()
+		if err != nil {
+			fmt.Printf("failed to close recording: %v\n", err)
+		}
+	}, nil
+}
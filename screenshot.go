@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// screenshotRowAlignment is the alignment of bytesPerRow required for texture to buffer copies.
+const screenshotRowAlignment = 256
+
+// SaveScreenshot saves the current frame as a PNG named after the current time in the working directory.
+// It returns the file name. The simulation does not advance.
+func (s *State) SaveScreenshot() (string, error) {
+	img, err := s.captureFrame()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("boids-%s.png", time.Now().Format("20060102-150405.000"))
+	return name, writePNG(name, img)
+}
+
+// ExportFrames simulates n frames at the fixed time step, as fast as the GPU allows, and writes each
+// as a numbered PNG to dir, which is created if needed. It stops early once ctx is done.
+func (s *State) ExportFrames(ctx context.Context, n uint32, dir string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create frames directory: %w", err)
+	}
+	for i := range n {
+		if ctx.Err() != nil {
+			fmt.Printf("interrupted after %d of %d frames\n", i, n)
+			return nil
+		}
+		// Render advances the simulation, captureFrame draws its result
+		err = s.Render()
+		if err != nil {
+			return err
+		}
+		img, err := s.captureFrame()
+		if err != nil {
+			return err
+		}
+		// Numbered so that ffmpeg -i frame-%06d.png picks them up in order
+		err = writePNG(filepath.Join(dir, fmt.Sprintf("frame-%06d.png", i)), img)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("wrote %d frames to %s\n", n, dir)
+	return nil
+}
+
+// captureFrame draws the current frame into an off-screen texture with the surface format and reads it back.
+func (s *State) captureFrame() (*image.NRGBA, error) {
+	// Only 8-bit RGBA and BGRA surfaces are supported, which covers the formats surfaces prefer
+	swapRedBlue := false
+	switch s.config.Format {
+	case wgpu.TextureFormatRGBA8Unorm, wgpu.TextureFormatRGBA8UnormSrgb:
+	case wgpu.TextureFormatBGRA8Unorm, wgpu.TextureFormatBGRA8UnormSrgb:
+		swapRedBlue = true
+	default:
+		return nil, fmt.Errorf("screenshots of surface format %s are not supported", s.config.Format)
+	}
+
+	width, height := s.config.Width, s.config.Height
+	texture, err := s.device.CreateTexture(&wgpu.TextureDescriptor{
+		Label: "Screenshot Texture",
+		Size: wgpu.Extent3D{
+			Width:              width,
+			Height:             height,
+			DepthOrArrayLayers: 1,
+		},
+		MipLevelCount: 1,
+		SampleCount:   1,
+		Dimension:     wgpu.TextureDimension2D,
+		Format:        s.config.Format,
+		Usage:         wgpu.TextureUsageRenderAttachment | wgpu.TextureUsageCopySrc,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create screenshot texture: %w", err)
+	}
+	defer texture.Release()
+	view, err := texture.CreateView(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create screenshot texture view: %w", err)
+	}
+	defer view.Release()
+
+	// Rows are padded to the copy alignment in the buffer
+	rowPitch := (width*4 + screenshotRowAlignment - 1) / screenshotRowAlignment * screenshotRowAlignment
+	size := uint64(rowPitch) * uint64(height)
+	buffer, err := s.device.CreateBuffer(&wgpu.BufferDescriptor{
+		Label: "Screenshot Buffer",
+		Size:  size,
+		Usage: wgpu.BufferUsageMapRead | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create screenshot buffer: %w", err)
+	}
+	defer buffer.Release()
+
+	commandEncoder, err := s.device.CreateCommandEncoder(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create command encoder: %w", err)
+	}
+	defer commandEncoder.Release()
+
+	err = s.draw(commandEncoder, view)
+	if err != nil {
+		return nil, err
+	}
+	err = commandEncoder.CopyTextureToBuffer(
+		&wgpu.ImageCopyTexture{
+			Texture: texture,
+			Aspect:  wgpu.TextureAspectAll,
+		},
+		&wgpu.ImageCopyBuffer{
+			Buffer: buffer,
+			Layout: wgpu.TextureDataLayout{BytesPerRow: rowPitch, RowsPerImage: height},
+		},
+		&wgpu.Extent3D{Width: width, Height: height, DepthOrArrayLayers: 1},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy screenshot: %w", err)
+	}
+	cmdBuffer, err := commandEncoder.Finish(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finish command buffer: %w", err)
+	}
+	defer cmdBuffer.Release()
+	s.queue.Submit(cmdBuffer)
+
+	data, err := s.mapRead(buffer, size)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	for y := 0; y < int(height); y++ {
+		row := data[y*int(rowPitch):][:width*4]
+		pixels := img.Pix[y*img.Stride:][:width*4]
+		copy(pixels, row)
+		for x := 0; x < len(pixels); x += 4 {
+			if swapRedBlue {
+				pixels[x], pixels[x+2] = pixels[x+2], pixels[x]
+			}
+			// The surface may be transparent, the screenshot shows what the window shows
+			pixels[x+3] = 255
+		}
+	}
+
+	return img, nil
+}
+
+// writePNG encodes img as a PNG file at path.
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// shaderFiles are the shaders -watch-shaders reads from the working directory instead of the embedded copies:
+// the compute.wgsl template and draw.wgsl.
+var shaderFiles = [2]string{"compute.wgsl", "draw.wgsl"}
+
+// readShaders reads the shaderFiles from the working directory.
+func readShaders() (computeSource, drawSource string, err error) {
+	var sources [len(shaderFiles)]string
+	for i, name := range shaderFiles {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read shader: %w", err)
+		}
+		sources[i] = string(data)
+	}
+	return sources[0], sources[1], nil
+}
+
+// ShaderWatcher reloads the pipelines of a State when one of the shaderFiles changes. It is notified of
+// changes in the background, but only reloads from the render loop, so pipelines are only ever replaced
+// between frames.
+type ShaderWatcher struct {
+	watcher *fsnotify.Watcher
+}
+
+// NewShaderWatcher returns a ShaderWatcher for shaders read by readShaders just before.
+func NewShaderWatcher() (*ShaderWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch shaders: %w", err)
+	}
+	// Editors that save by replacing the file would end a watch on the file itself, so its directory is watched
+	err = watcher.Add(".")
+	if err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch shaders: %w", err)
+	}
+	return &ShaderWatcher{watcher: watcher}, nil
+}
+
+// changed reports whether one of the shaderFiles was written or created since the last call, without waiting.
+func (w *ShaderWatcher) changed() bool {
+	changed := false
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return changed
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 && slices.Contains(shaderFiles[:], filepath.Base(event.Name)) {
+				changed = true
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return changed
+			}
+			fmt.Println("failed to watch shaders:", err)
+		default:
+			return changed
+		}
+	}
+}
+
+// Poll reloads the shaders of s if a file changed since the last reload. Errors are printed and the previous
+// pipelines stay in use until the shaders are fixed. A nil watcher does nothing.
+func (w *ShaderWatcher) Poll(s *State) {
+	if w == nil || !w.changed() {
+		return
+	}
+	computeSource, drawSource, err := readShaders()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = s.ReloadShaders(computeSource, drawSource)
+	if err != nil {
+		fmt.Println("failed to reload shaders, keeping the previous ones:", err)
+		return
+	}
+	fmt.Println("shaders reloaded")
+}
+
+// Close stops watching the shaders. A nil watcher does nothing.
+func (w *ShaderWatcher) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.watcher.Close()
+}
+
+// ReloadShaders recreates the pipelines and their bind groups from new shader sources. If they don't compile,
+// the previous pipelines stay in use and the error is returned. Trails drawn so far are lost.
+func (s *State) ReloadShaders(computeSource, drawSource string) error {
+	// The pipelines are created on a copy of s without any, so a failure leaves those of s untouched
+	next := *s
+	next.swapPipelines(&State{})
+	next.computeSource, next.drawSource = computeSource, drawSource
+	err := next.createPipelines(s.computePipeline != nil)
+	if err == nil {
+		err = next.createBindGroups()
+	}
+	if err == nil {
+		s.swapPipelines(&next)
+		s.computeSource, s.drawSource = computeSource, drawSource
+	}
+	next.releasePipelines()
+	return err
+}
+
+// swapPipelines swaps the pipelines, their bind groups and the trail texture of s and other.
+func (s *State) swapPipelines(other *State) {
+	s.renderPipeline, other.renderPipeline = other.renderPipeline, s.renderPipeline
+	s.pickPipeline, other.pickPipeline = other.pickPipeline, s.pickPipeline
+	s.fadePipeline, other.fadePipeline = other.fadePipeline, s.fadePipeline
+	s.trailBoidPipeline, other.trailBoidPipeline = other.trailBoidPipeline, s.trailBoidPipeline
+	s.compositePipeline, other.compositePipeline = other.compositePipeline, s.compositePipeline
+	s.computePipeline, other.computePipeline = other.computePipeline, s.computePipeline
+	s.gridClearPipeline, other.gridClearPipeline = other.gridClearPipeline, s.gridClearPipeline
+	s.gridCountPipeline, other.gridCountPipeline = other.gridCountPipeline, s.gridCountPipeline
+	s.gridScanPipeline, other.gridScanPipeline = other.gridScanPipeline, s.gridScanPipeline
+	s.gridScatterPipeline, other.gridScatterPipeline = other.gridScatterPipeline, s.gridScatterPipeline
+	s.drawBindGroup, other.drawBindGroup = other.drawBindGroup, s.drawBindGroup
+	s.pickBindGroup, other.pickBindGroup = other.pickBindGroup, s.pickBindGroup
+	s.particleBindGroup, other.particleBindGroup = other.particleBindGroup, s.particleBindGroup
+	s.trailDrawBindGroup, other.trailDrawBindGroup = other.trailDrawBindGroup, s.trailDrawBindGroup
+	s.trailBindGroup, other.trailBindGroup = other.trailBindGroup, s.trailBindGroup
+	s.trailTexture, other.trailTexture = other.trailTexture, s.trailTexture
+	s.trailView, other.trailView = other.trailView, s.trailView
+}
+
+// releasePipelines releases the pipelines created by createPipelines and the bind groups of createBindGroups.
+func (s *State) releasePipelines() {
+	s.releaseTrails()
+	for _, group := range []**wgpu.BindGroup{&s.drawBindGroup, &s.pickBindGroup, &s.particleBindGroup} {
+		if *group != nil {
+			(*group).Release()
+			*group = nil
+		}
+	}
+	for _, pipeline := range []**wgpu.RenderPipeline{&s.renderPipeline, &s.pickPipeline} {
+		if *pipeline != nil {
+			(*pipeline).Release()
+			*pipeline = nil
+		}
+	}
+	for _, pipeline := range []**wgpu.ComputePipeline{&s.computePipeline, &s.gridClearPipeline, &s.gridCountPipeline, &s.gridScanPipeline, &s.gridScatterPipeline} {
+		if *pipeline != nil {
+			(*pipeline).Release()
+			*pipeline = nil
+		}
+	}
+}
+
+// shaderLocation matches the position naga reports WGSL errors at, e.g. "┌─ wgsl:12:5" for line 12, column 5.
+var shaderLocation = regexp.MustCompile(`wgsl:(\d+):(\d+)`)
+
+// shaderError turns an error creating the shader module label from source into "label: error at line N: message",
+// followed by the offending line of source and a caret under the column. Errors without a position in source
+// are only prefixed with the label.
+func shaderError(label, source string, err error) error {
+	text := err.Error()
+	m := shaderLocation.FindStringSubmatch(text)
+	if m == nil {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	line, _ := strconv.Atoi(m[1])
+	column, _ := strconv.Atoi(m[2])
+	lines := strings.Split(source, "\n")
+	if line < 1 || line > len(lines) {
+		return fmt.Errorf("%s: %w", label, err)
+	}
+	code := strings.TrimRight(lines[line-1], "\r")
+	// The caret keeps the tabs of the line, so it lines up however wide they are shown
+	indent := []rune(code)[:min(max(column-1, 0), len([]rune(code)))]
+	for i, r := range indent {
+		if r != '\t' {
+			indent[i] = ' '
+		}
+	}
+	return fmt.Errorf("%s: error at line %d: %s\n%5d | %s\n      | %s^", label, line, shaderMessage(text), line, code, string(indent))
+}
+
+// shaderMessage extracts the message from the report of a WGSL error, which the driver wraps in the call that
+// failed and naga follows with the source around the error.
+func shaderMessage(text string) string {
+	for _, l := range strings.Split(text, "\n") {
+		if _, message, found := strings.Cut(l, "error: "); found {
+			return strings.TrimSpace(message)
+		}
+	}
+	message, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return message
+}
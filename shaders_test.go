@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// waitForChange waits up to a second for w to notice a change to the shaders.
+func waitForChange(w *ShaderWatcher) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if w.changed() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestShaderWatcherNoticesChanges(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range shaderFiles {
+		err := os.WriteFile(name, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := NewShaderWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	err = os.WriteFile("notes.txt", []byte("not a shader"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waitForChange(w) {
+		t.Error("change of another file reloads the shaders")
+	}
+
+	err = os.WriteFile("draw.wgsl", []byte("// changed"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitForChange(w) {
+		t.Fatal("change of draw.wgsl not noticed")
+	}
+
+	// Saving by replacing the file is noticed too
+	err = os.WriteFile("compute.wgsl.tmp", []byte("// changed"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if waitForChange(w) {
+		t.Error("change of a temporary file reloads the shaders")
+	}
+	err = os.Rename("compute.wgsl.tmp", "compute.wgsl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitForChange(w) {
+		t.Error("replacement of compute.wgsl not noticed")
+	}
+}
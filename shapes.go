@@ -0,0 +1,28 @@
+package main
+
+// Boid shapes selected by -boid-shape.
+const (
+	ShapeTriangle = "triangle"
+	ShapeArrow    = "arrow"
+	ShapeFish     = "fish"
+)
+
+// boidShapes are the meshes of the boid shapes as triangle lists of x, y vertex positions, at a boid size of 1.
+// They point along +y, boid_position in draw.wgsl turns +y into the heading.
+var boidShapes = map[string][]float32{
+	ShapeTriangle: {
+		-0.0025, -0.005, 0.0025, -0.005, 0.001, 0.0025,
+	},
+	// A head on a shaft
+	ShapeArrow: {
+		-0.003, 0, 0.003, 0, 0, 0.005,
+		-0.001, -0.005, 0.001, -0.005, 0.001, 0,
+		-0.001, -0.005, 0.001, 0, -0.001, 0,
+	},
+	// A body in two halves and a tail fin
+	ShapeFish: {
+		0, 0.005, -0.002, 0.0005, 0, -0.002,
+		0, 0.005, 0, -0.002, 0.002, 0.0005,
+		0, -0.002, -0.002, -0.005, 0.002, -0.005,
+	},
+}
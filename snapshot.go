@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/cogentcore/webgpu/wgpu"
+	"os"
+)
+
+// snapshotVersion is bumped whenever the snapshot layout or SimParams changes incompatibly.
+const snapshotVersion = 5
+
+// snapshot is a lossless copy of the simulation state that can be restored later.
+type snapshot struct {
+	Version      int       `json:"version"`
+	NumParticles int       `json:"numParticles"`
+	Params       SimParams `json:"params"`
+	Particles    []float32 `json:"particles"`
+}
+
+// SaveState reads back the particle buffer and writes it, together with the simulation parameters, to path.
+func (s *State) SaveState(path string) error {
+	particles, err := s.readParticleBuffer()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot{
+		Version:      snapshotVersion,
+		NumParticles: int(s.numParticles),
+		Params:       s.params,
+		Particles:    particles,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// LoadState restores a snapshot written by SaveState, uploading its particles and parameters to the GPU.
+func (s *State) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, expected %d", snap.Version, snapshotVersion)
+	}
+	if snap.NumParticles != int(s.numParticles) {
+		return fmt.Errorf("snapshot contains %d particles, but the simulation runs with %d", snap.NumParticles, s.numParticles)
+	}
+	if len(snap.Particles) != boid.Stride*snap.NumParticles {
+		return fmt.Errorf("snapshot particle data has %d values, expected %d", len(snap.Particles), boid.Stride*snap.NumParticles)
+	}
+
+	err = s.queue.WriteBuffer(s.particleBuffer, 0, wgpu.ToBytes(snap.Particles))
+	if err != nil {
+		return fmt.Errorf("failed to upload particles: %w", err)
+	}
+	snap.Params.ObstacleCount = s.params.ObstacleCount
+	snap.Params.ParticleCount = s.params.ParticleCount
+	snap.Params.AspectX, snap.Params.AspectY = s.params.AspectX, s.params.AspectY
+	err = s.queue.WriteBuffer(s.simParamBuffer, 0, snap.Params.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to upload simulation parameters: %w", err)
+	}
+	s.params = snap.Params
+	s.simTime = snap.Params.Time
+
+	// The speed colors are relative to the maximum speed, which may have changed
+	s.drawParams.MaxSpeed = s.params.MaxSpeed
+	err = s.queue.WriteBuffer(s.drawParamBuffer, 0, s.drawParams.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to upload draw parameters: %w", err)
+	}
+	return nil
+}
+
+// readParticleBuffer copies the particle buffer into a temporary buffer and blocks until it can be read.
+func (s *State) readParticleBuffer() ([]float32, error) {
+	size := s.particleBufferSize()
+
+	buffer, err := s.device.CreateBuffer(&wgpu.BufferDescriptor{
+		Label: "Snapshot Buffer",
+		Size:  size,
+		Usage: wgpu.BufferUsageMapRead | wgpu.BufferUsageCopyDst,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot buffer: %w", err)
+	}
+	defer buffer.Release()
+
+	commandEncoder, err := s.device.CreateCommandEncoder(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create command encoder: %w", err)
+	}
+	defer commandEncoder.Release()
+
+	err = commandEncoder.CopyBufferToBuffer(s.particleBuffer, 0, buffer, 0, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy particle buffer: %w", err)
+	}
+	cmdBuffer, err := commandEncoder.Finish(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finish command buffer: %w", err)
+	}
+	defer cmdBuffer.Release()
+	s.queue.Submit(cmdBuffer)
+
+	data, err := s.mapRead(buffer, size)
+	if err != nil {
+		return nil, err
+	}
+	return wgpu.FromBytes[float32](data), nil
+}
+
+// mapRead maps a MapRead buffer, blocks until it is mapped and returns a copy of its first size bytes.
+func (s *State) mapRead(buffer *wgpu.Buffer, size uint64) ([]byte, error) {
+	done := false
+	var status wgpu.BufferMapAsyncStatus
+	err := buffer.MapAsync(wgpu.MapModeRead, 0, size, func(st wgpu.BufferMapAsyncStatus) {
+		status = st
+		done = true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to map buffer: %w", err)
+	}
+	for !done {
+		s.device.Poll(true, nil)
+	}
+	if status != wgpu.BufferMapAsyncStatusSuccess {
+		return nil, fmt.Errorf("failed to map buffer: %s", status)
+	}
+
+	data := make([]byte, size)
+	copy(data, buffer.GetMappedRange(0, uint(size)))
+	err = buffer.Unmap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmap buffer: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,295 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/brodo/goBoids/boid"
+	"strings"
+)
+
+// Supported compressions of Arrow messages.
+const (
+	CompressionNone = "none"
+	CompressionLZ4  = "lz4"
+	CompressionZstd = "zstd"
+)
+
+// Arrow serializes frames as Arrow IPC streams with one row per boid.
+type Arrow struct {
+	// ForceMagnitude adds a forceMag column with the magnitude of each boid's steering force.
+	ForceMagnitude bool
+	// Compression compresses the record buffers, CompressionNone or "" disables compression.
+	Compression string
+	// Stats, if set, compares the size of the first compressed messages to their uncompressed size.
+	Stats *CompressionStats
+	// Sample is the fraction of the boids serialized, see sampled. The id column keeps their indices.
+	// 0 serializes every boid.
+	Sample float64
+}
+
+// Serialize writes boids into a single record. It never fails, Arrow stores any float.
+func (a Arrow) Serialize(boids []boid.Boid) ([]byte, error) {
+	return a.serialize([]Frame{{Boids: boids}}, false), nil
+}
+
+// SerializeBatch writes all frames into a single record with an additional frame column.
+func (a Arrow) SerializeBatch(frames []Frame) ([]byte, error) {
+	return a.serialize(frames, true), nil
+}
+
+func (a Arrow) serialize(frames []Frame, withFrame bool) []byte {
+	frames = sampleFrames(frames, a.Sample)
+	var options []ipc.Option
+	switch a.Compression {
+	case CompressionLZ4:
+		options = append(options, ipc.WithLZ4())
+	case CompressionZstd:
+		options = append(options, ipc.WithZstd())
+	}
+	msg := buildArrow(frames, withFrame, a.ForceMagnitude, options...)
+	if len(options) > 0 && a.Stats != nil && a.Stats.sampling() {
+		a.Stats.add(a.Compression, len(msg), len(buildArrow(frames, withFrame, a.ForceMagnitude)))
+	}
+	return msg
+}
+
+// compressionSamples is the number of messages CompressionStats averages before logging.
+const compressionSamples = 100
+
+// CompressionStats compares the size of compressed messages to their uncompressed size. It logs the
+// averages over the first compressionSamples messages, so the tradeoff is visible. Its zero value is ready to use.
+type CompressionStats struct {
+	messages                 int
+	compressed, uncompressed int
+}
+
+func (s *CompressionStats) sampling() bool {
+	return s.messages < compressionSamples
+}
+
+func (s *CompressionStats) add(codec string, compressed, uncompressed int) {
+	s.messages++
+	s.compressed += compressed
+	s.uncompressed += uncompressed
+	if s.messages == compressionSamples {
+		fmt.Printf("%s compression: %d bytes per message on average instead of %d uncompressed (%.0f%%)\n",
+			codec, s.compressed/s.messages, s.uncompressed/s.messages, 100*float64(s.compressed)/float64(s.uncompressed))
+	}
+}
+
+// particleFields are the columns every frame contains.
+var particleFields = []arrow.Field{
+	{Name: "time", Type: arrow.PrimitiveTypes.Int64},
+	// The index of the boid in the particle buffer, which doesn't change, so rows can be joined across frames
+	{Name: "id", Type: arrow.PrimitiveTypes.Int32},
+	{Name: "posX", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "posY", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "posZ", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "velX", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "velY", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "velZ", Type: arrow.PrimitiveTypes.Float32},
+	{Name: "neighbors", Type: arrow.PrimitiveTypes.Uint32},
+	{Name: "flock", Type: arrow.PrimitiveTypes.Uint32},
+	{Name: "predator", Type: arrow.FixedWidthTypes.Boolean},
+}
+
+// BuildArrow serializes boids as an Arrow IPC stream with the columns
+// time, id, posX, posY, posZ, velX, velY, velZ, neighbors, flock and predator.
+func BuildArrow(boids []boid.Boid) []byte {
+	return buildArrow([]Frame{{Boids: boids}}, false, false)
+}
+
+// BuildArrowWithForce is BuildArrow with an additional forceMag column.
+func BuildArrowWithForce(boids []boid.Boid) []byte {
+	return buildArrow([]Frame{{Boids: boids}}, false, true)
+}
+
+// buildArrow writes frames into a single record. withFrame adds a frame column with the frame index
+// of each row, force a forceMag column. options are passed to the IPC writer.
+func buildArrow(frames []Frame, withFrame, force bool, options ...ipc.Option) []byte {
+	rec := newRecord(frames, withFrame, force)
+	defer rec.Release()
+
+	return writeArrow(rec.Schema(), rec, options...)
+}
+
+// newRecord builds a record with a row per boid of frames, see buildArrow. The caller must release it.
+func newRecord(frames []Frame, withFrame, force bool) array.Record {
+	pool := memory.NewGoAllocator()
+	fields := particleFields[:len(particleFields):len(particleFields)]
+	if force {
+		fields = append(fields, arrow.Field{Name: "forceMag", Type: arrow.PrimitiveTypes.Float32})
+	}
+	frameField := len(fields)
+	if withFrame {
+		fields = append(fields, arrow.Field{Name: "frame", Type: arrow.PrimitiveTypes.Uint64})
+	}
+	schema := arrow.NewSchema(fields, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	now := timestamp()
+	for _, frame := range frames {
+		for i, p := range frame.Boids {
+			appendBoid(b, now, frame.id(i), p, force)
+			if withFrame {
+				b.Field(frameField).(*array.Uint64Builder).Append(frame.Index)
+			}
+		}
+	}
+	return b.NewRecord()
+}
+
+// appendBoid appends a row with the particle fields of the boid with index id, and the forceMag field if
+// force is set, to b.
+func appendBoid(b *array.RecordBuilder, now int64, id int, p boid.Boid, force bool) {
+	b.Field(0).(*array.Int64Builder).Append(now)
+	b.Field(1).(*array.Int32Builder).Append(int32(id))
+	b.Field(2).(*array.Float32Builder).Append(p.Pos.X)
+	b.Field(3).(*array.Float32Builder).Append(p.Pos.Y)
+	b.Field(4).(*array.Float32Builder).Append(p.Pos.Z)
+	b.Field(5).(*array.Float32Builder).Append(p.Vel.X)
+	b.Field(6).(*array.Float32Builder).Append(p.Vel.Y)
+	b.Field(7).(*array.Float32Builder).Append(p.Vel.Z)
+	b.Field(8).(*array.Uint32Builder).Append(p.Neighbors)
+	b.Field(9).(*array.Uint32Builder).Append(p.Flock)
+	b.Field(10).(*array.BooleanBuilder).Append(p.Predator)
+	if force {
+		b.Field(11).(*array.Float32Builder).Append(p.Force)
+	}
+}
+
+// writeArrow serializes a single record as an Arrow IPC stream.
+func writeArrow(schema *arrow.Schema, rec array.Record, options ...ipc.Option) []byte {
+	buf := bytes.NewBuffer(nil)
+	wr := ipc.NewWriter(buf, append([]ipc.Option{ipc.WithSchema(schema)}, options...)...)
+	err := wr.Write(rec)
+	if err != nil {
+		panic(err)
+	}
+	err = wr.Close()
+	if err != nil {
+		panic(err)
+	}
+	if len(buf.Bytes()) == 0 {
+		panic("buffer is empty")
+	}
+	return buf.Bytes()
+}
+
+// particleColumns are the columns DecodeArrow reads. The z columns are optional, so 2D producers
+// without them can still be read.
+var particleColumns = []struct {
+	name     string
+	optional bool
+}{
+	{"posX", false}, {"posY", false}, {"posZ", true},
+	{"velX", false}, {"velY", false}, {"velZ", true},
+}
+
+// DecodeArrow is the inverse of BuildArrow: it turns an Arrow IPC stream back into boids.
+// Only the position, velocity, flock and predator columns are read. All but the x and y columns may be missing.
+// Batches with a frame column decode to their last frame.
+func DecodeArrow(msg []byte) ([]boid.Boid, error) {
+	rdr, err := ipc.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Arrow stream: %w", err)
+	}
+	defer rdr.Release()
+
+	columns, err := findColumns(rdr.Schema())
+	if err != nil {
+		return nil, err
+	}
+
+	var boids []boid.Boid
+	var lastFrame uint64
+	for rdr.Next() {
+		rec := rdr.Record()
+		for row := 0; row < int(rec.NumRows()); row++ {
+			if columns.frame >= 0 {
+				// Start over with each new frame, so only the last one remains
+				frame := rec.Column(columns.frame).(*array.Uint64).Value(row)
+				if frame != lastFrame {
+					boids = boids[:0]
+					lastFrame = frame
+				}
+			}
+			boids = append(boids, columns.boid(rec, row))
+		}
+	}
+	if err := rdr.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Arrow record: %w", err)
+	}
+	return boids, nil
+}
+
+// columnIndices are the indices of the columns DecodeArrow reads in a schema, -1 for missing optional columns.
+type columnIndices struct {
+	particle [6]int // see particleColumns
+	flock    int
+	frame    int
+	predator int
+}
+
+// findColumns looks up the columns DecodeArrow reads in schema and checks their types.
+func findColumns(schema *arrow.Schema) (columnIndices, error) {
+	var columns columnIndices
+	for i, c := range particleColumns {
+		indices := schema.FieldIndices(c.name)
+		if len(indices) == 0 && c.optional {
+			columns.particle[i] = -1
+			continue
+		}
+		if len(indices) != 1 {
+			return columns, fmt.Errorf("schema mismatch: expected exactly one %q column, found %d", c.name, len(indices))
+		}
+		if typ := schema.Field(indices[0]).Type; typ.ID() != arrow.FLOAT32 {
+			return columns, fmt.Errorf("schema mismatch: column %q has type %s, expected float32", c.name, typ)
+		}
+		columns.particle[i] = indices[0]
+	}
+	for _, c := range []struct {
+		name  string
+		id    arrow.Type
+		index *int
+	}{
+		{"flock", arrow.UINT32, &columns.flock},
+		{"frame", arrow.UINT64, &columns.frame},
+		{"predator", arrow.BOOL, &columns.predator},
+	} {
+		*c.index = -1
+		if indices := schema.FieldIndices(c.name); len(indices) == 1 {
+			if typ := schema.Field(indices[0]).Type; typ.ID() != c.id {
+				return columns, fmt.Errorf("schema mismatch: column %q has type %s, expected %s", c.name, typ, strings.ToLower(c.id.String()))
+			}
+			*c.index = indices[0]
+		}
+	}
+	return columns, nil
+}
+
+// boid reads the boid in row of rec.
+func (c columnIndices) boid(rec array.Record, row int) boid.Boid {
+	var values [6]float32
+	for i, col := range c.particle {
+		if col >= 0 {
+			values[i] = rec.Column(col).(*array.Float32).Value(row)
+		}
+	}
+	b := boid.Boid{
+		Pos: boid.Vec3{X: values[0], Y: values[1], Z: values[2]},
+		Vel: boid.Vec3{X: values[3], Y: values[4], Z: values[5]},
+	}
+	if c.flock >= 0 {
+		b.Flock = rec.Column(c.flock).(*array.Uint32).Value(row)
+	}
+	if c.predator >= 0 {
+		b.Predator = rec.Column(c.predator).(*array.Boolean).Value(row)
+	}
+	return b
+}
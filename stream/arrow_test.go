@@ -0,0 +1,162 @@
+package stream
+
+import (
+	"bytes"
+	"flag"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/brodo/goBoids/boid"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testTime is the timestamp of the messages in testdata.
+const testTime = 1700000000000000
+
+// useTestTime stamps messages with testTime until the test ends.
+func useTestTime(t *testing.T) {
+	t.Helper()
+	previous := timestamp
+	timestamp = func() int64 { return testTime }
+	t.Cleanup(func() { timestamp = previous })
+}
+
+// testBoids are the boids of the golden files. testdata/frame-v0.arrow holds their x and y components and
+// neighbor counts, as written by the Arrow encoding before it moved into this package.
+var testBoids = []boid.Boid{
+	{Pos: boid.Vec3{X: 0.1, Y: -0.2, Z: 0.3}, Vel: boid.Vec3{X: 0.01, Y: 0.02, Z: -0.03}, Neighbors: 2, Force: 0.5, Flock: 1},
+	{Pos: boid.Vec3{X: -0.5, Y: 0.5}, Vel: boid.Vec3{X: -0.1}, Predator: true},
+	{Pos: boid.Vec3{X: 0.9, Y: 0.9, Z: -0.9}, Vel: boid.Vec3{Y: 0.2, Z: 0.1}, Neighbors: 7, Force: 0.25, Flock: 2},
+}
+
+// arrowColumns decodes the Arrow IPC stream msg into its columns by name, with the values converted to float64.
+func arrowColumns(t *testing.T, msg []byte) map[string][]float64 {
+	t.Helper()
+	rdr, err := ipc.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("failed to read Arrow stream: %v", err)
+	}
+	defer rdr.Release()
+	columns := map[string][]float64{}
+	for rdr.Next() {
+		rec := rdr.Record()
+		for i, field := range rec.Schema().Fields() {
+			column := rec.Column(i)
+			for row := 0; row < column.Len(); row++ {
+				var v float64
+				switch c := column.(type) {
+				case *array.Int64:
+					v = float64(c.Value(row))
+				case *array.Int32:
+					v = float64(c.Value(row))
+				case *array.Uint32:
+					v = float64(c.Value(row))
+				case *array.Uint64:
+					v = float64(c.Value(row))
+				case *array.Float32:
+					v = float64(c.Value(row))
+				case *array.Boolean:
+					if c.Value(row) {
+						v = 1
+					}
+				default:
+					t.Fatalf("column %q has unexpected type %s", field.Name, field.Type)
+				}
+				columns[field.Name] = append(columns[field.Name], v)
+			}
+		}
+	}
+	if err := rdr.Err(); err != nil {
+		t.Fatalf("failed to read Arrow record: %v", err)
+	}
+	return columns
+}
+
+// checkGolden compares msg to the golden file name in testdata, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, msg []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		err := os.WriteFile(path, msg, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("message differs from %s, run the tests with -update if the change is intended", path)
+	}
+}
+
+func TestBuildArrowGolden(t *testing.T) {
+	useTestTime(t)
+	checkGolden(t, "frame.arrow", BuildArrow(testBoids))
+}
+
+// The columns of the original encoding must keep their values, so existing consumers keep working.
+func TestBuildArrowKeepsOriginalColumns(t *testing.T) {
+	useTestTime(t)
+	original, err := os.ReadFile(filepath.Join("testdata", "frame-v0.arrow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := arrowColumns(t, original)
+	got := arrowColumns(t, BuildArrow(testBoids))
+	for name, values := range want {
+		if !reflect.DeepEqual(got[name], values) {
+			t.Errorf("column %s is %v, want %v", name, got[name], values)
+		}
+	}
+}
+
+func TestBuildArrowWithForce(t *testing.T) {
+	columns := arrowColumns(t, BuildArrowWithForce(testBoids))
+	forces := columns["forceMag"]
+	if len(forces) != len(testBoids) {
+		t.Fatalf("got %d forces, want one per boid (%d)", len(forces), len(testBoids))
+	}
+	for i, force := range forces {
+		if force < 0 || force != float64(testBoids[i].Force) {
+			t.Errorf("boid %d has force %v, want %v", i, force, testBoids[i].Force)
+		}
+	}
+	if _, ok := arrowColumns(t, BuildArrow(testBoids))["forceMag"]; ok {
+		t.Error("BuildArrow has a forceMag column")
+	}
+}
+
+func TestDecodeArrow(t *testing.T) {
+	got, err := DecodeArrow(BuildArrow(testBoids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Neighbor counts and forces are not decoded
+	want := make([]boid.Boid, len(testBoids))
+	for i, b := range testBoids {
+		want[i] = boid.Boid{Pos: b.Pos, Vel: b.Vel, Flock: b.Flock, Predator: b.Predator}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeArrowBatchKeepsLastFrame(t *testing.T) {
+	msg, err := Arrow{}.SerializeBatch([]Frame{{Index: 3, Boids: testBoids[:2]}, {Index: 4, Boids: testBoids[2:]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeArrow(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Pos != testBoids[2].Pos {
+		t.Errorf("decoded %+v, want only the boid of the last frame", got)
+	}
+}
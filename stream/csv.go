@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"os"
+	"strconv"
+	"time"
+)
+
+// csvFlushInterval is how often a CSVWriter flushes buffered rows to its file.
+const csvFlushInterval = time.Second
+
+// CSVWriter writes one row per boid and frame to a CSV file, for analysis in a spreadsheet. The time column
+// holds the seconds since the first frame.
+type CSVWriter struct {
+	file   *os.File
+	writer *csv.Writer
+	start  time.Time
+}
+
+// NewCSVWriter creates the file at path, truncating it if it exists, and writes the header row.
+func NewCSVWriter(path string) (*CSVWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSV file: %w", err)
+	}
+	writer := csv.NewWriter(file)
+	err = writer.Write([]string{"time", "posX", "posY", "velX", "velY"})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write CSV header: %w", err)
+	}
+	return &CSVWriter{file: file, writer: writer}, nil
+}
+
+// Run writes every frame received on frames until the channel is closed, then closes the writer.
+// Rows are flushed to the file every csvFlushInterval.
+func (c *CSVWriter) Run(frames <-chan []float32) {
+	defer func() {
+		err := c.Close()
+		if err != nil {
+			fmt.Printf("failed to close CSV file: %v\n", err)
+		}
+	}()
+	ticker := time.NewTicker(csvFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-frames:
+			if !ok {
+				return
+			}
+			err := c.Write(data)
+			if err != nil {
+				fmt.Printf("failed to write CSV rows: %v\n", err)
+			}
+		case <-ticker.C:
+			c.writer.Flush()
+			err := c.writer.Error()
+			if err != nil {
+				fmt.Printf("failed to flush CSV file: %v\n", err)
+			}
+		}
+	}
+}
+
+// Write appends a row for every boid in a frame of particle data. Rows are buffered until the next flush.
+func (c *CSVWriter) Write(data []float32) error {
+	boids, err := boid.Boids(data)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if c.start.IsZero() {
+		c.start = now
+	}
+	t := strconv.FormatFloat(now.Sub(c.start).Seconds(), 'f', 6, 64)
+	for _, b := range boids {
+		err = c.writer.Write([]string{t, formatFloat(b.Pos.X), formatFloat(b.Pos.Y), formatFloat(b.Vel.X), formatFloat(b.Vel.Y)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the remaining rows and closes the file.
+func (c *CSVWriter) Close() error {
+	c.writer.Flush()
+	err := c.writer.Error()
+	if err != nil {
+		c.file.Close()
+		return fmt.Errorf("failed to flush CSV file: %w", err)
+	}
+	return c.file.Close()
+}
+
+// formatFloat formats f with the fewest digits that read back as the same float32.
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'g', -1, 32)
+}
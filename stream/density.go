@@ -0,0 +1,75 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+	"strconv"
+	"strings"
+)
+
+// DensityHistogram counts how many boids fall into each neighbor count bucket. buckets holds the
+// ascending lower bounds of the buckets, each bucket ends where the next one begins and the last one is
+// open-ended. For example, buckets 0, 1, 6 count boids with 0, 1–5 and 6 or more neighbors.
+// Counts below the first bound are not counted.
+func DensityHistogram(counts []uint32, buckets []int) []int {
+	histogram := make([]int, len(buckets))
+	for _, c := range counts {
+		for i := len(buckets) - 1; i >= 0; i-- {
+			if int(c) >= buckets[i] {
+				histogram[i]++
+				break
+			}
+		}
+	}
+	return histogram
+}
+
+// ParseDensityBuckets parses a comma-separated list of ascending, non-negative bucket lower bounds.
+func ParseDensityBuckets(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var buckets []int
+	for _, part := range strings.Split(s, ",") {
+		bound, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid density bucket %q: %w", part, err)
+		}
+		if bound < 0 {
+			return nil, fmt.Errorf("invalid density bucket %d: must not be negative", bound)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("invalid density buckets %q: bounds must be ascending", s)
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// BuildDensityArrow serializes a density histogram with one row per bucket.
+func BuildDensityArrow(buckets []int, histogram []int) []byte {
+	pool := memory.NewGoAllocator()
+	schema := arrow.NewSchema(
+		[]arrow.Field{
+			{Name: "time", Type: arrow.PrimitiveTypes.Int64},
+			{Name: "minNeighbors", Type: arrow.PrimitiveTypes.Uint32},
+			{Name: "boids", Type: arrow.PrimitiveTypes.Uint32},
+		},
+		nil,
+	)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	now := timestamp()
+	for i, bound := range buckets {
+		b.Field(0).(*array.Int64Builder).Append(now)
+		b.Field(1).(*array.Uint32Builder).Append(uint32(bound))
+		b.Field(2).(*array.Uint32Builder).Append(uint32(histogram[i]))
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+
+	return writeArrow(schema, rec)
+}
@@ -0,0 +1,75 @@
+package stream
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDensityHistogram(t *testing.T) {
+	tests := []struct {
+		name    string
+		counts  []uint32
+		buckets []int
+		want    []int
+	}{
+		{"buckets", []uint32{0, 1, 5, 6, 10, 11, 100}, []int{0, 1, 6, 11}, []int{1, 2, 2, 2}},
+		{"below the first bound", []uint32{0, 2, 3, 7}, []int{3, 5}, []int{1, 1}},
+		{"no boids", nil, []int{0, 1}, []int{0, 0}},
+		{"no buckets", []uint32{1, 2}, nil, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DensityHistogram(tt.counts, tt.buckets); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDensityBuckets(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []int
+		wantErr bool
+	}{
+		{"0,1,6,11,21", []int{0, 1, 6, 11, 21}, false},
+		{" 0, 5 ", []int{0, 5}, false},
+		{"", nil, false},
+		{"0,x", nil, true},
+		{"-1,5", nil, true},
+		{"5,5", nil, true},
+		{"5,1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDensityBuckets(tt.s)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseDensityBuckets(%q) = %v, %v, want %v and an error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPublisherDensityHistogram(t *testing.T) {
+	useTestTime(t)
+	sink := &fakeSink{}
+	p := &Publisher{Sink: sink, Serializer: fakeSerializer{}, Subject: "test", DensityBuckets: []int{0, 1, 6}}
+	// testFrame gives the boids 0 to 7 neighbors
+	p.Publish(testFrame(0, 8))
+
+	var msg []byte
+	for _, m := range sink.messages {
+		if m.subject == DensitySubject("test") {
+			msg = m.data
+		}
+	}
+	if msg == nil {
+		t.Fatalf("published %v, want a density histogram", sink.subjects())
+	}
+	want := map[string][]float64{
+		"time":         {testTime, testTime, testTime},
+		"minNeighbors": {0, 1, 6},
+		"boids":        {1, 5, 2},
+	}
+	if got := arrowColumns(t, msg); !reflect.DeepEqual(got, want) {
+		t.Errorf("got histogram %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+)
+
+// JSONLines serializes frames as newline-delimited JSON with one object per boid, for log pipelines
+// that can't ingest Arrow. It is several times larger than Arrow, so consider publishing only every
+// nth frame (-publish-every) or a sample of the boids when using it.
+type JSONLines struct {
+	// Sample is the fraction of the boids serialized, see sampled. 0 serializes every boid.
+	Sample float64
+}
+
+// JSONBoid is a single line of JSONLines output.
+type JSONBoid struct {
+	// Time is the frame time in microseconds since the Unix epoch, like the Arrow time column.
+	Time      int64      `json:"time"`
+	ID        int        `json:"id"`
+	Pos       [3]float32 `json:"pos"`
+	Vel       [3]float32 `json:"vel"`
+	Neighbors uint32     `json:"neighbors"`
+	Flock     uint32     `json:"flock"`
+	Predator  bool       `json:"predator"`
+	// Frame is the frame index, only set in batches.
+	Frame *uint64 `json:"frame,omitempty"`
+}
+
+// Serialize writes a JSONBoid line per boid, all with the same time and without a frame index. JSON has no
+// NaN or infinity, so it fails if a boid has such a position or velocity.
+func (j JSONLines) Serialize(boids []boid.Boid) ([]byte, error) {
+	return serializeJSONLines(sampleFrames([]Frame{{Boids: boids}}, j.Sample), false)
+}
+
+// SerializeBatch writes the lines of all frames, each with its frame index.
+func (j JSONLines) SerializeBatch(frames []Frame) ([]byte, error) {
+	return serializeJSONLines(sampleFrames(frames, j.Sample), true)
+}
+
+func serializeJSONLines(frames []Frame, withFrame bool) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	now := timestamp()
+	for _, frame := range frames {
+		var index *uint64
+		if withFrame {
+			index = &frame.Index
+		}
+		for i, b := range frame.Boids {
+			err := writeJSONBoid(enc, now, frame.id(i), b, index)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeJSONBoid(enc *json.Encoder, now int64, i int, b boid.Boid, frame *uint64) error {
+	err := enc.Encode(JSONBoid{
+		Time:      now,
+		ID:        i,
+		Pos:       [3]float32{b.Pos.X, b.Pos.Y, b.Pos.Z},
+		Vel:       [3]float32{b.Vel.X, b.Vel.Y, b.Vel.Z},
+		Neighbors: b.Neighbors,
+		Flock:     b.Flock,
+		Predator:  b.Predator,
+		Frame:     frame,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode boid %d: %w", i, err)
+	}
+	return nil
+}
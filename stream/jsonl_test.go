@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/brodo/goBoids/boid"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// decodeJSONLines decodes every line of msg as a JSONBoid, rejecting unknown fields.
+func decodeJSONLines(t *testing.T, msg []byte) []JSONBoid {
+	t.Helper()
+	var lines []JSONBoid
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	for scanner.Scan() {
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+		var line JSONBoid
+		err := dec.Decode(&line)
+		if err != nil {
+			t.Fatalf("failed to decode line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestJSONLinesSerialize(t *testing.T) {
+	useTestTime(t)
+	msg, err := JSONLines{}.Serialize(testBoids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := decodeJSONLines(t, msg)
+	if len(lines) != len(testBoids) {
+		t.Fatalf("got %d lines, want one per boid (%d)", len(lines), len(testBoids))
+	}
+	for i, b := range testBoids {
+		want := JSONBoid{
+			Time:      testTime,
+			ID:        i,
+			Pos:       [3]float32{b.Pos.X, b.Pos.Y, b.Pos.Z},
+			Vel:       [3]float32{b.Vel.X, b.Vel.Y, b.Vel.Z},
+			Neighbors: b.Neighbors,
+			Flock:     b.Flock,
+			Predator:  b.Predator,
+		}
+		if !reflect.DeepEqual(lines[i], want) {
+			t.Errorf("line %d: got %+v, want %+v", i, lines[i], want)
+		}
+	}
+}
+
+func TestJSONLinesSerializeBatch(t *testing.T) {
+	useTestTime(t)
+	frames := []Frame{{Index: 4, Boids: testBoids[:1]}, {Index: 5, Boids: testBoids}}
+	msg, err := JSONLines{Sample: 0.5}.SerializeBatch(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := decodeJSONLines(t, msg)
+
+	// Half of the boids of each frame are kept, with their original ids
+	type row struct {
+		frame uint64
+		id    int
+	}
+	var got []row
+	for _, line := range lines {
+		if line.Frame == nil {
+			t.Fatalf("line %+v has no frame index", line)
+		}
+		got = append(got, row{*line.Frame, line.ID})
+	}
+	want := []row{{4, 0}, {5, 0}, {5, 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got frames and ids %v, want %v", got, want)
+	}
+}
+
+func TestJSONLinesSerializeNaN(t *testing.T) {
+	boids := append([]boid.Boid(nil), testBoids...)
+	boids[1].Vel.X = float32(math.NaN())
+	_, err := JSONLines{}.Serialize(boids)
+	if err == nil {
+		t.Fatal("boid with a NaN velocity serialized")
+	}
+
+	// The publisher drops the frame instead of crashing
+	sink := &fakeSink{}
+	p := &Publisher{Sink: sink, Serializer: JSONLines{}, Subject: "test"}
+	p.Publish(boid.FlattenBoids(boids))
+	if n := sink.count(); n != 0 {
+		t.Errorf("published %d messages, want the frame dropped", n)
+	}
+}
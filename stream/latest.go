@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"github.com/nats-io/nats.go"
+	"sync"
+)
+
+// Latest retains the most recently published frame, so late subscribers don't have to wait for the next one.
+type Latest struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// Set replaces the retained frame.
+func (l *Latest) Set(data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.data = data
+}
+
+// Get returns the retained frame, or nil if no frame was published yet.
+func (l *Latest) Get() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.data
+}
+
+// Serve answers requests on LatestSubject(subject) with the retained frame. Requests before the first frame
+// are answered with an empty message. Closing or draining nc stops serving.
+func (l *Latest) Serve(nc *nats.Conn, subject string) error {
+	_, err := nc.Subscribe(LatestSubject(subject), func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+		_ = msg.Respond(l.Get())
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+package stream
+
+import (
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"testing"
+	"time"
+)
+
+// connectTestServer starts a NATS server on a random port and connects to it. Both are shut down when the
+// test ends.
+func connectTestServer(t *testing.T) *nats.Conn {
+	t.Helper()
+	server := natsserver.RunRandClientPortServer()
+	t.Cleanup(server.Shutdown)
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// requestLatest requests the latest frame published to subject.
+func requestLatest(t *testing.T, nc *nats.Conn, subject string) string {
+	t.Helper()
+	reply, err := nc.Request(LatestSubject(subject), nil, time.Second)
+	if err != nil {
+		t.Fatalf("failed to request the latest frame: %v", err)
+	}
+	return string(reply.Data)
+}
+
+func TestLatestServe(t *testing.T) {
+	nc := connectTestServer(t)
+	latest := &Latest{}
+	err := latest.Serve(nc, "boids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Publisher{Sink: NewNATSSink(nc), Serializer: fakeSerializer{}, Subject: "boids", Latest: latest}
+
+	if got := requestLatest(t, nc, "boids"); got != "" {
+		t.Errorf("got %q before the first frame, want an empty reply", got)
+	}
+	p.Publish(testFrame(0, 2))
+	p.Publish(testFrame(5, 2))
+	if got, want := requestLatest(t, nc, "boids"), "[5 6]"; got != want {
+		t.Errorf("got %q, want the last frame %q", got, want)
+	}
+	// Other subjects aren't answered
+	_, err = nc.Request(LatestSubject("other"), nil, 100*time.Millisecond)
+	if err != nats.ErrNoResponders && err != nats.ErrTimeout {
+		t.Errorf("got %v for another subject, want no reply", err)
+	}
+}
+
+func TestLatestServeBatches(t *testing.T) {
+	nc := connectTestServer(t)
+	latest := &Latest{}
+	err := latest.Serve(nc, "boids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Publisher{Sink: NewNATSSink(nc), Serializer: fakeSerializer{}, Subject: "boids", Latest: latest, Batch: 2}
+
+	p.Publish(testFrame(0, 1))
+	p.Publish(testFrame(1, 1))
+	p.Publish(testFrame(2, 1))
+	// The incomplete batch isn't published yet, the latest message is the complete one
+	if got, want := requestLatest(t, nc, "boids"), "0:[0]|1:[1]"; got != want {
+		t.Errorf("got %q, want the last batch %q", got, want)
+	}
+}
@@ -0,0 +1,274 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/brodo/goBoids/boid"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordSyncEvery is the number of frames after which a Recorder syncs its file to disk.
+const recordSyncEvery = 60
+
+// parquetWriters is the number of goroutines marshalling rows for a Parquet file.
+const parquetWriters = 4
+
+// Recorder appends frames to an Arrow IPC or Parquet file, with a frame column with the frame index.
+// An Arrow file has one record batch per frame and can be read with any Arrow implementation, e.g.
+// pyarrow.ipc.open_file, a Parquet file one row group per recordSyncEvery frames. Either is only valid
+// once the recorder is closed.
+type Recorder struct {
+	writer recordWriter
+	force  bool
+	frames uint64 // number of frames written so far
+}
+
+// recordWriter writes the records of a Recorder in a file format.
+type recordWriter interface {
+	Write(rec array.Record) error
+	// Flush writes the buffered records and syncs the file to disk.
+	Flush() error
+	// Close writes the file footer and closes the file.
+	Close() error
+}
+
+// NewRecorder creates the file at path, truncating it if it exists. A path ending in .parquet is written as
+// Parquet, any other as an Arrow IPC file. force adds a forceMag column.
+func NewRecorder(path string, force bool) (*Recorder, error) {
+	// The schema is that of every record, an empty frame yields it without any rows
+	rec := newRecord(nil, true, force)
+	defer rec.Release()
+	var w recordWriter
+	var err error
+	if IsParquet(path) {
+		w, err = newParquetWriter(path, rec.Schema())
+	} else {
+		w, err = newArrowFileWriter(path, rec.Schema())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{writer: w, force: force}, nil
+}
+
+// IsParquet reports whether a Recorder writes the file at path as Parquet.
+func IsParquet(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".parquet")
+}
+
+// arrowFileWriter writes records as the record batches of an Arrow IPC file.
+type arrowFileWriter struct {
+	file   *os.File
+	writer *ipc.FileWriter
+}
+
+// newArrowFileWriter creates the Arrow IPC file at path for records with schema.
+func newArrowFileWriter(path string, schema *arrow.Schema) (*arrowFileWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	writer, err := ipc.NewFileWriter(file, ipc.WithSchema(schema))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create Arrow file writer: %w", err)
+	}
+	return &arrowFileWriter{file: file, writer: writer}, nil
+}
+
+func (w *arrowFileWriter) Write(rec array.Record) error {
+	return w.writer.Write(rec)
+}
+
+func (w *arrowFileWriter) Flush() error {
+	return w.file.Sync()
+}
+
+func (w *arrowFileWriter) Close() error {
+	err := w.writer.Close()
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to write Arrow file footer: %w", err)
+	}
+	return w.file.Close()
+}
+
+// parquetWriter writes records as the rows of a Parquet file. Rows are buffered until Flush writes them
+// as a row group.
+type parquetWriter struct {
+	file   source.ParquetFile
+	writer *writer.ArrowWriter
+}
+
+// newParquetWriter creates the Parquet file at path for records with schema.
+func newParquetWriter(path string, schema *arrow.Schema) (*parquetWriter, error) {
+	file, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	w, err := writer.NewArrowWriter(schema, file, parquetWriters)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create Parquet writer: %w", err)
+	}
+	// Snappy keeps up with the frame rate better than the default gzip
+	w.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{file: file, writer: w}, nil
+}
+
+func (w *parquetWriter) Write(rec array.Record) error {
+	return w.writer.WriteArrow(rec)
+}
+
+func (w *parquetWriter) Flush() error {
+	return w.writer.Flush(true)
+}
+
+func (w *parquetWriter) Close() error {
+	err := w.writer.WriteStop()
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to write Parquet file footer: %w", err)
+	}
+	return w.file.Close()
+}
+
+// Run writes every frame received on frames until the channel is closed, then closes the recorder.
+func (r *Recorder) Run(frames <-chan []float32) {
+	defer func() {
+		err := r.Close()
+		if err != nil {
+			fmt.Printf("failed to close output file: %v\n", err)
+		}
+	}()
+	for data := range frames {
+		err := r.Write(data)
+		if err != nil {
+			fmt.Printf("failed to record frame: %v\n", err)
+		}
+	}
+}
+
+// Write appends a frame of particle data as a record batch.
+func (r *Recorder) Write(data []float32) error {
+	boids, err := boid.Boids(data)
+	if err != nil {
+		return err
+	}
+	if len(boids) == 0 {
+		return nil
+	}
+	rec := newRecord([]Frame{{Index: r.frames, Boids: boids}}, true, r.force)
+	defer rec.Release()
+	r.frames++
+	err = r.writer.Write(rec)
+	if err != nil {
+		return err
+	}
+	if r.frames%recordSyncEvery == 0 {
+		return r.writer.Flush()
+	}
+	return nil
+}
+
+// Close writes the file footer and closes the file. The file is only valid afterwards.
+func (r *Recorder) Close() error {
+	return r.writer.Close()
+}
+
+// Recording reads the frames of a file written by a Recorder.
+type Recording struct {
+	file    *os.File
+	reader  *ipc.FileReader
+	columns columnIndices
+	time    int // index of the time column
+	next    int // index of the next record batch
+}
+
+// OpenRecording opens the recording at path.
+func OpenRecording(path string) (*Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	reader, err := ipc.NewFileReader(file, ipc.WithAllocator(memory.NewGoAllocator()))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read Arrow file: %w", err)
+	}
+	columns, err := findColumns(reader.Schema())
+	if err == nil && len(reader.Schema().FieldIndices("time")) != 1 {
+		err = fmt.Errorf("schema mismatch: expected exactly one %q column", "time")
+	}
+	if err != nil {
+		reader.Close()
+		file.Close()
+		return nil, err
+	}
+	return &Recording{file: file, reader: reader, columns: columns, time: reader.Schema().FieldIndices("time")[0]}, nil
+}
+
+// Next returns the boids of the next frame and the time it was recorded at. It returns io.EOF after the last frame.
+func (r *Recording) Next() ([]boid.Boid, time.Time, error) {
+	if r.next >= r.reader.NumRecords() {
+		return nil, time.Time{}, io.EOF
+	}
+	rec, err := r.reader.Record(r.next)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read frame %d: %w", r.next, err)
+	}
+	r.next++
+
+	boids := make([]boid.Boid, rec.NumRows())
+	for row := range boids {
+		boids[row] = r.columns.boid(rec, row)
+	}
+	var recorded time.Time
+	if len(boids) > 0 {
+		recorded = time.UnixMicro(rec.Column(r.time).(*array.Int64).Value(0))
+	}
+	return boids, recorded, nil
+}
+
+// Close closes the recording.
+func (r *Recording) Close() error {
+	err := r.reader.Close()
+	if err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// FanOut copies every frame received on in to n channels, which are closed once in is closed.
+// Frames are shared, so receivers must not modify them. A slow receiver holds up the others.
+func FanOut(in <-chan []float32, n int) []<-chan []float32 {
+	outs := make([]chan []float32, n)
+	receivers := make([]<-chan []float32, n)
+	for i := range outs {
+		outs[i] = make(chan []float32, cap(in))
+		receivers[i] = outs[i]
+	}
+	go func() {
+		for data := range in {
+			for _, out := range outs {
+				out <- data
+			}
+		}
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+	return receivers
+}
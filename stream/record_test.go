@@ -0,0 +1,98 @@
+package stream
+
+import (
+	"github.com/brodo/goBoids/boid"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordFrames records frames of testBoids to path, enough that the file is flushed once in between.
+func recordFrames(t *testing.T, path string, force bool) int {
+	t.Helper()
+	useTestTime(t)
+	r, err := NewRecorder(path, force)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := recordSyncEvery + 1
+	for range frames {
+		err = r.Write(boid.FlattenBoids(testBoids))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func TestRecorderArrow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.arrow")
+	frames := recordFrames(t, path, false)
+
+	recording, err := OpenRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recording.Close()
+	for frame := range frames {
+		boids, recorded, err := recording.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", frame, err)
+		}
+		if len(boids) != len(testBoids) || boids[2].Pos != testBoids[2].Pos || !recorded.Equal(time.UnixMicro(testTime)) {
+			t.Fatalf("frame %d: got %d boids recorded at %v, want %d at %v", frame, len(boids), recorded, len(testBoids), time.UnixMicro(testTime))
+		}
+	}
+	_, _, err = recording.Next()
+	if err != io.EOF {
+		t.Errorf("got %v after the last frame, want io.EOF", err)
+	}
+}
+
+func TestRecorderParquet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.parquet")
+	frames := recordFrames(t, path, true)
+
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		t.Fatalf("failed to read Parquet file: %v", err)
+	}
+	defer r.ReadStop()
+	rows := int64(frames * len(testBoids))
+	if r.GetNumRows() != rows {
+		t.Fatalf("got %d rows, want %d", r.GetNumRows(), rows)
+	}
+
+	// The columns are those of the Arrow frames, followed by forceMag and frame
+	posX, _, _, err := r.ReadColumnByIndex(2, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	force, _, _, err := r.ReadColumnByIndex(int64(len(particleFields)), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, _, _, err := r.ReadColumnByIndex(int64(len(particleFields))+1, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row := range int(rows) {
+		want := testBoids[row%len(testBoids)]
+		if posX[row] != want.Pos.X || force[row] != want.Force || frame[row] != int64(row/len(testBoids)) {
+			t.Fatalf("row %d: got posX %v, forceMag %v, frame %v, want %v, %v, %d",
+				row, posX[row], force[row], frame[row], want.Pos.X, want.Force, row/len(testBoids))
+		}
+	}
+}
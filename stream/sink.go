@@ -0,0 +1,186 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"sync/atomic"
+)
+
+// destinationQueueSize is the number of messages buffered per destination before frames are dropped.
+const destinationQueueSize = 16
+
+// Sink is a destination for serialized particle frames and derived data.
+type Sink interface {
+	Publish(subject string, msg []byte) error
+	Close() error
+}
+
+// NATSSink publishes messages on a NATS connection.
+type NATSSink struct {
+	nc     *nats.Conn
+	closed chan struct{} // closed once the connection is
+}
+
+// NewNATSSink returns a Sink that publishes on nc and drains it when closed. It replaces the closed
+// handler of nc.
+func NewNATSSink(nc *nats.Conn) *NATSSink {
+	n := &NATSSink{nc: nc, closed: make(chan struct{})}
+	nc.SetClosedHandler(func(*nats.Conn) { close(n.closed) })
+	return n
+}
+
+func (n *NATSSink) Publish(subject string, msg []byte) error {
+	return n.nc.Publish(subject, msg)
+}
+
+// Connected reports whether the connection to the server is currently up.
+func (n *NATSSink) Connected() bool {
+	return n.nc.IsConnected()
+}
+
+// Close drains the connection so buffered messages are flushed before it is closed, and waits until it is.
+// Draining gives up after the drain timeout of the connection.
+func (n *NATSSink) Close() error {
+	err := n.nc.Drain()
+	if err != nil {
+		return err
+	}
+	<-n.closed
+	return nil
+}
+
+// message is a queued Publish call.
+type message struct {
+	subject string
+	data    []byte
+}
+
+// destination wraps a Sink with its own buffered queue and goroutine, so a slow or failing
+// sink can't hold up the others.
+type destination struct {
+	name      string
+	sink      Sink
+	queue     chan message
+	done      chan struct{}
+	published atomic.Uint64 // messages the sink accepted
+	errors    atomic.Uint64 // publish errors returned by the sink
+	dropped   atomic.Uint64 // frames dropped because the queue was full
+	lastErr   atomic.Pointer[error]
+}
+
+func newDestination(name string, sink Sink) *destination {
+	d := &destination{
+		name:  name,
+		sink:  sink,
+		queue: make(chan message, destinationQueueSize),
+		done:  make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *destination) run() {
+	defer close(d.done)
+	for msg := range d.queue {
+		err := d.sink.Publish(msg.subject, msg.data)
+		if err != nil {
+			d.lastErr.Store(&err)
+			n := d.errors.Add(1)
+			// Only log occasionally, a dead destination would otherwise log every frame
+			if n == 1 || n%100 == 0 {
+				fmt.Printf("failed to publish to %s (%d errors so far): %v\n", d.name, n, err)
+			}
+		} else {
+			d.published.Add(1)
+		}
+	}
+}
+
+// MultiSink fans every message out to all of its destinations.
+type MultiSink struct {
+	destinations []*destination
+}
+
+// Add adds a destination that receives all messages published from now on. name is used in log messages.
+func (m *MultiSink) Add(name string, sink Sink) {
+	m.destinations = append(m.destinations, newDestination(name, sink))
+}
+
+// Len returns the number of destinations.
+func (m *MultiSink) Len() int {
+	return len(m.destinations)
+}
+
+// Publish queues msg for every destination. Destinations whose queue is full drop the message.
+func (m *MultiSink) Publish(subject string, msg []byte) error {
+	for _, d := range m.destinations {
+		select {
+		case d.queue <- message{subject: subject, data: msg}:
+		default:
+			n := d.dropped.Add(1)
+			if n == 1 || n%100 == 0 {
+				fmt.Printf("publish queue for %s is full, dropped %d frames so far\n", d.name, n)
+			}
+		}
+	}
+	return nil
+}
+
+// Connected reports whether at least one destination is connected. Sinks without a Connected method
+// are assumed to be connected.
+func (m *MultiSink) Connected() bool {
+	for _, d := range m.destinations {
+		c, ok := d.sink.(interface{ Connected() bool })
+		if !ok || c.Connected() {
+			return true
+		}
+	}
+	return false
+}
+
+// Failures returns the number of messages that failed to publish and that were dropped because a
+// destination's queue was full, summed over all destinations.
+func (m *MultiSink) Failures() (failed, dropped uint64) {
+	for _, d := range m.destinations {
+		failed += d.errors.Load()
+		dropped += d.dropped.Load()
+	}
+	return failed, dropped
+}
+
+// Published returns the number of messages published successfully, summed over all destinations.
+func (m *MultiSink) Published() uint64 {
+	var published uint64
+	for _, d := range m.destinations {
+		published += d.published.Load()
+	}
+	return published
+}
+
+// LastError joins the most recent publish error of every destination. It is nil if no publish failed.
+func (m *MultiSink) LastError() error {
+	var errs []error
+	for _, d := range m.destinations {
+		if err := d.lastErr.Load(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.name, *err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close waits until every destination has published its queued messages and closes the sinks.
+func (m *MultiSink) Close() error {
+	for _, d := range m.destinations {
+		close(d.queue)
+	}
+	var errs []error
+	for _, d := range m.destinations {
+		<-d.done
+		err := d.sink.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
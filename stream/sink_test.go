@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitForMessages waits until sink has published n messages.
+func waitForMessages(t *testing.T, sink *fakeSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for sink.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d messages, want %d", sink.count(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMultiSinkFanOut(t *testing.T) {
+	primary, analytics := &fakeSink{}, &fakeSink{}
+	m := &MultiSink{}
+	m.Add("primary", primary)
+	m.Add("analytics", analytics)
+	var want []string
+	for i := range destinationQueueSize {
+		subject := fmt.Sprintf("boids.%d", i)
+		want = append(want, subject)
+		err := m.Publish(subject, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sink := range []*fakeSink{primary, analytics} {
+		if got := sink.subjects(); !reflect.DeepEqual(got, want) {
+			t.Errorf("got messages %v, want %v", got, want)
+		}
+		if !sink.closed {
+			t.Error("sink wasn't closed")
+		}
+	}
+	if published := m.Published(); published != uint64(2*len(want)) {
+		t.Errorf("got %d published messages, want %d", published, 2*len(want))
+	}
+}
+
+func TestMultiSinkIsolatesFailingDestinations(t *testing.T) {
+	dead, alive := &fakeSink{err: errors.New("connection refused")}, &fakeSink{}
+	m := &MultiSink{}
+	m.Add("dead", dead)
+	m.Add("alive", alive)
+	for range 3 {
+		err := m.Publish("boids", nil)
+		if err != nil {
+			t.Fatalf("got %v, want errors of a destination not to fail publishing", err)
+		}
+	}
+	err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alive.count() != 3 {
+		t.Errorf("the working destination got %d messages, want 3", alive.count())
+	}
+	failed, dropped := m.Failures()
+	if failed != 3 || dropped != 0 || m.Published() != 3 {
+		t.Errorf("got %d failed, %d dropped and %d published messages, want 3, 0 and 3", failed, dropped, m.Published())
+	}
+	if err := m.LastError(); err == nil || err.Error() != "dead: connection refused" {
+		t.Errorf("got last error %v, want the dead destination's", err)
+	}
+}
+
+func TestMultiSinkSlowDestinationDoesntBlock(t *testing.T) {
+	slow, fast := &fakeSink{block: make(chan struct{})}, &fakeSink{}
+	m := &MultiSink{}
+	m.Add("slow", slow)
+	m.Add("fast", fast)
+	// The slow destination takes the first message and queues the next destinationQueueSize
+	messages := destinationQueueSize + 5
+	for i := range messages {
+		err := m.Publish("boids", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForMessages(t, fast, i+1)
+		// Once the slow destination blocks on the first message, its queue only fills up
+		for i == 0 && len(m.destinations[0].queue) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	_, dropped := m.Failures()
+	if want := uint64(messages - 1 - destinationQueueSize); dropped != want {
+		t.Errorf("got %d dropped messages, want %d", dropped, want)
+	}
+
+	close(slow.block)
+	err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := slow.count(), 1+destinationQueueSize; got != want {
+		t.Errorf("the slow destination got %d messages, want %d", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package stream
+
+import (
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/brodo/goBoids/boid"
+)
+
+// FlockStats summarizes a frame for consumers that don't need every boid.
+type FlockStats struct {
+	Boids int
+	// Centroid is the mean position of the boids.
+	Centroid boid.Vec3
+	// Min and Max are the corners of the bounding box of the boids.
+	Min, Max boid.Vec3
+	// MeanSpeed is the mean length of the velocities.
+	MeanSpeed float32
+	// Polarization is the length of the mean normalized velocity, the order parameter of the flock:
+	// 1 if all boids head the same way, near 0 if they head in random directions.
+	Polarization float32
+}
+
+// ComputeStats computes the statistics of a frame. Boids that stand still have no heading, so the polarization
+// is that of the moving boids, and 0 if none move.
+func ComputeStats(boids []boid.Boid) FlockStats {
+	stats := FlockStats{Boids: len(boids)}
+	if len(boids) == 0 {
+		return stats
+	}
+	stats.Min, stats.Max = boids[0].Pos, boids[0].Pos
+	var position, heading boid.Vec3
+	var speed float64
+	moving := 0
+	for _, b := range boids {
+		position = position.Add(b.Pos)
+		stats.Min = boid.Vec3{X: min(stats.Min.X, b.Pos.X), Y: min(stats.Min.Y, b.Pos.Y), Z: min(stats.Min.Z, b.Pos.Z)}
+		stats.Max = boid.Vec3{X: max(stats.Max.X, b.Pos.X), Y: max(stats.Max.Y, b.Pos.Y), Z: max(stats.Max.Z, b.Pos.Z)}
+		s := b.Vel.Len()
+		speed += float64(s)
+		if s > 0 {
+			heading = heading.Add(b.Vel.Scale(1 / s))
+			moving++
+		}
+	}
+	n := float32(len(boids))
+	stats.Centroid = position.Scale(1 / n)
+	stats.MeanSpeed = float32(speed / float64(len(boids)))
+	if moving > 0 {
+		stats.Polarization = heading.Scale(1 / float32(moving)).Len()
+	}
+	return stats
+}
+
+// BuildStatsArrow serializes flock statistics as a record with a single row.
+func BuildStatsArrow(stats FlockStats) []byte {
+	pool := memory.NewGoAllocator()
+	fields := []arrow.Field{
+		{Name: "time", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "boids", Type: arrow.PrimitiveTypes.Uint32},
+	}
+	values := []float32{
+		stats.Centroid.X, stats.Centroid.Y, stats.Centroid.Z,
+		stats.Min.X, stats.Min.Y, stats.Min.Z,
+		stats.Max.X, stats.Max.Y, stats.Max.Z,
+		stats.MeanSpeed, stats.Polarization,
+	}
+	for _, name := range []string{
+		"centroidX", "centroidY", "centroidZ",
+		"minX", "minY", "minZ",
+		"maxX", "maxY", "maxZ",
+		"meanSpeed", "polarization",
+	} {
+		fields = append(fields, arrow.Field{Name: name, Type: arrow.PrimitiveTypes.Float32})
+	}
+	schema := arrow.NewSchema(fields, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	b.Field(0).(*array.Int64Builder).Append(timestamp())
+	b.Field(1).(*array.Uint32Builder).Append(uint32(stats.Boids))
+	for i, v := range values {
+		b.Field(2 + i).(*array.Float32Builder).Append(v)
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+
+	return writeArrow(schema, rec)
+}
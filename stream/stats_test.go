@@ -0,0 +1,33 @@
+package stream
+
+import (
+	"github.com/brodo/goBoids/boid"
+	"math"
+	"testing"
+)
+
+func TestComputeStatsPolarization(t *testing.T) {
+	east := boid.Boid{Vel: boid.Vec3{X: 0.3}}
+	north := boid.Boid{Vel: boid.Vec3{Y: 0.1}}
+	still := boid.Boid{}
+	tests := []struct {
+		name  string
+		boids []boid.Boid
+		want  float32
+	}{
+		{"aligned", []boid.Boid{east, east}, 1},
+		{"opposite", []boid.Boid{east, {Vel: boid.Vec3{X: -0.1}}}, 0},
+		{"perpendicular", []boid.Boid{east, north}, float32(math.Sqrt2 / 2)},
+		// Boids that stand still don't dilute the heading of the others
+		{"aligned and still", []boid.Boid{east, east, still, still}, 1},
+		{"all still", []boid.Boid{still, still}, 0},
+		{"no boids", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ComputeStats(tt.boids).Polarization; math.Abs(float64(got-tt.want)) > 1e-6 {
+				t.Errorf("got polarization %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
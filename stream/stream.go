@@ -0,0 +1,172 @@
+// Package stream publishes simulation frames. It works on plain particle data and has no GPU dependencies.
+package stream
+
+import (
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"math"
+	"time"
+)
+
+// FlockSubject is the default subject serialized frames are published to.
+const FlockSubject = "sensors.flock"
+
+// timestamp returns the time stamped on serialized frames in microseconds since the Unix epoch. Tests replace it
+// to get reproducible messages.
+var timestamp = func() int64 {
+	return time.Now().UnixMicro()
+}
+
+// Serializer encodes a frame for publishing.
+type Serializer interface {
+	Serialize(boids []boid.Boid) ([]byte, error)
+}
+
+// Frame is a frame of a batch, see BatchSerializer.
+type Frame struct {
+	// Index counts the frames received by the publisher.
+	Index uint64
+	Boids []boid.Boid
+	// IDs are the indices of Boids in the particle buffer, nil if Boids are all boids in order.
+	IDs []int
+}
+
+// id returns the index in the particle buffer of the i-th boid of the frame.
+func (f Frame) id(i int) int {
+	if f.IDs == nil {
+		return i
+	}
+	return f.IDs[i]
+}
+
+// sampled reports whether the boid at index i belongs to a deterministic fraction of the boids,
+// e.g. every 4th boid starting with the first for 0.25. Every boid belongs to a fraction of 0 or 1.
+func sampled(i int, fraction float64) bool {
+	if fraction <= 0 || fraction >= 1 {
+		return true
+	}
+	return math.Ceil(float64(i+1)*fraction) > math.Ceil(float64(i)*fraction)
+}
+
+// sampleFrames reduces frames to the boids selected by sampled, keeping their indices in IDs.
+func sampleFrames(frames []Frame, fraction float64) []Frame {
+	if fraction <= 0 || fraction >= 1 {
+		return frames
+	}
+	out := make([]Frame, len(frames))
+	for n, frame := range frames {
+		out[n].Index = frame.Index
+		for i, b := range frame.Boids {
+			if sampled(i, fraction) {
+				out[n].Boids = append(out[n].Boids, b)
+				out[n].IDs = append(out[n].IDs, frame.id(i))
+			}
+		}
+	}
+	return out
+}
+
+// BatchSerializer encodes several frames into a single message, with the frame index of each boid.
+type BatchSerializer interface {
+	SerializeBatch(frames []Frame) ([]byte, error)
+}
+
+// Publisher serializes particle frames and publishes them to a Sink.
+type Publisher struct {
+	Sink       Sink
+	Serializer Serializer
+	// Subject is the subject frames are published to, density histograms go to DensitySubject(Subject)
+	// and statistics to StatsSubject(Subject).
+	Subject string
+	// DensityBuckets are the lower bounds of the density histogram buckets. No histogram is published if empty.
+	DensityBuckets []int
+	// Stats publishes the statistics of every frame, see ComputeStats.
+	Stats bool
+	// Latest retains the last published message if set.
+	Latest *Latest
+	// Batch is the number of frames published together in one message. Values above 1 require
+	// Serializer to be a BatchSerializer.
+	Batch int
+
+	frames  uint64  // number of frames received so far
+	pending []Frame // frames of the current batch
+}
+
+// Run publishes every frame received on frames until the channel is closed, then closes the sink.
+func (p *Publisher) Run(frames <-chan []float32) {
+	defer func() {
+		err := p.Sink.Close()
+		if err != nil {
+			fmt.Printf("failed to close sinks: %v\n", err)
+		}
+	}()
+	for data := range frames {
+		p.Publish(data)
+	}
+	p.Flush()
+}
+
+// Flush publishes the frames of an incomplete batch.
+func (p *Publisher) Flush() {
+	if len(p.pending) == 0 {
+		return
+	}
+	p.send(p.Serializer.(BatchSerializer).SerializeBatch(p.pending))
+	p.pending = nil
+}
+
+// send publishes a serialized message. Messages that failed to serialize are dropped.
+func (p *Publisher) send(msg []byte, err error) {
+	if err != nil {
+		fmt.Printf("skipping frame that can't be serialized: %v\n", err)
+		return
+	}
+	if p.Latest != nil {
+		p.Latest.Set(msg)
+	}
+	err = p.Sink.Publish(p.Subject, msg)
+	if err != nil {
+		fmt.Printf("failed to publish particle data: %v\n", err)
+	}
+}
+
+// Publish serializes and publishes a single frame of flat particle data. With batching, the frame
+// is only published once the batch is complete.
+func (p *Publisher) Publish(data []float32) {
+	boids, err := boid.Boids(data)
+	if err != nil {
+		fmt.Printf("skipping invalid particle data: %v\n", err)
+		return
+	}
+	if len(boids) == 0 {
+		return
+	}
+	index := p.frames
+	p.frames++
+	if p.Batch > 1 {
+		p.pending = append(p.pending, Frame{Index: index, Boids: boids})
+		if len(p.pending) >= p.Batch {
+			p.Flush()
+		}
+	} else {
+		p.send(p.Serializer.Serialize(boids))
+	}
+
+	if len(p.DensityBuckets) > 0 {
+		counts := make([]uint32, len(boids))
+		for i, b := range boids {
+			counts[i] = b.Neighbors
+		}
+		histogram := DensityHistogram(counts, p.DensityBuckets)
+		err = p.Sink.Publish(DensitySubject(p.Subject), BuildDensityArrow(p.DensityBuckets, histogram))
+		if err != nil {
+			fmt.Printf("failed to publish density histogram: %v\n", err)
+		}
+	}
+	if p.Stats {
+		err = p.Sink.Publish(StatsSubject(p.Subject), BuildStatsArrow(ComputeStats(boids)))
+		if err != nil {
+			fmt.Printf("failed to publish flock statistics: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeSink records the published messages.
+type fakeSink struct {
+	mu       sync.Mutex
+	messages []message
+	closed   bool
+	err      error         // returned by Publish
+	block    chan struct{} // Publish waits until it is closed, if set
+}
+
+func (s *fakeSink) Publish(subject string, msg []byte) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("publish after close")
+	}
+	s.messages = append(s.messages, message{subject: subject, data: msg})
+	return s.err
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// count returns the number of published messages.
+func (s *fakeSink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+// subjects returns the subjects of the published messages in order.
+func (s *fakeSink) subjects() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var subjects []string
+	for _, m := range s.messages {
+		subjects = append(subjects, m.subject)
+	}
+	return subjects
+}
+
+// fakeSerializer encodes a frame as the x positions of its boids, and a batch as its frames separated by "|".
+type fakeSerializer struct{}
+
+func (fakeSerializer) Serialize(boids []boid.Boid) ([]byte, error) {
+	var xs []float32
+	for _, b := range boids {
+		xs = append(xs, b.Pos.X)
+	}
+	return []byte(fmt.Sprint(xs)), nil
+}
+
+func (f fakeSerializer) SerializeBatch(frames []Frame) ([]byte, error) {
+	var msg []byte
+	for i, frame := range frames {
+		if i > 0 {
+			msg = append(msg, '|')
+		}
+		xs, _ := f.Serialize(frame.Boids)
+		msg = append(msg, fmt.Sprintf("%d:%s", frame.Index, xs)...)
+	}
+	return msg, nil
+}
+
+// testFrame returns particle data of n boids at x positions first, first+1, ...
+func testFrame(first, n int) []float32 {
+	boids := make([]boid.Boid, n)
+	for i := range boids {
+		boids[i] = boid.Boid{Pos: boid.Vec3{X: float32(first + i)}, Vel: boid.Vec3{X: 1}, Neighbors: uint32(i)}
+	}
+	return boid.FlattenBoids(boids)
+}
+
+// runPublisher publishes frames with p and returns once the sink is closed.
+func runPublisher(p *Publisher, frames ...[]float32) {
+	ch := make(chan []float32, len(frames))
+	for _, f := range frames {
+		ch <- f
+	}
+	close(ch)
+	p.Run(ch)
+}
+
+func TestPublisherRun(t *testing.T) {
+	sink := &fakeSink{}
+	latest := &Latest{}
+	p := &Publisher{Sink: sink, Serializer: fakeSerializer{}, Subject: "test", Latest: latest}
+	runPublisher(p, testFrame(0, 2), testFrame(10, 1))
+
+	if !sink.closed {
+		t.Error("sink not closed after the frames channel was closed")
+	}
+	want := []message{{subject: "test", data: []byte("[0 1]")}, {subject: "test", data: []byte("[10]")}}
+	if !reflect.DeepEqual(sink.messages, want) {
+		t.Errorf("published %q, want %q", sink.messages, want)
+	}
+	if got := string(latest.Get()); got != "[10]" {
+		t.Errorf("latest frame is %q, want the last one", got)
+	}
+}
+
+func TestPublisherDerivedSubjects(t *testing.T) {
+	sink := &fakeSink{}
+	p := &Publisher{Sink: sink, Serializer: fakeSerializer{}, Subject: "test", DensityBuckets: []int{0, 1}, Stats: true}
+	runPublisher(p, testFrame(0, 3))
+
+	want := []string{"test", DensitySubject("test"), StatsSubject("test")}
+	if got := sink.subjects(); !reflect.DeepEqual(got, want) {
+		t.Errorf("published to %q, want %q", got, want)
+	}
+}
+
+func TestPublisherBatch(t *testing.T) {
+	sink := &fakeSink{}
+	p := &Publisher{Sink: sink, Serializer: fakeSerializer{}, Subject: "test", Batch: 2}
+	runPublisher(p, testFrame(0, 1), testFrame(1, 1), testFrame(2, 1))
+
+	// The incomplete last batch is flushed when the channel is closed
+	var got []string
+	for _, m := range sink.messages {
+		got = append(got, string(m.data))
+	}
+	want := []string{"0:[0]|1:[1]", "2:[2]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published batches %q, want %q", got, want)
+	}
+}
+
+func TestPublisherSkipsInvalidFrames(t *testing.T) {
+	sink := &fakeSink{}
+	p := &Publisher{Sink: sink, Serializer: fakeSerializer{}, Subject: "test"}
+	runPublisher(p, make([]float32, boid.Stride+1), nil, testFrame(5, 1))
+
+	if len(sink.messages) != 1 || string(sink.messages[0].data) != "[5]" {
+		t.Errorf("published %q, want only the valid frame", sink.messages)
+	}
+	if p.frames != 1 {
+		t.Errorf("counted %d frames, want 1", p.frames)
+	}
+}
+
+func TestPublisherSurvivesSinkErrors(t *testing.T) {
+	sink := &fakeSink{err: errors.New("unavailable")}
+	p := &Publisher{Sink: sink, Serializer: fakeSerializer{}, Subject: "test"}
+	runPublisher(p, testFrame(0, 1), testFrame(1, 1))
+
+	if len(sink.messages) != 2 || !sink.closed {
+		t.Errorf("published %d frames and closed %t, want 2 frames and a closed sink", len(sink.messages), sink.closed)
+	}
+}
@@ -0,0 +1,43 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DensitySubject is the subject density histograms of the frames published to subject are published to.
+func DensitySubject(subject string) string {
+	return subject + ".density"
+}
+
+// StatsSubject is the subject statistics of the frames published to subject are published to.
+func StatsSubject(subject string) string {
+	return subject + ".stats"
+}
+
+// LatestSubject is the request-reply subject that answers with the most recent frame published to subject.
+func LatestSubject(subject string) string {
+	return subject + ".latest"
+}
+
+// ControlSubject is the subject that accepts parameter updates for the simulation publishing to subject.
+func ControlSubject(subject string) string {
+	return subject + ".control"
+}
+
+// ValidateSubject checks that subject can be published to: dot-separated, non-empty tokens without
+// whitespace or the wildcards * and >.
+func ValidateSubject(subject string) error {
+	if subject == "" {
+		return fmt.Errorf("subject must not be empty")
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" {
+			return fmt.Errorf("subject %q has an empty token", subject)
+		}
+		if strings.ContainsAny(token, "*> \t\r\n") {
+			return fmt.Errorf("subject %q must not contain wildcards or whitespace", subject)
+		}
+	}
+	return nil
+}
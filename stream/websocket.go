@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webSocketQueueSize is the number of frames buffered per client before frames are dropped for it.
+	webSocketQueueSize = 4
+	// webSocketWriteTimeout is how long a client may take to receive a frame before it is disconnected.
+	webSocketWriteTimeout = 5 * time.Second
+	// webSocketReadLimit is the largest message a client may send. Messages sent by clients are ignored, so
+	// a client sending more than this is disconnected.
+	webSocketReadLimit = 4096
+)
+
+// webSocketUpgrader accepts clients from any origin, e.g. a page opened from a file.
+var webSocketUpgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// WebSocketSink is a Sink that streams every message as a binary WebSocket frame to all connected clients,
+// e.g. browsers. Each client has its own queue and frames are dropped for clients that don't keep up, so
+// a slow client never holds up the others or the publisher. Messages sent by clients are ignored.
+type WebSocketSink struct {
+	server *http.Server
+
+	mu      sync.Mutex
+	clients map[*webSocketClient]struct{}
+}
+
+// webSocketClient is a connected client with the frames waiting to be written to it.
+type webSocketClient struct {
+	conn    *websocket.Conn
+	queue   chan []byte
+	dropped uint64 // frames dropped because the queue was full, guarded by the sink's mu
+}
+
+// NewWebSocketSink returns a WebSocketSink that accepts clients on addr in the background.
+func NewWebSocketSink(addr string) *WebSocketSink {
+	w := newWebSocketSink()
+	w.server = &http.Server{Addr: addr, Handler: w}
+	go func() {
+		err := w.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("WebSocket endpoint stopped: %v\n", err)
+		}
+	}()
+	return w
+}
+
+// newWebSocketSink returns a WebSocketSink without a server, which only accepts clients through ServeHTTP.
+func newWebSocketSink() *WebSocketSink {
+	return &WebSocketSink{clients: map[*webSocketClient]struct{}{}}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and streams frames to it until either side closes it.
+func (w *WebSocketSink) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Upgrade responds with an error itself if the request isn't a valid handshake
+	conn, err := webSocketUpgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		return
+	}
+	conn.SetReadLimit(webSocketReadLimit)
+
+	c := &webSocketClient{conn: conn, queue: make(chan []byte, webSocketQueueSize)}
+	w.mu.Lock()
+	w.clients[c] = struct{}{}
+	w.mu.Unlock()
+	go c.write()
+
+	// Reading answers pings and notices when the client closes the connection or goes away
+	for {
+		_, _, err = conn.NextReader()
+		if err != nil {
+			break
+		}
+	}
+	w.remove(c)
+}
+
+// remove stops streaming to c. Its writer sends a close frame once the queued frames are written.
+func (w *WebSocketSink) remove(c *webSocketClient) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.clients[c]; ok {
+		delete(w.clients, c)
+		close(c.queue)
+	}
+}
+
+// write writes the queued frames to the client until the queue is closed or writing fails.
+func (c *webSocketClient) write() {
+	defer c.conn.Close()
+	for msg := range c.queue {
+		err := c.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+		if err == nil {
+			err = c.conn.WriteMessage(websocket.BinaryMessage, msg)
+		}
+		if err != nil {
+			// Closing the connection also ends the read loop, which removes the client
+			return
+		}
+	}
+	closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(webSocketWriteTimeout))
+}
+
+// Publish queues msg for every connected client. The subject is ignored.
+func (w *WebSocketSink) Publish(subject string, msg []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for c := range w.clients {
+		select {
+		case c.queue <- msg:
+		default:
+			c.dropped++
+			if c.dropped == 1 || c.dropped%100 == 0 {
+				fmt.Printf("WebSocket client %s is too slow, dropped %d frames so far\n", c.conn.RemoteAddr(), c.dropped)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops accepting clients and closes the connected ones once their queued frames are written.
+func (w *WebSocketSink) Close() error {
+	var err error
+	if w.server != nil {
+		err = w.server.Close()
+	}
+	w.mu.Lock()
+	clients := make([]*webSocketClient, 0, len(w.clients))
+	for c := range w.clients {
+		clients = append(clients, c)
+	}
+	w.mu.Unlock()
+	for _, c := range clients {
+		w.remove(c)
+	}
+	return err
+}
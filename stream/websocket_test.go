@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds how long the tests wait for a client or the sink.
+const testTimeout = 5 * time.Second
+
+// serveWebSocket serves a WebSocketSink on a test server, which is closed when the test ends.
+func serveWebSocket(t *testing.T) (*WebSocketSink, *httptest.Server) {
+	t.Helper()
+	sink := newWebSocketSink()
+	server := httptest.NewServer(sink)
+	t.Cleanup(func() {
+		sink.Close()
+		server.Close()
+	})
+	return sink, server
+}
+
+// dialWebSocket connects a client to server and waits until sink streams to it.
+func dialWebSocket(t *testing.T, sink *WebSocketSink, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	sink.mu.Lock()
+	clients := len(sink.clients)
+	sink.mu.Unlock()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitForClients(t, sink, clients+1)
+	return conn
+}
+
+// waitForClients waits until sink has n clients.
+func waitForClients(t *testing.T, sink *WebSocketSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		sink.mu.Lock()
+		clients := len(sink.clients)
+		sink.mu.Unlock()
+		if clients == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d clients, want %d", clients, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebSocketSinkStreamsFrames(t *testing.T) {
+	sink, server := serveWebSocket(t)
+	conns := []*websocket.Conn{dialWebSocket(t, sink, server)}
+	conns = append(conns, dialWebSocket(t, sink, server))
+
+	frames := [][]byte{[]byte("first"), bytes.Repeat([]byte{1}, 70000)}
+	for _, frame := range frames {
+		err := sink.Publish("boids", frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		for _, want := range frames {
+			kind, got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != websocket.BinaryMessage || !bytes.Equal(got, want) {
+				t.Errorf("got message of type %d with %d bytes, want a binary message with %d bytes", kind, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestWebSocketSinkAnswersPings(t *testing.T) {
+	sink, server := serveWebSocket(t)
+	conn := dialWebSocket(t, sink, server)
+	pongs := make(chan string, 1)
+	conn.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	// Reading handles the pong
+	go func() {
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	err := conn.WriteControl(websocket.PingMessage, []byte("are you there"), time.Now().Add(testTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-pongs:
+		if data != "are you there" {
+			t.Errorf("got pong %q, want the ping's payload", data)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("got no pong")
+	}
+}
+
+func TestWebSocketSinkClose(t *testing.T) {
+	sink, server := serveWebSocket(t)
+	conn := dialWebSocket(t, sink, server)
+	err := sink.Publish("boids", []byte("last"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued frame is still written before the close frame
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, got, err := conn.ReadMessage()
+	if err != nil || string(got) != "last" {
+		t.Fatalf("got %q, %v, want the queued frame", got, err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("got %v, want a normal closure", err)
+	}
+}
+
+func TestWebSocketSinkRejectsInvalidHandshakes(t *testing.T) {
+	_, server := serveWebSocket(t)
+	valid := http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"Upgrade"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+	tests := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{"no upgrade", "Upgrade", ""},
+		{"no connection upgrade", "Connection", "keep-alive"},
+		{"no version", "Sec-Websocket-Version", ""},
+		{"old version", "Sec-Websocket-Version", "8"},
+		{"no key", "Sec-Websocket-Key", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range valid {
+				req.Header[k] = v
+			}
+			req.Header.Set(tt.header, tt.value)
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestWebSocketSinkRejectsInvalidFrameLengths(t *testing.T) {
+	sink, server := serveWebSocket(t)
+	conn := dialWebSocket(t, sink, server)
+	// A masked binary frame with a 64-bit length above 2^63, which doesn't fit an int64
+	frame := []byte{0x82, 0x80 | 127}
+	frame = binary.BigEndian.AppendUint64(frame, 1<<63+1)
+	frame = append(frame, 0, 0, 0, 0)
+	err := conn.UnderlyingConn().SetWriteDeadline(time.Now().Add(testTimeout))
+	if err == nil {
+		_, err = conn.UnderlyingConn().Write(frame)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForClients(t, sink, 0)
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, _, err = conn.ReadMessage()
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("got %v, want the connection to be closed", err)
+	}
+}
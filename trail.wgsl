@@ -0,0 +1,24 @@
+// Full-screen passes for boid trails, see trails.go.
+// The trail texture holds the boids of previous frames. Each frame it is faded and the current boids are
+// drawn into it, and then it is drawn to the screen underneath the current boids.
+
+@group(0) @binding(0) var trail: texture_2d<f32>;
+
+// A single triangle that covers the whole screen
+@vertex
+fn fullscreen_vs(@builtin(vertex_index) vertex: u32) -> @builtin(position) vec4<f32> {
+    let uv = vec2<f32>(f32((vertex << 1u) & 2u), f32(vertex & 2u));
+    return vec4<f32>(uv * 2.0 - 1.0, 0.0, 1.0);
+}
+
+// The fade pipeline ignores this color and scales the trail by one minus the blend constant, which holds the decay
+@fragment
+fn fade_fs() -> @location(0) vec4<f32> {
+    return vec4<f32>(1.0);
+}
+
+// The trail texture has the size of the surface, so pixels map one to one
+@fragment
+fn composite_fs(@builtin(position) position: vec4<f32>) -> @location(0) vec4<f32> {
+    return textureLoad(trail, vec2<i32>(position.xy), 0);
+}
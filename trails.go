@@ -0,0 +1,262 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/cogentcore/webgpu/wgpu"
+)
+
+//go:embed trail.wgsl
+var trailShader string
+
+// createTrailPipelines creates the pipelines that fade the trail texture, draw the boids into it and
+// draw it to the screen. drawShader and vertexBuffers are those of the render pipeline.
+func (s *State) createTrailPipelines(drawShader *wgpu.ShaderModule, vertexBuffers []wgpu.VertexBufferLayout) error {
+	shader, err := s.device.CreateShaderModule(&wgpu.ShaderModuleDescriptor{
+		Label: "trail.wgsl",
+		WGSLDescriptor: &wgpu.ShaderModuleWGSLDescriptor{
+			Code: trailShader,
+		},
+	})
+	if err != nil {
+		return shaderError("trail.wgsl", trailShader, err)
+	}
+	defer shader.Release()
+
+	s.fadePipeline, err = s.device.CreateRenderPipeline(&wgpu.RenderPipelineDescriptor{
+		Label: "Fade pipeline",
+		Vertex: wgpu.VertexState{
+			Module:     shader,
+			EntryPoint: "fullscreen_vs",
+		},
+		Fragment: &wgpu.FragmentState{
+			Module:     shader,
+			EntryPoint: "fade_fs",
+			Targets: []wgpu.ColorTargetState{
+				{
+					Format: s.config.Format,
+					// trail = trail * (1 - decay), the decay is set as the blend constant
+					Blend: &wgpu.BlendState{
+						Color: wgpu.BlendComponent{
+							Operation: wgpu.BlendOperationAdd,
+							SrcFactor: wgpu.BlendFactorZero,
+							DstFactor: wgpu.BlendFactorOneMinusConstant,
+						},
+						Alpha: wgpu.BlendComponent{
+							Operation: wgpu.BlendOperationAdd,
+							SrcFactor: wgpu.BlendFactorZero,
+							DstFactor: wgpu.BlendFactorOneMinusConstant,
+						},
+					},
+					WriteMask: wgpu.ColorWriteMaskAll,
+				},
+			},
+		},
+		Primitive: wgpu.PrimitiveState{
+			Topology:  wgpu.PrimitiveTopologyTriangleList,
+			FrontFace: wgpu.FrontFaceCCW,
+		},
+		Multisample: wgpu.MultisampleState{
+			Count: 1,
+			Mask:  0xFFFFFFFF,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The boids are drawn into the trail texture without multisampling
+	s.trailBoidPipeline, err = s.device.CreateRenderPipeline(&wgpu.RenderPipelineDescriptor{
+		Label: "Trail boid pipeline",
+		Vertex: wgpu.VertexState{
+			Module:     drawShader,
+			EntryPoint: "main_vs",
+			Buffers:    vertexBuffers,
+		},
+		Fragment: &wgpu.FragmentState{
+			Module:     drawShader,
+			EntryPoint: "main_fs",
+			Targets: []wgpu.ColorTargetState{
+				{
+					Format:    s.config.Format,
+					WriteMask: wgpu.ColorWriteMaskAll,
+				},
+			},
+		},
+		Primitive: wgpu.PrimitiveState{
+			Topology:  wgpu.PrimitiveTopologyTriangleList,
+			FrontFace: wgpu.FrontFaceCCW,
+		},
+		Multisample: wgpu.MultisampleState{
+			Count: 1,
+			Mask:  0xFFFFFFFF,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Bind groups of pipelines with automatic layouts can't be shared, so the draw parameters are bound twice
+	layout := s.trailBoidPipeline.GetBindGroupLayout(0)
+	defer layout.Release()
+	s.trailDrawBindGroup, err = s.device.CreateBindGroup(&wgpu.BindGroupDescriptor{
+		Layout: layout,
+		Entries: []wgpu.BindGroupEntry{
+			{
+				Binding: 0,
+				Buffer:  s.drawParamBuffer,
+				Size:    wgpu.WholeSize,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	s.compositePipeline, err = s.device.CreateRenderPipeline(&wgpu.RenderPipelineDescriptor{
+		Label: "Trail composite pipeline",
+		Vertex: wgpu.VertexState{
+			Module:     shader,
+			EntryPoint: "fullscreen_vs",
+		},
+		Fragment: &wgpu.FragmentState{
+			Module:     shader,
+			EntryPoint: "composite_fs",
+			Targets: []wgpu.ColorTargetState{
+				{
+					Format: s.config.Format,
+					// Fading scales the color and the alpha of the trails alike, so they are blended as premultiplied
+					// colors over the background
+					Blend: &wgpu.BlendState{
+						Color: wgpu.BlendComponent{
+							Operation: wgpu.BlendOperationAdd,
+							SrcFactor: wgpu.BlendFactorOne,
+							DstFactor: wgpu.BlendFactorOneMinusSrcAlpha,
+						},
+						Alpha: wgpu.BlendComponent{
+							Operation: wgpu.BlendOperationAdd,
+							SrcFactor: wgpu.BlendFactorOne,
+							DstFactor: wgpu.BlendFactorOneMinusSrcAlpha,
+						},
+					},
+					WriteMask: wgpu.ColorWriteMaskAll,
+				},
+			},
+		},
+		Primitive: wgpu.PrimitiveState{
+			Topology:  wgpu.PrimitiveTopologyTriangleList,
+			FrontFace: wgpu.FrontFaceCCW,
+		},
+		Multisample: wgpu.MultisampleState{
+			Count: s.sampleCount,
+			Mask:  0xFFFFFFFF,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.createTrailTexture()
+}
+
+// createTrailTexture (re)creates the trail texture to match the current surface size. Trails drawn so far are lost.
+func (s *State) createTrailTexture() error {
+	s.releaseTrailTexture()
+
+	texture, err := s.device.CreateTexture(&wgpu.TextureDescriptor{
+		Label: "Trail Texture",
+		Size: wgpu.Extent3D{
+			Width:              s.config.Width,
+			Height:             s.config.Height,
+			DepthOrArrayLayers: 1,
+		},
+		MipLevelCount: 1,
+		SampleCount:   1,
+		Dimension:     wgpu.TextureDimension2D,
+		Format:        s.config.Format,
+		Usage:         wgpu.TextureUsageRenderAttachment | wgpu.TextureUsageTextureBinding,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create trail texture: %w", err)
+	}
+	s.trailTexture = texture
+	s.trailView, err = texture.CreateView(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create trail texture view: %w", err)
+	}
+
+	layout := s.compositePipeline.GetBindGroupLayout(0)
+	defer layout.Release()
+	s.trailBindGroup, err = s.device.CreateBindGroup(&wgpu.BindGroupDescriptor{
+		Layout: layout,
+		Entries: []wgpu.BindGroupEntry{
+			{
+				Binding:     0,
+				TextureView: s.trailView,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create trail bind group: %w", err)
+	}
+	return nil
+}
+
+func (s *State) releaseTrailTexture() {
+	if s.trailBindGroup != nil {
+		s.trailBindGroup.Release()
+		s.trailBindGroup = nil
+	}
+	if s.trailView != nil {
+		s.trailView.Release()
+		s.trailView = nil
+	}
+	if s.trailTexture != nil {
+		s.trailTexture.Release()
+		s.trailTexture = nil
+	}
+}
+
+// releaseTrails releases the trail texture and pipelines.
+func (s *State) releaseTrails() {
+	s.releaseTrailTexture()
+	if s.trailDrawBindGroup != nil {
+		s.trailDrawBindGroup.Release()
+		s.trailDrawBindGroup = nil
+	}
+	for _, pipeline := range []**wgpu.RenderPipeline{&s.fadePipeline, &s.trailBoidPipeline, &s.compositePipeline} {
+		if *pipeline != nil {
+			(*pipeline).Release()
+			*pipeline = nil
+		}
+	}
+}
+
+// drawTrails records the render pass that fades the trail texture by the trail decay and adds the current boids.
+func (s *State) drawTrails(commandEncoder *wgpu.CommandEncoder) error {
+	renderPass := commandEncoder.BeginRenderPass(&wgpu.RenderPassDescriptor{
+		ColorAttachments: []wgpu.RenderPassColorAttachment{
+			{
+				View:    s.trailView,
+				LoadOp:  wgpu.LoadOpLoad,
+				StoreOp: wgpu.StoreOpStore,
+			},
+		},
+	})
+	decay := float64(s.trailDecay)
+	renderPass.SetBlendConstant(&wgpu.Color{R: decay, G: decay, B: decay, A: decay})
+	renderPass.SetPipeline(s.fadePipeline)
+	renderPass.Draw(3, 1, 0, 0)
+
+	renderPass.SetPipeline(s.trailBoidPipeline)
+	renderPass.SetBindGroup(0, s.trailDrawBindGroup, nil)
+	renderPass.SetVertexBuffer(0, s.particleBuffer, 0, wgpu.WholeSize)
+	renderPass.SetVertexBuffer(1, s.vertexBuffer, 0, wgpu.WholeSize)
+	renderPass.Draw(s.vertexCount, s.particleCount, 0, 0)
+	err := renderPass.End()
+	if err != nil {
+		return fmt.Errorf("failed to complete trail render pass: %w", err)
+	}
+	renderPass.Release()
+	return nil
+}
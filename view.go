@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Bounds for the view zoom, so the flock can neither vanish nor fill the window with a single boid
+const (
+	minZoom = 0.25
+	maxZoom = 32
+)
+
+// zoomStep is the zoom factor of one scroll wheel notch.
+const zoomStep = 1.1
+
+// Bounds of the boid size, and the factor one key press changes it by
+const (
+	minBoidSize  = 0.25
+	maxBoidSize  = 16
+	boidSizeStep = 1.25
+)
+
+// SetBoidSize scales the boid triangle by size, clamped between minBoidSize and maxBoidSize.
+func (s *State) SetBoidSize(size float32) error {
+	s.drawParams.BoidSize = min(max(size, minBoidSize), maxBoidSize)
+	err := s.queue.WriteBuffer(s.drawParamBuffer, 0, s.drawParams.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to update boid size: %w", err)
+	}
+	return nil
+}
+
+// SetView shows the world around center magnified by zoom, which is clamped between minZoom and maxZoom.
+// Only drawing is affected, the simulation keeps running in world space.
+func (s *State) SetView(center [2]float32, zoom float32) error {
+	s.drawParams.ViewCenter = center
+	s.drawParams.ViewZoom = min(max(zoom, minZoom), maxZoom)
+	err := s.queue.WriteBuffer(s.drawParamBuffer, 0, s.drawParams.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to update view: %w", err)
+	}
+	return nil
+}
+
+// ResetView shows the whole world again.
+func (s *State) ResetView() error {
+	return s.SetView([2]float32{}, 1)
+}
+
+// ZoomAt zooms in by notches scroll wheel notches, or out for negative values, keeping the world point
+// at the clip space position p in place.
+func (s *State) ZoomAt(p [2]float32, notches float64) error {
+	anchor := s.clipToWorld(p)
+	zoom := min(max(s.drawParams.ViewZoom*float32(math.Pow(zoomStep, notches)), minZoom), maxZoom)
+	return s.SetView([2]float32{anchor[0] - p[0]/zoom, anchor[1] - p[1]/zoom}, zoom)
+}
+
+// Pan moves the view by delta in clip space, e.g. the distance the cursor was dragged.
+func (s *State) Pan(delta [2]float32) error {
+	zoom := s.drawParams.ViewZoom
+	center := s.drawParams.ViewCenter
+	return s.SetView([2]float32{center[0] - delta[0]/zoom, center[1] - delta[1]/zoom}, zoom)
+}
+
+// clipToWorld converts a position in clip space to the world position drawn there.
+func (s *State) clipToWorld(p [2]float32) [2]float32 {
+	zoom := s.drawParams.ViewZoom
+	center := s.drawParams.ViewCenter
+	return [2]float32{p[0]/zoom + center[0], p[1]/zoom + center[1]}
+}
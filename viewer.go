@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brodo/goBoids/boid"
+	"github.com/brodo/goBoids/stream"
+	"github.com/cogentcore/webgpu/wgpu"
+	"github.com/nats-io/nats.go"
+)
+
+// SubscribeFrames subscribes to cfg.Subject and decodes the received Arrow records into particle data.
+// Only the newest frame is kept in the returned channel, so a slow renderer never falls behind the stream.
+// The returned function unsubscribes and closes the connection.
+func SubscribeFrames(cfg NATSConfig) (<-chan []float32, func(), error) {
+	nc, err := nats.Connect(cfg.URL, natsOptions(cfg.URL, cfg)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	frames := make(chan []float32, 1)
+	var lastErr string
+	_, err = nc.Subscribe(cfg.Subject, func(msg *nats.Msg) {
+		boids, err := stream.DecodeArrow(msg.Data)
+		if err != nil {
+			// A mismatching producer sends the same broken frame over and over, so only log changes
+			if err.Error() != lastErr {
+				lastErr = err.Error()
+				fmt.Println("skipping frame:", err)
+			}
+			return
+		}
+		lastErr = ""
+
+		// Replace a frame that hasn't been rendered yet with the newer one
+		select {
+		case <-frames:
+		default:
+		}
+		frames <- boid.FlattenBoids(boids)
+	})
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	return frames, func() {
+		err := nc.Drain()
+		if err != nil {
+			fmt.Printf("failed to drain NATS connection: %v\n", err)
+		}
+	}, nil
+}
+
+// SetParticles uploads particle data to the GPU and draws it from the next frame on.
+// Particles beyond the capacity of the particle buffer are ignored.
+func (s *State) SetParticles(particles []float32) error {
+	count := min(len(particles)/boid.Stride, int(s.numParticles))
+	if count > 0 {
+		err := s.queue.WriteBuffer(s.particleBuffer, 0, wgpu.ToBytes(particles[:boid.Stride*count]))
+		if err != nil {
+			return fmt.Errorf("failed to upload particles: %w", err)
+		}
+	}
+	s.particleCount = uint32(count)
+	return nil
+}